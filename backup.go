@@ -0,0 +1,461 @@
+package common
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Backup archives are tar files, optionally compressed with gzip or zstd. The
+// first entry is backup.json with the manifest header, followed by one entry per
+// object in listing order and finally manifest.json with the full manifest.
+// Every object entry carries its BackupEntry as a PAX record, so an interrupted
+// archive can still be verified and restored up to its last object.
+const (
+	backupVersion      = 1
+	backupHeaderName   = "backup.json"
+	backupManifestName = "manifest.json"
+	backupObjectPrefix = "objects/"
+	backupEntryRecord  = "LINGIO.entry"
+)
+
+var (
+	// ErrBackupIncomplete is returned for archives that end before their manifest,
+	// e.g. because the backup was interrupted.
+	ErrBackupIncomplete = errors.New("backup archive is incomplete")
+	// ErrBackupCorrupt is returned for archives whose objects do not match their checksums or manifest.
+	ErrBackupCorrupt = errors.New("backup archive is corrupt")
+)
+
+// BackupMode records how the objects in an archive relate to the bucket.
+type BackupMode string
+
+const (
+	// BackupRaw archives objects as stored in the bucket, e.g. still encrypted.
+	BackupRaw BackupMode = "raw"
+	// BackupDecrypted archives objects read through an EncryptedStore.
+	BackupDecrypted BackupMode = "decrypted"
+)
+
+// BackupManifest describes the objects in a backup archive.
+type BackupManifest struct {
+	Version int        `json:"version"`
+	Store   string     `json:"store"`
+	Mode    BackupMode `json:"mode"`
+	Created time.Time  `json:"created"`
+	Prefix  string     `json:"prefix,omitempty"`
+	// StartAfter is set if the archive continues an interrupted backup.
+	StartAfter string        `json:"startAfter,omitempty"`
+	Objects    []BackupEntry `json:"objects,omitempty"`
+}
+
+// LastKey returns the key of the last object in the archive, which is where an
+// interrupted backup should be resumed.
+func (m BackupManifest) LastKey() string {
+	if len(m.Objects) == 0 {
+		return m.StartAfter
+	}
+	return m.Objects[len(m.Objects)-1].Key
+}
+
+// BackupEntry describes a single archived object.
+type BackupEntry struct {
+	Key             string            `json:"key"`
+	ETag            string            `json:"etag,omitempty"`
+	Size            int64             `json:"size"`
+	SHA256          string            `json:"sha256"`
+	LastModified    time.Time         `json:"lastModified,omitzero"`
+	Expiration      time.Time         `json:"expiration,omitzero"`
+	ContentType     string            `json:"contentType,omitempty"`
+	ContentEncoding string            `json:"contentEncoding,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	Tags            map[string]string `json:"tags,omitempty"`
+}
+
+// BackupOptions configures Backup.
+type BackupOptions struct {
+	// Mode is recorded in the manifest and checked on restore. Defaults to BackupRaw.
+	Mode BackupMode
+	// Compression compresses the whole archive. Empty writes a plain tar file.
+	Compression Compression
+	// Prefix limits the backup to objects with the key prefix.
+	Prefix string
+	// StartAfter resumes an interrupted backup after the LastKey of its archive.
+	StartAfter string
+	// Concurrency is the number of objects fetched ahead. Defaults to DefaultBatchConcurrency.
+	Concurrency int
+	// Progress is called after each object is archived.
+	Progress func(BackupEntry)
+}
+
+// RestoreOptions configures Restore.
+type RestoreOptions struct {
+	// Mode must match the mode of the archive. Defaults to BackupRaw.
+	Mode BackupMode
+	// SkipExisting leaves objects that already exist in the store untouched,
+	// so an interrupted restore can be run again.
+	SkipExisting bool
+	// Concurrency is the number of concurrent writes. Defaults to DefaultBatchConcurrency.
+	Concurrency int
+	// Progress is called after each object is restored or skipped.
+	Progress func(BackupEntry)
+}
+
+// RestoreResult summarizes a restore.
+type RestoreResult struct {
+	Manifest BackupManifest
+	Restored int
+	// Skipped counts existing objects with SkipExisting and objects that have already expired.
+	Skipped int
+}
+
+// Backup writes every object in the store to w as a backup archive and returns its
+// manifest. If the backup fails, the archive is still closed so that it can be
+// verified and the backup resumed with StartAfter set to the LastKey of the manifest.
+func Backup(ctx context.Context, store LingioStore, w io.Writer, opts BackupOptions) (manifest BackupManifest, err error) {
+	ctx, span := tracer.Start(ctx, "backup.Backup")
+	defer span.End()
+	defer span.RecordError(err)
+
+	manifest = BackupManifest{
+		Version:    backupVersion,
+		Store:      store.StoreName(),
+		Mode:       opts.Mode,
+		Created:    time.Now().UTC(),
+		Prefix:     opts.Prefix,
+		StartAfter: opts.StartAfter,
+	}
+	if manifest.Mode == "" {
+		manifest.Mode = BackupRaw
+	}
+
+	var aw io.WriteCloser = nopWriteCloser{w}
+	if opts.Compression != "" {
+		if aw, err = newCompressWriter(opts.Compression, w); err != nil {
+			return manifest, err
+		}
+	}
+	tw := tar.NewWriter(aw)
+	defer func() {
+		if cerr := tw.Close(); err == nil {
+			err = cerr
+		}
+		if cerr := aw.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	if err := writeBackupJSON(tw, backupHeaderName, manifest); err != nil {
+		return manifest, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	listing := store.ListObjectsWithOptions(ctx, ListOptions{Prefix: opts.Prefix, StartAfter: opts.StartAfter})
+	for res := range getListedObjectsInOrder(ctx, store, listing, opts.Concurrency) {
+		if res.Err != nil {
+			return manifest, res.Err
+		}
+		sum := sha256.Sum256(res.Data)
+		entry := BackupEntry{
+			Key:             res.Key,
+			ETag:            res.Info.ETag,
+			Size:            int64(len(res.Data)),
+			SHA256:          hex.EncodeToString(sum[:]),
+			LastModified:    res.Info.LastModified,
+			Expiration:      res.Info.Expiration,
+			ContentType:     res.Info.ContentType,
+			ContentEncoding: res.Info.ContentEncoding,
+			Metadata:        res.Info.Metadata,
+			Tags:            res.Info.Tags,
+		}
+		if err := writeBackupObject(tw, entry, res.Data); err != nil {
+			return manifest, err
+		}
+		manifest.Objects = append(manifest.Objects, entry)
+		if opts.Progress != nil {
+			opts.Progress(entry)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return manifest, NewErrorE(http.StatusServiceUnavailable, err).Str("bucket", manifest.Store).Msg("Backup cancelled.")
+	}
+	return manifest, writeBackupJSON(tw, backupManifestName, manifest)
+}
+
+// Restore writes the objects of a backup archive into the store. The archive mode
+// must match opts.Mode, so that decrypted archives are not written into raw buckets
+// and vice versa. Incomplete archives are restored up to their last object and
+// reported with ErrBackupIncomplete.
+func Restore(ctx context.Context, store LingioStore, r io.Reader, opts RestoreOptions) (result RestoreResult, err error) {
+	ctx, span := tracer.Start(ctx, "backup.Restore")
+	defer span.End()
+	defer span.RecordError(err)
+
+	mode := opts.Mode
+	if mode == "" {
+		mode = BackupRaw
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultBatchConcurrency
+	}
+
+	grp, gctx := errgroup.WithContext(ctx)
+	grp.SetLimit(concurrency)
+	var mu sync.Mutex
+	done := func(entry BackupEntry, skipped bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if skipped {
+			result.Skipped++
+		} else {
+			result.Restored++
+		}
+		if opts.Progress != nil {
+			opts.Progress(entry)
+		}
+	}
+
+	onHeader := func(header BackupManifest) error {
+		if header.Mode != mode {
+			return fmt.Errorf("restore: archive mode is %s, not %s", header.Mode, mode)
+		}
+		return nil
+	}
+	onObject := func(entry BackupEntry, data []byte) error {
+		if !entry.Expiration.IsZero() && !time.Now().Before(entry.Expiration) {
+			done(entry, true)
+			return nil
+		}
+		grp.Go(func() error {
+			_, err := store.PutObjectWithOptions(gctx, entry.Key, data, PutOptions{
+				IfNoneMatch:     opts.SkipExisting,
+				ContentType:     entry.ContentType,
+				ContentEncoding: entry.ContentEncoding,
+				Metadata:        entry.Metadata,
+				Tags:            entry.Tags,
+			})
+			if opts.SkipExisting && errors.Is(err, ErrPreconditionFailed) {
+				done(entry, true)
+				return nil
+			} else if err != nil {
+				return err
+			}
+			done(entry, false)
+			return nil
+		})
+		// stop reading the archive once a write has failed
+		return gctx.Err()
+	}
+
+	manifest, readErr := readBackup(r, onHeader, onObject)
+	err = grp.Wait()
+	result.Manifest = manifest
+	if err != nil {
+		return result, err
+	}
+	return result, readErr
+}
+
+// VerifyBackup reads the whole archive, checks every object against its checksum
+// and the manifest, and returns the manifest. Incomplete archives are reported
+// with ErrBackupIncomplete and the manifest of the objects read so far.
+func VerifyBackup(r io.Reader) (BackupManifest, error) {
+	return readBackup(r, nil, nil)
+}
+
+// readBackup reads an archive, calling onHeader with the manifest header and
+// onObject for each verified object.
+func readBackup(r io.Reader, onHeader func(BackupManifest) error, onObject func(BackupEntry, []byte) error) (BackupManifest, error) {
+	ar, err := newBackupArchiveReader(r)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	defer ar.Close()
+	tr := tar.NewReader(ar)
+
+	var manifest BackupManifest
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != backupHeaderName {
+		return manifest, fmt.Errorf("%w: missing %s", ErrBackupCorrupt, backupHeaderName)
+	}
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return manifest, fmt.Errorf("%w: %s: %v", ErrBackupCorrupt, backupHeaderName, err)
+	}
+	if manifest.Version != backupVersion {
+		return manifest, fmt.Errorf("%w: unsupported version %d", ErrBackupCorrupt, manifest.Version)
+	}
+	if onHeader != nil {
+		if err := onHeader(manifest); err != nil {
+			return manifest, err
+		}
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return manifest, ErrBackupIncomplete
+		} else if err != nil {
+			return manifest, fmt.Errorf("%w: %v", ErrBackupCorrupt, err)
+		}
+
+		if hdr.Name == backupManifestName {
+			var full BackupManifest
+			if err := json.NewDecoder(tr).Decode(&full); err != nil {
+				return manifest, fmt.Errorf("%w: %s: %v", ErrBackupCorrupt, backupManifestName, err)
+			}
+			if err := compareBackupManifests(manifest, full); err != nil {
+				return manifest, err
+			}
+			return full, nil
+		}
+
+		var entry BackupEntry
+		if err := json.Unmarshal([]byte(hdr.PAXRecords[backupEntryRecord]), &entry); err != nil {
+			return manifest, fmt.Errorf("%w: %s: %v", ErrBackupCorrupt, hdr.Name, err)
+		}
+		data, err := io.ReadAll(tr)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return manifest, ErrBackupIncomplete
+		} else if err != nil {
+			return manifest, fmt.Errorf("%w: %s: %v", ErrBackupCorrupt, hdr.Name, err)
+		}
+		sum := sha256.Sum256(data)
+		if int64(len(data)) != entry.Size || hex.EncodeToString(sum[:]) != entry.SHA256 {
+			return manifest, fmt.Errorf("%w: %s: checksum mismatch", ErrBackupCorrupt, entry.Key)
+		}
+		if onObject != nil {
+			if err := onObject(entry, data); err != nil {
+				return manifest, err
+			}
+		}
+		manifest.Objects = append(manifest.Objects, entry)
+	}
+}
+
+// compareBackupManifests checks that the objects read from the archive match the manifest.
+func compareBackupManifests(read, manifest BackupManifest) error {
+	if len(read.Objects) != len(manifest.Objects) {
+		return fmt.Errorf("%w: manifest lists %d objects, archive has %d", ErrBackupCorrupt, len(manifest.Objects), len(read.Objects))
+	}
+	for i, entry := range manifest.Objects {
+		if read.Objects[i].Key != entry.Key || read.Objects[i].SHA256 != entry.SHA256 {
+			return fmt.Errorf("%w: %s does not match manifest", ErrBackupCorrupt, read.Objects[i].Key)
+		}
+	}
+	return nil
+}
+
+func writeBackupJSON(tw *tar.Writer, name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(data)),
+		Mode:     0644,
+		ModTime:  time.Now().UTC(),
+		Format:   tar.FormatPAX,
+	}); err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+func writeBackupObject(tw *tar.Writer, entry BackupEntry, data []byte) error {
+	record, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       backupObjectPrefix + entry.Key,
+		Size:       int64(len(data)),
+		Mode:       0644,
+		ModTime:    entry.LastModified,
+		Format:     tar.FormatPAX,
+		PAXRecords: map[string]string{backupEntryRecord: string(record)},
+	}); err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// newBackupArchiveReader detects a compressed archive by its magic number.
+func newBackupArchiveReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return newDecompressReader(CompressionGzip, io.NopCloser(br), 0)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return newDecompressReader(CompressionZstd, io.NopCloser(br), 0)
+	}
+	return io.NopCloser(br), nil
+}
+
+// getListedObjectsInOrder fetches up to concurrency objects of the listing ahead
+// while returning the results in listing order. Listing errors are forwarded as
+// results without a key.
+func getListedObjectsInOrder(ctx context.Context, store LingioStore, listing <-chan ObjectInfo, concurrency int) <-chan BatchResult {
+	if concurrency <= 0 {
+		concurrency = DefaultBatchConcurrency
+	}
+	pending := make(chan chan BatchResult, concurrency)
+	go func() {
+		defer close(pending)
+		for info := range listing {
+			next := make(chan BatchResult, 1)
+			select {
+			case pending <- next:
+			case <-ctx.Done():
+				return
+			}
+			if info.Err != nil {
+				next <- BatchResult{Err: info.Err}
+				return
+			}
+			go func(key string) {
+				data, info, err := store.GetObject(ctx, key)
+				next <- BatchResult{Key: key, Data: data, Info: info, Err: err}
+			}(info.Key)
+		}
+	}()
+
+	results := make(chan BatchResult)
+	go func() {
+		defer close(results)
+		for next := range pending {
+			res := <-next
+			select {
+			case results <- res:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return results
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
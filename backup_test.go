@@ -0,0 +1,113 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	es, _ := newTestEncryptedStore(t)
+	for _, key := range []string{"a/1", "a/2", "b/1"} {
+		if _, err := es.PutObjectWithOptions(ctx, key, []byte("data "+key), PutOptions{
+			ContentType: "text/plain",
+			Metadata:    map[string]string{"Owner": key},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var archive bytes.Buffer
+	manifest, err := Backup(ctx, es, &archive, BackupOptions{Mode: BackupDecrypted, Compression: CompressionZstd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Objects) != 3 {
+		t.Fatalf("expected 3 objects in manifest but got %d", len(manifest.Objects))
+	}
+
+	verified, err := VerifyBackup(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.LastKey() != manifest.LastKey() || len(verified.Objects) != 3 {
+		t.Errorf("expected verified manifest to match but got %+v", verified)
+	}
+
+	dst := NewMemoryStore("restore")
+	if _, err := Restore(ctx, dst, bytes.NewReader(archive.Bytes()), RestoreOptions{}); err == nil {
+		t.Error("expected restoring a decrypted archive in raw mode to fail")
+	}
+	if len(dst.Keys()) != 0 {
+		t.Errorf("expected nothing to be restored but got %v", dst.Keys())
+	}
+
+	result, err := Restore(ctx, dst, bytes.NewReader(archive.Bytes()), RestoreOptions{Mode: BackupDecrypted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Restored != 3 || !reflect.DeepEqual(dst.Keys(), []string{"a/1", "a/2", "b/1"}) {
+		t.Errorf("expected 3 restored objects but got %d: %v", result.Restored, dst.Keys())
+	}
+	data, info, err := dst.GetObject(ctx, "a/2")
+	if err != nil || string(data) != "data a/2" || info.ContentType != "text/plain" || info.Metadata["Owner"] != "a/2" {
+		t.Errorf("expected restored object with metadata but got %q %+v (%v)", data, info, err)
+	}
+
+	result, err = Restore(ctx, dst, bytes.NewReader(archive.Bytes()), RestoreOptions{Mode: BackupDecrypted, SkipExisting: true})
+	if err != nil || result.Skipped != 3 {
+		t.Errorf("expected all objects to be skipped but got %+v (%v)", result, err)
+	}
+}
+
+func TestBackupResume(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore("test")
+	for _, key := range []string{"1", "2", "3", "4"} {
+		if _, err := ms.PutObject(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ms.InjectFault(Fault{Op: OpGetObject, Key: "3", Err: errors.New("boom"), Times: 1})
+
+	var first bytes.Buffer
+	if _, err := Backup(ctx, ms, &first, BackupOptions{Concurrency: 1}); err == nil {
+		t.Fatal("expected backup to fail")
+	}
+	partial, err := VerifyBackup(&first)
+	if !errors.Is(err, ErrBackupIncomplete) {
+		t.Fatalf("expected ErrBackupIncomplete but got %v", err)
+	}
+	if partial.LastKey() != "2" {
+		t.Fatalf("expected backup to stop after 2 but got %q", partial.LastKey())
+	}
+
+	var second bytes.Buffer
+	manifest, err := Backup(ctx, ms, &second, BackupOptions{StartAfter: partial.LastKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Objects) != 2 || manifest.Objects[0].Key != "3" {
+		t.Errorf("expected resumed backup to contain 3 and 4 but got %+v", manifest.Objects)
+	}
+}
+
+func TestVerifyBackupCorrupt(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore("test")
+	if _, err := ms.PutObject(ctx, "key", []byte("original")); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if _, err := Backup(ctx, ms, &archive, BackupOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupted := bytes.Replace(archive.Bytes(), []byte("original"), []byte("modified"), 1)
+	if _, err := VerifyBackup(bytes.NewReader(corrupted)); !errors.Is(err, ErrBackupCorrupt) {
+		t.Errorf("expected ErrBackupCorrupt but got %v", err)
+	}
+}
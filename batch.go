@@ -0,0 +1,144 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// DefaultBatchConcurrency is used by the batch operations if no concurrency is provided.
+const DefaultBatchConcurrency = 16
+
+// BatchResult is the outcome of a single item in a batch operation.
+// Data is only set by GetObjects and GetListedObjects.
+type BatchResult struct {
+	Key  string
+	Data []byte
+	Info ObjectInfo
+	Err  error
+}
+
+// BatchPut is a single object write in PutObjects.
+type BatchPut struct {
+	Key  string
+	Data []byte
+	Opts PutOptions
+}
+
+// BatchDeleter is implemented by stores that can delete many objects with few requests.
+type BatchDeleter interface {
+	// DeleteObjects removes the files and returns one result per file, in the same order.
+	DeleteObjects(ctx context.Context, files []string) []BatchResult
+}
+
+// GetObjects fetches the files with bounded concurrency and returns one result per
+// file, in the same order. A failed item does not stop the remaining items.
+func GetObjects(ctx context.Context, store LingioStore, files []string, concurrency int) []BatchResult {
+	return forEach(ctx, files, concurrency, func(i int) BatchResult {
+		data, info, err := store.GetObject(ctx, files[i])
+		return BatchResult{Key: files[i], Data: data, Info: info, Err: err}
+	})
+}
+
+// PutObjects stores the objects with bounded concurrency and returns one result per
+// object, in the same order. A failed item does not stop the remaining items.
+func PutObjects(ctx context.Context, store LingioStore, puts []BatchPut, concurrency int) []BatchResult {
+	keys := make([]string, len(puts))
+	for i, put := range puts {
+		keys[i] = put.Key
+	}
+	return forEach(ctx, keys, concurrency, func(i int) BatchResult {
+		info, err := store.PutObjectWithOptions(ctx, puts[i].Key, puts[i].Data, puts[i].Opts)
+		return BatchResult{Key: puts[i].Key, Info: info, Err: err}
+	})
+}
+
+// DeleteObjects removes the files and returns one result per file, in the same order.
+// Stores implementing BatchDeleter delete in bulk, other stores with bounded concurrency.
+func DeleteObjects(ctx context.Context, store LingioStore, files []string, concurrency int) []BatchResult {
+	if bd, ok := store.(BatchDeleter); ok {
+		return bd.DeleteObjects(ctx, files)
+	}
+	return forEach(ctx, files, concurrency, func(i int) BatchResult {
+		return BatchResult{Key: files[i], Err: store.DeleteObject(ctx, files[i])}
+	})
+}
+
+// GetListedObjects fetches every object in the listing with bounded concurrency and
+// streams the results in no particular order. Listing errors are forwarded as results
+// without a key. The channel is closed when the listing is exhausted or ctx is done.
+func GetListedObjects(ctx context.Context, store LingioStore, listing <-chan ObjectInfo, concurrency int) <-chan BatchResult {
+	if concurrency <= 0 {
+		concurrency = DefaultBatchConcurrency
+	}
+	results := make(chan BatchResult, concurrency)
+	send := func(res BatchResult) bool {
+		select {
+		case results <- res:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				var info ObjectInfo
+				select {
+				case <-ctx.Done():
+					return
+				case obj, more := <-listing:
+					if !more {
+						return
+					}
+					info = obj
+				}
+				if info.Err != nil {
+					send(BatchResult{Err: info.Err})
+					return
+				}
+				data, objInfo, err := store.GetObject(ctx, info.Key)
+				if !send(BatchResult{Key: info.Key, Data: data, Info: objInfo, Err: err}) {
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// forEach calls fn for every key with at most concurrency calls in flight and
+// collects the results. Keys not yet started when ctx is done fail with a 503.
+func forEach(ctx context.Context, keys []string, concurrency int, fn func(i int) BatchResult) []BatchResult {
+	if concurrency <= 0 {
+		concurrency = DefaultBatchConcurrency
+	}
+	results := make([]BatchResult, len(keys))
+	var grp errgroup.Group
+	grp.SetLimit(concurrency)
+	for i := range keys {
+		if err := ctx.Err(); err != nil {
+			results[i] = BatchResult{
+				Key: keys[i],
+				Err: NewErrorE(http.StatusServiceUnavailable, err).Str("file", keys[i]).Msg("Batch operation cancelled."),
+			}
+			continue
+		}
+		grp.Go(func() error {
+			results[i] = fn(i)
+			return nil
+		})
+	}
+	grp.Wait()
+	return results
+}
@@ -0,0 +1,65 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestBatchOperations(t *testing.T) {
+	ctx := context.Background()
+	es, backend := newTestEncryptedStore(t)
+
+	puts := []BatchPut{
+		{Key: "a", Data: []byte("1")},
+		{Key: "b", Data: []byte("2")},
+		{Key: "a", Data: []byte("3"), Opts: PutOptions{IfMatch: "stale"}},
+	}
+	results := PutObjects(ctx, es, puts, 2)
+	if results[0].Err != nil || results[1].Err != nil || !errors.Is(results[2].Err, ErrPreconditionFailed) {
+		t.Errorf("expected only the conditional put to fail but got %+v", results)
+	}
+
+	results = GetObjects(ctx, es, []string{"b", "missing", "a"}, 2)
+	if string(results[0].Data) != "2" || !errors.Is(results[1].Err, ErrObjectNotFound) || string(results[2].Data) != "1" {
+		t.Errorf("expected results in request order but got %+v", results)
+	}
+
+	results = DeleteObjects(ctx, es, []string{"a", "b"}, 2)
+	for _, res := range results {
+		if res.Err != nil {
+			t.Errorf("%s: %v", res.Key, res.Err)
+		}
+	}
+	if keys := backend.Keys(); len(keys) != 0 {
+		t.Errorf("expected all objects to be deleted but got %v", keys)
+	}
+}
+
+func TestGetListedObjects(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore("test")
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := ms.PutObject(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	failure := errors.New("injected")
+	ms.InjectFault(Fault{Op: OpListObjects, Err: failure, After: 2})
+
+	var fetched int
+	var listErr error
+	for res := range GetListedObjects(ctx, ms, ms.ListObjectsWithOptions(ctx, ListOptions{}), 2) {
+		if res.Err != nil {
+			listErr = res.Err
+		} else if string(res.Data) != res.Key {
+			t.Errorf("%s: unexpected data %q", res.Key, res.Data)
+		} else {
+			fetched++
+		}
+	}
+	if fetched != 2 || listErr != failure {
+		t.Errorf("expected 2 objects and the listing error but got %d objects and %v", fetched, listErr)
+	}
+}
@@ -0,0 +1,52 @@
+package common
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// minBlindIndexKeySize is the minimum size of blind index keys in bytes.
+const minBlindIndexKeySize = 32
+
+// BlindIndex returns a keyed HMAC-SHA256 of the value, so that values such as email
+// addresses can be indexed without storing them in plaintext. Equal values have the
+// same blind index under the same key, so lookups keep working, but the value
+// cannot be recovered or guessed without the key. Use a random key of at least 32
+// bytes that is used for nothing else. The HMAC key is derived from it with HKDF.
+//
+// The result is URL-safe base64 without padding, so it can be part of a cache key.
+func BlindIndex(key []byte, value string) (string, error) {
+	indexKey, err := deriveBlindIndexKey(key, "blind-index")
+	if err != nil {
+		return "", err
+	}
+	return blindIndex(indexKey, value), nil
+}
+
+// blindIndex returns the blind index of the value under a derived index key.
+func blindIndex(indexKey []byte, value string) string {
+	mac := hmac.New(sha256.New, indexKey)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// blindIndexKeyID identifies the blind index key without revealing it. It is
+// derived with its own label, so it says nothing about the index key.
+func blindIndexKeyID(key []byte) (string, error) {
+	id, err := deriveBlindIndexKey(key, "blind-index key id")
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(id)[:8], nil
+}
+
+func deriveBlindIndexKey(key []byte, info string) ([]byte, error) {
+	derived, err := hkdf.Key(sha256.New, key, nil, "lingio "+info, 32)
+	if err != nil {
+		return nil, fmt.Errorf("hkdf: %w", err)
+	}
+	return derived, nil
+}
@@ -0,0 +1,75 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func mustBlindIndex(t *testing.T, key []byte, value string) string {
+	t.Helper()
+	index, err := BlindIndex(key, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return index
+}
+
+func TestBlindIndex(t *testing.T) {
+	key1, key2 := []byte(testKeyOld), []byte(testKeyNew)
+	a := mustBlindIndex(t, key1, "foo@bar.com")
+	if a != mustBlindIndex(t, key1, "foo@bar.com") {
+		t.Error("expected blind index to be deterministic")
+	}
+	if a == mustBlindIndex(t, key2, "foo@bar.com") || a == mustBlindIndex(t, key1, "bar@foo.com") {
+		t.Error("expected blind index to depend on key and value")
+	}
+	if strings.ContainsAny(a, ".=+/") {
+		t.Errorf("expected blind index to be usable in cache keys but got %q", a)
+	}
+	// the key is only used to derive the HMAC key
+	mac := hmac.New(sha256.New, key1)
+	mac.Write([]byte("foo@bar.com"))
+	if a == base64.RawURLEncoding.EncodeToString(mac.Sum(nil)) {
+		t.Error("expected blind index to use a derived key")
+	}
+}
+
+func TestRedisCacheBlindIndexes(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:0"})
+	defer client.Close()
+	cache := NewRedisCache(client, "people", "v1")
+	if err := cache.SetBlindIndexes([]byte("short"), "email"); err == nil {
+		t.Error("expected short blind index key to be refused")
+	}
+	if key := cache.Key("email", "foo@bar.com"); key != "people.v1.email=foo@bar.com" {
+		t.Errorf("expected plaintext index without blind indexes but got %q", key)
+	}
+
+	if err := cache.SetBlindIndexes([]byte(testKeyOld), "email"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{cache.Key("email", "foo@bar.com"), cache.ETagKey("email", "foo@bar.com")} {
+		if strings.Contains(key, "foo@bar.com") || !strings.HasSuffix(key, "="+mustBlindIndex(t, []byte(testKeyOld), "foo@bar.com")) {
+			t.Errorf("expected blind index key but got %q", key)
+		}
+	}
+	if key := cache.Key("id", "p123"); !strings.HasSuffix(key, ".id=p123") {
+		t.Errorf("expected other indexes to keep their values but got %q", key)
+	}
+
+	other := NewRedisCache(client, "people", "v1")
+	if err := other.SetBlindIndexes([]byte(testKeyNew), "email"); err != nil {
+		t.Fatal(err)
+	}
+	if cache.InitKey() == other.InitKey() || cache.InitKey() == "people.v1.initialized" {
+		t.Error("expected cache to be scoped by the blind index key")
+	}
+	if id := cache.BlindIndexKeyID(); id == "" || !strings.HasPrefix(cache.InitKey(), "people.v1.blind-"+id+".") {
+		t.Errorf("expected init key in the scope of the blind index key id but got %q", cache.InitKey())
+	}
+}
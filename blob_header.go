@@ -0,0 +1,190 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Encrypted objects start with a header that describes how they were encrypted,
+// so a store can read objects of every crypto version and key it holds:
+//
+//	magic (4) || crypto version (1) || flags (1) || key id length (1) || key id || wrapped key length (2) || wrapped key
+//
+// followed by either nonce || ciphertext, or an encrypted stream. The crypto
+// version is that of the key (see Keyring), and the key ID of envelope encrypted
+// objects is the ID of the master key that wrapped the data key. The header is
+// not authenticated: a modified header selects the wrong key or format, which
+// fails decryption.
+//
+// Objects of the legacy key that were written before the header was introduced
+// have no header at all, see EncryptedStore.sniffBlobHeader.
+var blobMagic = []byte("LEH1")
+
+// Header flags.
+const (
+	blobBound    byte = 1 << iota // v3 crypto, see Bind
+	blobStream                    // chunked stream format
+	blobEnvelope                  // data key is wrapped in the header
+	blobGzip                      // plaintext was compressed with gzip
+	blobZstd                      // plaintext was compressed with zstd
+
+	blobFlags = blobBound | blobStream | blobEnvelope | blobGzip | blobZstd
+)
+
+var (
+	errMissingHeader   = fmt.Errorf("%w: missing header", ErrDecryptionFailed)
+	errTruncatedHeader = fmt.Errorf("%w: truncated header", ErrDecryptionFailed)
+)
+
+// maxBlobHeaderSize bounds the size of a header.
+const maxBlobHeaderSize = 4 + 3 + 255 + 2 + maxWrappedKeySize
+
+// blobHeader describes how an object was encrypted.
+type blobHeader struct {
+	version     int    // crypto version of the key, 0 without header
+	keyID       string // key of the keyring, or envelopeKeyID
+	bound       bool   // v3 crypto
+	stream      bool   // chunked stream format
+	masterKeyID string // master key of the wrapped data key, for envelope encryption
+	wrapped     []byte
+	compression Compression // content encoding of the plaintext, if any
+	maybeRaw    bool        // may also be a ciphertext of the legacy key without header
+}
+
+// contentEncoding returns the content encoding of the object, or the compression
+// recorded in the header if the backend did not keep the content encoding.
+func (hdr blobHeader) contentEncoding(info ObjectInfo) string {
+	if info.ContentEncoding == "" {
+		return string(hdr.compression)
+	}
+	return info.ContentEncoding
+}
+
+// cryptoVersion returns the version of the crypto module that is recorded in
+// the header of its objects.
+func cryptoVersion(cm cryptoModule) int {
+	switch cm.(type) {
+	case v1Crypto:
+		return 1
+	case v2Crypto:
+		return 2
+	case v4Crypto:
+		return 4
+	}
+	return 0
+}
+
+func appendBlobHeader(dst []byte, hdr blobHeader) []byte {
+	var flags byte
+	if hdr.bound {
+		flags |= blobBound
+	}
+	if hdr.stream {
+		flags |= blobStream
+	}
+	switch hdr.compression {
+	case CompressionGzip:
+		flags |= blobGzip
+	case CompressionZstd:
+		flags |= blobZstd
+	}
+	keyID := hdr.keyID
+	if keyID == envelopeKeyID {
+		flags |= blobEnvelope
+		keyID = hdr.masterKeyID
+	}
+	dst = append(dst, blobMagic...)
+	dst = append(dst, byte(hdr.version), flags, byte(len(keyID)))
+	dst = append(dst, keyID...)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(hdr.wrapped)))
+	return append(dst, hdr.wrapped...)
+}
+
+// parseBlobHeader returns the header that the data starts with, and its length.
+func parseBlobHeader(data []byte) (hdr blobHeader, n int, err error) {
+	if !bytes.HasPrefix(data, blobMagic) {
+		return hdr, 0, errMissingHeader
+	}
+	n = len(blobMagic) + 3
+	if len(data) < n {
+		return hdr, 0, errTruncatedHeader
+	}
+	version, flags, keyLen := data[n-3], data[n-2], int(data[n-1])
+	if flags&^blobFlags != 0 {
+		return hdr, 0, fmt.Errorf("%w: %w: unknown header flags %#x", ErrDecryptionFailed, ErrNotSupported, flags)
+	}
+	if len(data) < n+keyLen+2 {
+		return hdr, 0, errTruncatedHeader
+	}
+	keyID := string(data[n : n+keyLen])
+	n += keyLen
+	wrappedLen := int(binary.BigEndian.Uint16(data[n:]))
+	n += 2
+	if len(data) < n+wrappedLen {
+		return hdr, 0, errTruncatedHeader
+	}
+
+	hdr = blobHeader{
+		version: int(version),
+		keyID:   keyID,
+		bound:   flags&blobBound != 0,
+		stream:  flags&blobStream != 0,
+	}
+	if flags&blobEnvelope != 0 {
+		hdr.keyID, hdr.masterKeyID, hdr.wrapped = envelopeKeyID, keyID, bytes.Clone(data[n:n+wrappedLen])
+	}
+	switch flags & (blobGzip | blobZstd) {
+	case blobGzip:
+		hdr.compression = CompressionGzip
+	case blobZstd:
+		hdr.compression = CompressionZstd
+	case blobGzip | blobZstd:
+		return hdr, 0, fmt.Errorf("%w: invalid header compression", ErrDecryptionFailed)
+	}
+	return hdr, n + wrappedLen, nil
+}
+
+// sniffBlobHeader returns the header of the object stored under the encrypted
+// filename, and its length. Objects of the legacy key written before the header
+// was introduced are nonce || ciphertext, and are returned with an empty header.
+//
+// A v2 ciphertext starts with a random nonce, which matches blobMagic with a
+// chance of 1 in 2^32, so headers of the legacy key are marked maybeRaw and the
+// object is decrypted without header if it does not decrypt with it. v2 is
+// authenticated, so a header is never mistaken for ciphertext or vice versa.
+func (es *EncryptedStore) sniffBlobHeader(encfile string, data []byte) (blobHeader, int, error) {
+	if keyID, _ := splitKeyedFilename(encfile); keyID != "" {
+		return parseBlobHeader(data)
+	}
+	if !bytes.HasPrefix(data, blobMagic) {
+		return blobHeader{}, 0, nil
+	}
+	switch cryptoVersion(es.keys[""]) {
+	case 1:
+		// v1 is not authenticated, so a header is only trusted if it has the version of the key
+		if hdr, n, err := parseBlobHeader(data); err == nil && hdr.version == 1 && hdr.keyID == "" {
+			return hdr, n, nil
+		}
+		return blobHeader{}, 0, nil
+	case 2:
+		hdr, n, err := parseBlobHeader(data)
+		hdr.maybeRaw = true
+		return hdr, n, err
+	}
+	return parseBlobHeader(data)
+}
+
+// peekBlobHeader returns the header that the reader of the encrypted filename
+// starts with, and its length, without consuming it. Invalid headers are
+// reported with ErrDecryptionFailed.
+func (es *EncryptedStore) peekBlobHeader(encfile string, br *bufio.Reader) (blobHeader, int, error) {
+	data, err := br.Peek(maxBlobHeaderSize)
+	if err != nil && err != io.EOF {
+		return blobHeader{}, 0, NewErrorE(http.StatusInternalServerError, err).Msg("Could not read object data.")
+	}
+	return es.sniffBlobHeader(encfile, data)
+}
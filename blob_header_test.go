@@ -0,0 +1,140 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestEncryptedStoreHeaderlessObjects(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryStore("test")
+	es, err := NewKeyringEncryptedStore(backend, Keyring{Primary: "2027", Keys: map[string]string{"2027": testKeyNew, "": testKeyOld}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// objects of the legacy key written before the header was introduced
+	if _, err := backend.PutObject(ctx, es.keys[""].encryptFilename("a"), es.keys[""].encryptData(nil, []byte("a"), nil)); err != nil {
+		t.Fatal(err)
+	}
+	if data, _, err := es.GetObject(ctx, "a"); err != nil || string(data) != "a" {
+		t.Errorf("expected headerless object to be readable but got %q (%v)", data, err)
+	}
+	if data, err := readAllObject(t, es, "a"); err != nil || string(data) != "a" {
+		t.Errorf("expected headerless object to be streamed but got %q (%v)", data, err)
+	}
+
+	// objects of keyed filenames always have a header
+	if _, err := backend.PutObject(ctx, es.encryptFilename("b"), es.crypto.encryptData(nil, []byte("b"), nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := es.GetObject(ctx, "b"); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("expected headerless object of a keyed filename to be refused but got %v", err)
+	}
+	if err := backend.DeleteObject(ctx, es.encryptFilename("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := es.RotateKeys(ctx, RotateOptions{})
+	if err != nil || result.Rotated != 1 || result.Failed != 0 {
+		t.Errorf("expected headerless object to be rotated but got %+v (%v)", result, err)
+	}
+	data, _, err := backend.GetObject(ctx, es.encryptFilename("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr, _, err := parseBlobHeader(data); err != nil || hdr.keyID != "2027" || hdr.version != 2 {
+		t.Errorf("expected object to be encrypted with the primary key but got %+v (%v)", hdr, err)
+	}
+}
+
+func TestEncryptedStoreBlobHeader(t *testing.T) {
+	ctx := context.Background()
+	es, backend := newTestEncryptedStore(t)
+	if _, err := es.PutObjectWithOptions(ctx, "a", []byte("a"), PutOptions{ContentEncoding: string(CompressionGzip)}); err != nil {
+		t.Fatal(err)
+	}
+	data, binfo, err := backend.GetObject(ctx, es.encryptFilename("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binfo.ContentEncoding != "" {
+		t.Errorf("expected ciphertext to be stored without content encoding but got %q", binfo.ContentEncoding)
+	}
+	hdr, _, err := parseBlobHeader(data)
+	if err != nil || !bytes.HasPrefix(data, blobMagic) || hdr.version != 2 || hdr.compression != CompressionGzip {
+		t.Errorf("expected v2 header with compression but got %+v (%v)", hdr, err)
+	}
+	// a backend that does not keep the content encoding
+	if _, err := backend.PutObject(ctx, es.encryptFilename("a"), data); err != nil {
+		t.Fatal(err)
+	}
+	if _, info, err := es.GetObject(ctx, "a"); err != nil || info.ContentEncoding != string(CompressionGzip) {
+		t.Errorf("expected content encoding from the header but got %q (%v)", info.ContentEncoding, err)
+	}
+
+	data = bytes.Clone(data)
+	data[len(blobMagic)+1] |= 0x80
+	if _, err := backend.PutObject(ctx, es.encryptFilename("a"), data); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := es.GetObject(ctx, "a"); !errors.Is(err, ErrDecryptionFailed) || !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expected unknown header flags to be refused but got %v", err)
+	}
+
+	v1, err := NewInsecureEncryptedStore(backend, "0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = v1.encryptBlob(ctx, "b", "", []byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := es.decryptBlob(ctx, "b", es.encryptFilename("b"), bytes.Clone(data)); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("expected v1 object to be refused by the v2 key but got %v", err)
+	}
+	if plaintext, _, err := v1.decryptBlob(ctx, "b", es.encryptFilename("b"), data); err != nil || string(plaintext) != "0123456789abcdef" {
+		t.Errorf("expected v1 object to be detected but got %q (%v)", plaintext, err)
+	}
+}
+
+func TestEncryptedStoreHeaderCollision(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryStore("test")
+	es, err := NewKeyringEncryptedStore(backend, Keyring{Primary: "2027", Keys: map[string]string{"2027": testKeyNew, "": testKeyOld}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := es.keys[""].(v2Crypto)
+
+	// headerless v2 objects whose random nonce starts with a header
+	prefixes := map[string][]byte{
+		"magic":         blobMagic,
+		"blob header":   append(bytes.Clone(blobMagic), 2, 0, 0, 0, 0),
+		"stream header": append(bytes.Clone(blobMagic), 2, blobStream, 0, 0, 0),
+	}
+	for file, prefix := range prefixes {
+		nonce := make([]byte, legacy.aesgcm.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			t.Fatal(err)
+		}
+		copy(nonce, prefix)
+		data := legacy.seal(nonce, []byte(file), nil)
+		if _, err := backend.PutObject(ctx, keyedFilename("", legacy.encryptFilename(file)), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for file := range prefixes {
+		if data, _, err := es.GetObject(ctx, file); err != nil || string(data) != file {
+			t.Errorf("expected %s collision to be readable but got %q (%v)", file, data, err)
+		}
+		if data, err := readAllObject(t, es, file); err != nil || string(data) != file {
+			t.Errorf("expected %s collision to be streamed but got %q (%v)", file, data, err)
+		}
+	}
+	if result, err := es.RotateKeys(ctx, RotateOptions{}); err != nil || result.Rotated != len(prefixes) || result.Failed != 0 {
+		t.Errorf("expected all collisions to be rotated but got %+v (%v)", result, err)
+	}
+}
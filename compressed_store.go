@@ -0,0 +1,355 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/klauspost/compress/zstd"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Compression is a content encoding supported by CompressedStore.
+type Compression string
+
+const (
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+// DefaultMaxDecompressedSize is the default limit on the decompressed size of
+// objects read through a CompressedStore.
+const DefaultMaxDecompressedSize = 1 << 30
+
+// ErrDecompressedTooLarge is returned when an object decompresses to more than the
+// maximum size, e.g. a small object crafted to expand into unbounded memory.
+var ErrDecompressedTooLarge = errors.New("compressed store: decompressed object too large")
+
+// CompressedStore compresses object data before it reaches the backend. The
+// algorithm is recorded as the object content encoding, so reads decompress
+// objects written with any supported algorithm and pass through objects
+// without a content encoding.
+//
+// Use it on top of an EncryptedStore, since encrypted data does not compress.
+// Preconditions, ETags and listed sizes refer to the compressed object.
+type CompressedStore struct {
+	backend     LingioStore
+	algorithm   Compression
+	maxSize     int64
+	zstdDecoder *zstd.Decoder
+}
+
+// zstd encoders and decoders are safe for concurrent use with EncodeAll and DecodeAll.
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+// NewCompressedStore initializes a lingio store that compresses writes with the
+// algorithm. Reads fail with ErrDecompressedTooLarge for objects larger than
+// DefaultMaxDecompressedSize once decompressed, see SetMaxDecompressedSize.
+func NewCompressedStore(backend LingioStore, algorithm Compression) (*CompressedStore, error) {
+	switch algorithm {
+	case CompressionGzip, CompressionZstd:
+	default:
+		return nil, fmt.Errorf("compressed store: unsupported compression %q", algorithm)
+	}
+	cs := &CompressedStore{
+		backend:   backend,
+		algorithm: algorithm,
+	}
+	if err := cs.SetMaxDecompressedSize(DefaultMaxDecompressedSize); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// SetMaxDecompressedSize limits the decompressed size of objects. It must be
+// called before the store is used.
+func (cs *CompressedStore) SetMaxDecompressedSize(size int64) error {
+	if size <= 0 {
+		return fmt.Errorf("compressed store: invalid maximum size %d", size)
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(size)))
+	if err != nil {
+		return fmt.Errorf("compressed store: %w", err)
+	}
+	cs.maxSize, cs.zstdDecoder = size, decoder
+	return nil
+}
+
+func (cs *CompressedStore) GetObject(ctx context.Context, file string) (_ []byte, _ ObjectInfo, err error) {
+	ctx, span := tracer.Start(ctx, "compressed_store.GetObject", trace.WithAttributes(
+		attribute.String("file", file),
+	))
+	defer span.End()
+	defer span.RecordError(err)
+
+	data, info, err := cs.backend.GetObject(ctx, file)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	encoding := Compression(info.ContentEncoding)
+	if !isCompression(encoding) {
+		return data, info, nil
+	}
+
+	data, err = cs.decompress(encoding, data)
+	if err != nil {
+		return nil, ObjectInfo{}, NewErrorE(http.StatusInternalServerError, err).
+			Str("file", file).Str("encoding", info.ContentEncoding).Msg("Could not decompress object.")
+	}
+	info.ContentEncoding = ""
+	info.Size = int64(len(data))
+	return data, info, nil
+}
+
+func (cs *CompressedStore) PutObject(ctx context.Context, file string, data []byte) (ObjectInfo, error) {
+	return cs.PutObjectWithOptions(ctx, file, data, PutOptions{})
+}
+
+// PutObjectWithOptions compresses and stores the object. If opts.ContentEncoding
+// is set the data is assumed to be encoded already and is stored as is.
+func (cs *CompressedStore) PutObjectWithOptions(ctx context.Context, file string, data []byte, opts PutOptions) (info ObjectInfo, err error) {
+	ctx, span := tracer.Start(ctx, "compressed_store.PutObject", trace.WithAttributes(
+		attribute.String("file", file),
+	))
+	defer span.End()
+	defer span.RecordError(err)
+
+	if opts.ContentEncoding != "" {
+		return cs.backend.PutObjectWithOptions(ctx, file, data, opts)
+	}
+
+	compressed, err := compress(cs.algorithm, data)
+	if err != nil {
+		return ObjectInfo{}, NewErrorE(http.StatusInternalServerError, err).Str("file", file).Msg("Could not compress object.")
+	}
+	opts.ContentEncoding = string(cs.algorithm)
+	info, err = cs.backend.PutObjectWithOptions(ctx, file, compressed, opts)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info.ContentEncoding = ""
+	info.Size = int64(len(data))
+	return info, nil
+}
+
+// GetObjectReader opens the file for reading and decompresses it while it is read.
+func (cs *CompressedStore) GetObjectReader(ctx context.Context, file string) (_ io.ReadCloser, info ObjectInfo, err error) {
+	ctx, span := tracer.Start(ctx, "compressed_store.GetObjectReader", trace.WithAttributes(
+		attribute.String("file", file),
+	))
+	defer span.End()
+	defer span.RecordError(err)
+
+	r, info, err := GetObjectReader(ctx, cs.backend, file)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	encoding := Compression(info.ContentEncoding)
+	if !isCompression(encoding) {
+		return r, info, nil
+	}
+
+	dr, err := newDecompressReader(encoding, r, cs.maxSize)
+	if err != nil {
+		r.Close()
+		return nil, ObjectInfo{}, NewErrorE(http.StatusInternalServerError, err).
+			Str("file", file).Str("encoding", info.ContentEncoding).Msg("Could not decompress object.")
+	}
+	info.ContentEncoding = ""
+	info.Size = -1 // unknown until fully read
+	return dr, info, nil
+}
+
+// PutObjectReader compresses and uploads the contents of r. The compressed size
+// is not known in advance, so the backend receives a stream of unknown size.
+func (cs *CompressedStore) PutObjectReader(ctx context.Context, file string, r io.Reader, size int64, opts PutOptions) (info ObjectInfo, err error) {
+	ctx, span := tracer.Start(ctx, "compressed_store.PutObjectReader", trace.WithAttributes(
+		attribute.String("file", file),
+		attribute.Int64("size", size),
+	))
+	defer span.End()
+	defer span.RecordError(err)
+
+	if opts.ContentEncoding != "" {
+		return PutObjectReader(ctx, cs.backend, file, r, size, opts)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := newCompressWriter(cs.algorithm, pw)
+		if err == nil {
+			_, err = io.Copy(w, r)
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close() // unblocks the compressor if the backend fails early
+
+	opts.ContentEncoding = string(cs.algorithm)
+	info, err = PutObjectReader(ctx, cs.backend, file, pr, -1, opts)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info.ContentEncoding = ""
+	info.Size = size
+	return info, nil
+}
+
+func (cs *CompressedStore) DeleteObject(ctx context.Context, file string) error {
+	return cs.backend.DeleteObject(ctx, file)
+}
+
+func (cs *CompressedStore) DeleteObjectWithOptions(ctx context.Context, file string, opts DeleteOptions) error {
+	return cs.backend.DeleteObjectWithOptions(ctx, file, opts)
+}
+
+// CopyObject copies the object, including its content encoding, without recompressing it.
+func (cs *CompressedStore) CopyObject(ctx context.Context, src, dst string, opts CopyOptions) (ObjectInfo, error) {
+	return cs.backend.CopyObject(ctx, src, dst, opts)
+}
+
+func (cs *CompressedStore) MoveObject(ctx context.Context, src, dst string, opts CopyOptions) (ObjectInfo, error) {
+	return cs.backend.MoveObject(ctx, src, dst, opts)
+}
+
+// DeleteObjects removes the files, in bulk if the backend implements BatchDeleter.
+func (cs *CompressedStore) DeleteObjects(ctx context.Context, files []string) []BatchResult {
+	return DeleteObjects(ctx, cs.backend, files, DefaultBatchConcurrency)
+}
+
+func (cs *CompressedStore) ListObjects(ctx context.Context) <-chan ObjectInfo {
+	return cs.backend.ListObjects(ctx)
+}
+
+func (cs *CompressedStore) ListObjectsWithOptions(ctx context.Context, opts ListOptions) <-chan ObjectInfo {
+	return cs.backend.ListObjectsWithOptions(ctx, opts)
+}
+
+// ListenObjectEvents reports changes to objects if the backend implements NotifyingStore.
+func (cs *CompressedStore) ListenObjectEvents(ctx context.Context, prefix string) <-chan ObjectEvent {
+	events, err := ListenObjectEvents(ctx, cs.backend, prefix)
+	if err != nil {
+		return failedObjectEvents(err)
+	}
+	return events
+}
+
+func (cs *CompressedStore) StoreName() string {
+	return cs.backend.StoreName()
+}
+
+func isCompression(encoding Compression) bool {
+	return encoding == CompressionGzip || encoding == CompressionZstd
+}
+
+func compress(algorithm Compression, data []byte) ([]byte, error) {
+	if algorithm == CompressionZstd {
+		return zstdEncoder.EncodeAll(data, nil), nil
+	}
+	var buf bytes.Buffer
+	w, err := newCompressWriter(algorithm, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (cs *CompressedStore) decompress(encoding Compression, data []byte) ([]byte, error) {
+	if encoding == CompressionZstd {
+		data, err := cs.zstdDecoder.DecodeAll(data, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+			return nil, fmt.Errorf("%w: %w", ErrDecompressedTooLarge, err)
+		}
+		return data, err
+	}
+	r, err := newDecompressReader(encoding, io.NopCloser(bytes.NewReader(data)), cs.maxSize)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func newCompressWriter(algorithm Compression, w io.Writer) (io.WriteCloser, error) {
+	switch algorithm {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unsupported compression %q", algorithm)
+}
+
+// newDecompressReader returns a reader that decompresses r and closes it when closed.
+// Reading more than maxSize decompressed bytes fails with ErrDecompressedTooLarge,
+// unless maxSize is zero.
+func newDecompressReader(encoding Compression, r io.ReadCloser, maxSize int64) (io.ReadCloser, error) {
+	var dr decompressReadCloser
+	switch encoding {
+	case CompressionGzip:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		dr = decompressReadCloser{gr, func() { gr.Close(); r.Close() }}
+	case CompressionZstd:
+		opts := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+		if maxSize > 0 {
+			opts = append(opts, zstd.WithDecoderMaxMemory(uint64(maxSize)))
+		}
+		zr, err := zstd.NewReader(r, opts...)
+		if err != nil {
+			return nil, err
+		}
+		dr = decompressReadCloser{zr, func() { zr.Close(); r.Close() }}
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+	if maxSize > 0 {
+		dr.Reader = &sizeLimitReader{r: io.LimitReader(dr.Reader, maxSize+1), max: maxSize}
+	}
+	return dr, nil
+}
+
+type decompressReadCloser struct {
+	io.Reader
+	close func()
+}
+
+func (r decompressReadCloser) Close() error {
+	r.close()
+	return nil
+}
+
+// sizeLimitReader fails with ErrDecompressedTooLarge once more than max bytes are read.
+type sizeLimitReader struct {
+	r      io.Reader // limited to max+1 bytes
+	n, max int64
+}
+
+func (r *sizeLimitReader) Read(p []byte) (int, error) {
+	if r.n > r.max {
+		return 0, ErrDecompressedTooLarge
+	}
+	n, err := r.r.Read(p)
+	if r.n += int64(n); r.n > r.max {
+		return n - int(r.n-r.max), ErrDecompressedTooLarge
+	}
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		return n, fmt.Errorf("%w: %w", ErrDecompressedTooLarge, err)
+	}
+	return n, err
+}
@@ -0,0 +1,97 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestCompressedStore(t *testing.T) {
+	ctx := context.Background()
+	plaintext := bytes.Repeat([]byte(`{"name":"lingio"}`), 1000)
+
+	for _, algorithm := range []Compression{CompressionGzip, CompressionZstd} {
+		backend := NewMemoryStore("test")
+		cs, err := NewCompressedStore(backend, algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := cs.PutObject(ctx, "doc", plaintext); err != nil {
+			t.Fatal(err)
+		}
+		stored, info, err := backend.GetObject(ctx, "doc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ContentEncoding != string(algorithm) || len(stored) >= len(plaintext) {
+			t.Errorf("%s: expected compressed object but got %d bytes with encoding %q", algorithm, len(stored), info.ContentEncoding)
+		}
+
+		data, info, err := cs.GetObject(ctx, "doc")
+		if err != nil || !bytes.Equal(data, plaintext) || info.ContentEncoding != "" {
+			t.Errorf("%s: expected decompressed data (%v)", algorithm, err)
+		}
+
+		if _, err := cs.PutObjectReader(ctx, "stream", bytes.NewReader(plaintext), int64(len(plaintext)), PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		rc, _, err := cs.GetObjectReader(ctx, "stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err = io.ReadAll(rc)
+		rc.Close()
+		if err != nil || !bytes.Equal(data, plaintext) {
+			t.Errorf("%s: expected streamed data to roundtrip (%v)", algorithm, err)
+		}
+
+		// objects written before compression was enabled are passed through
+		if _, err := backend.PutObject(ctx, "legacy", []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+		if data, _, err := cs.GetObject(ctx, "legacy"); err != nil || string(data) != "{}" {
+			t.Errorf("%s: expected uncompressed object to be passed through but got %q (%v)", algorithm, data, err)
+		}
+	}
+}
+
+func TestCompressedStoreMaxSize(t *testing.T) {
+	ctx := context.Background()
+	for _, algorithm := range []Compression{CompressionGzip, CompressionZstd} {
+		cs, err := NewCompressedStore(NewMemoryStore("test"), algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cs.SetMaxDecompressedSize(4096); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"fits", "bomb"} {
+			size := 4096
+			if key == "bomb" {
+				size = 1 << 20
+			}
+			if _, err := cs.PutObject(ctx, key, make([]byte, size)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if data, _, err := cs.GetObject(ctx, "fits"); err != nil || len(data) != 4096 {
+			t.Errorf("%s: expected object of the maximum size to be read but got %d bytes (%v)", algorithm, len(data), err)
+		}
+		if _, _, err := cs.GetObject(ctx, "bomb"); !errors.Is(err, ErrDecompressedTooLarge) {
+			t.Errorf("%s: expected ErrDecompressedTooLarge but got %v", algorithm, err)
+		}
+		rc, _, err := cs.GetObjectReader(ctx, "bomb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if !errors.Is(err, ErrDecompressedTooLarge) || len(data) > 4096 {
+			t.Errorf("%s: expected stream to fail with ErrDecompressedTooLarge but got %d bytes (%v)", algorithm, len(data), err)
+		}
+	}
+}
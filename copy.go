@@ -0,0 +1,108 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+)
+
+// CopyObjectBetween copies an object from one store to another. Copies within the
+// same store, or between ObjectStores using the same minio client, are performed
+// server-side. Other copies stream the object through the service, so encrypted
+// objects are decrypted and re-encrypted with the key of the destination store.
+func CopyObjectBetween(ctx context.Context, src LingioStore, srcFile string, dst LingioStore, dstFile string, opts CopyOptions) (ObjectInfo, error) {
+	if sameStore(src, dst) {
+		return src.CopyObject(ctx, srcFile, dstFile, opts)
+	}
+	if srcOS, ok := asObjectStore(src); ok {
+		if dstOS, ok := asObjectStore(dst); ok && srcOS.mc == dstOS.mc {
+			return dstOS.copyObjectFrom(ctx, srcOS.bucketName, srcFile, dstFile, opts)
+		}
+	}
+
+	r, info, err := GetObjectReader(ctx, src, srcFile)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer r.Close()
+	if opts.SourceETag != "" && info.ETag != opts.SourceETag {
+		return ObjectInfo{}, NewErrorE(http.StatusPreconditionFailed, ErrPreconditionFailed).
+			Str("bucket", src.StoreName()).Str("file", srcFile).Msg("Object ETag does not match.")
+	}
+	return PutObjectReader(ctx, dst, dstFile, r, info.Size, PutOptions{
+		IfNoneMatch:     opts.IfNoneMatch,
+		ContentType:     info.ContentType,
+		ContentEncoding: info.ContentEncoding,
+		Metadata:        info.Metadata,
+		Tags:            info.Tags,
+	})
+}
+
+// MoveObjectBetween copies an object from one store to another and removes the source.
+// The source is only removed if it still has the ETag of the copied object.
+// See CopyObjectBetween.
+func MoveObjectBetween(ctx context.Context, src LingioStore, srcFile string, dst LingioStore, dstFile string, opts CopyOptions) (ObjectInfo, error) {
+	if sameStore(src, dst) {
+		return src.MoveObject(ctx, srcFile, dstFile, opts)
+	}
+	opts, err := pinSourceETag(ctx, src, srcFile, opts)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := CopyObjectBetween(ctx, src, srcFile, dst, dstFile, opts)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := src.DeleteObjectWithOptions(ctx, srcFile, DeleteOptions{IfMatch: opts.SourceETag}); err != nil {
+		return ObjectInfo{}, err
+	}
+	return info, nil
+}
+
+// moveObject copies the object within the store and removes the source if it
+// still has the ETag of the copied object.
+func moveObject(ctx context.Context, store LingioStore, src, dst string, opts CopyOptions) (ObjectInfo, error) {
+	opts, err := pinSourceETag(ctx, store, src, opts)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := store.CopyObject(ctx, src, dst, opts)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := store.DeleteObjectWithOptions(ctx, src, DeleteOptions{IfMatch: opts.SourceETag}); err != nil {
+		return ObjectInfo{}, err
+	}
+	return info, nil
+}
+
+// pinSourceETag sets SourceETag to the current ETag of the source unless the
+// caller provided one, so that a move never copies one version of the source
+// and removes another.
+func pinSourceETag(ctx context.Context, store LingioStore, file string, opts CopyOptions) (CopyOptions, error) {
+	if opts.SourceETag != "" {
+		return opts, nil
+	}
+	r, info, err := GetObjectReader(ctx, store, file)
+	if err != nil {
+		return opts, err
+	}
+	r.Close()
+	opts.SourceETag = info.ETag
+	return opts, nil
+}
+
+func sameStore(a, b LingioStore) bool {
+	ta := reflect.TypeOf(a)
+	return ta == reflect.TypeOf(b) && ta.Comparable() && a == b
+}
+
+func asObjectStore(store LingioStore) (ObjectStore, bool) {
+	switch os := store.(type) {
+	case ObjectStore:
+		return os, true
+	case *ObjectStore:
+		return *os, os != nil
+	}
+	return ObjectStore{}, false
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestEncryptedStoreMove(t *testing.T) {
+	ctx := context.Background()
+	es, backend := newTestEncryptedStore(t)
+
+	info, err := es.PutObject(ctx, "partner-1/person.json", []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := es.MoveObject(ctx, "partner-1/person.json", "person.json", CopyOptions{SourceETag: "stale"}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected ErrPreconditionFailed for stale source etag but got %v", err)
+	}
+	if _, err := es.MoveObject(ctx, "partner-1/person.json", "person.json", CopyOptions{SourceETag: info.ETag}); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := listKeys(t, es, ListOptions{}); len(keys) != 1 || keys[0] != "person.json" {
+		t.Errorf("expected only the moved key but got %v", keys)
+	}
+	if keys := backend.Keys(); len(keys) != 1 || keys[0] != es.encryptFilename("person.json") {
+		t.Errorf("expected the encrypted destination filename in backend but got %v", keys)
+	}
+}
+
+func TestCopyObjectBetween(t *testing.T) {
+	ctx := context.Background()
+	src, _ := newTestEncryptedStore(t)
+	dst, err := NewEncryptedStore(NewMemoryStore("other"), "abcdef0123456789abcdef0123456789")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := src.PutObject(ctx, "a", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CopyObjectBetween(ctx, src, "a", dst, "b", CopyOptions{IfNoneMatch: true}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _, err := dst.GetObject(ctx, "b"); err != nil || string(data) != "secret" {
+		t.Errorf("expected data re-encrypted with the destination key but got %q (%v)", data, err)
+	}
+	if _, err := CopyObjectBetween(ctx, src, "a", dst, "b", CopyOptions{IfNoneMatch: true}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected ErrPreconditionFailed for existing destination but got %v", err)
+	}
+}
+
+// racingStore overwrites the source of every copy right after it was copied.
+type racingStore struct {
+	*MemoryStore
+}
+
+func (rs racingStore) CopyObject(ctx context.Context, src, dst string, opts CopyOptions) (ObjectInfo, error) {
+	info, err := rs.MemoryStore.CopyObject(ctx, src, dst, opts)
+	if err == nil {
+		_, err = rs.MemoryStore.PutObject(ctx, src, []byte("updated"))
+	}
+	return info, err
+}
+
+func (rs racingStore) MoveObject(ctx context.Context, src, dst string, opts CopyOptions) (ObjectInfo, error) {
+	return moveObject(ctx, rs, src, dst, opts)
+}
+
+func TestMoveObjectKeepsUpdatedSource(t *testing.T) {
+	ctx := context.Background()
+	store := racingStore{NewMemoryStore("test")}
+	if _, err := store.PutObject(ctx, "a", []byte("original")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.MoveObject(ctx, "a", "b", CopyOptions{}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected ErrPreconditionFailed for a source updated during the move but got %v", err)
+	}
+	if data, _, err := store.GetObject(ctx, "a"); err != nil || string(data) != "updated" {
+		t.Errorf("expected the updated source to be kept but got %q (%v)", data, err)
+	}
+}
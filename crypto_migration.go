@@ -0,0 +1,256 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"unicode/utf8"
+
+	zl "github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
+)
+
+// MigrateCryptoOptions configures MigrateCrypto.
+type MigrateCryptoOptions struct {
+	// DryRun decrypts and validates every object without writing or deleting anything.
+	DryRun bool
+	// StartAfter resumes a migration after the encrypted backend key, e.g. the
+	// Checkpoint of an interrupted migration.
+	StartAfter string
+	// Validate checks decrypted objects, e.g. with json.Valid. Since v1 crypto is not
+	// authenticated, decrypting with the wrong key is otherwise not detected.
+	Validate func(file string, data []byte) error
+	// Concurrency bounds the number of objects migrated at once. Zero uses DefaultBatchConcurrency.
+	Concurrency int
+	// Progress is called with the running report after each object.
+	Progress func(CryptoMigrationReport)
+}
+
+// CryptoMigrationReport describes the outcome of MigrateCrypto. Keys are encrypted
+// backend keys, files are decrypted keys.
+type CryptoMigrationReport struct {
+	Scanned int
+	// Migrated objects were rewritten, or would be with DryRun.
+	Migrated int
+	// Current objects were already readable by the target store.
+	Current int
+	// Conflicts are files stored in both formats with different contents. The
+	// object in the old format is kept, so it can be inspected.
+	Conflicts []string
+	// Undecryptable keys could not be decrypted by either store, or failed validation.
+	Undecryptable []string
+	// Failed maps keys to the error that stopped their migration.
+	Failed map[string]string
+	// Checkpoint is the last backend key before which every object was processed.
+	// Pass it as StartAfter to resume the migration.
+	Checkpoint string
+}
+
+// MigrateV1ToV2 rewrites every object in the backend that was written by
+// NewInsecureEncryptedStore with the v2 crypto of NewEncryptedStore, using the
+// same key. See MigrateCrypto.
+func MigrateV1ToV2(ctx context.Context, backend LingioStore, cipherKey string, opts MigrateCryptoOptions) (CryptoMigrationReport, error) {
+	from, err := NewInsecureEncryptedStore(backend, cipherKey)
+	if err != nil {
+		return CryptoMigrationReport{}, err
+	}
+	to, err := NewEncryptedStore(backend, cipherKey)
+	if err != nil {
+		return CryptoMigrationReport{}, err
+	}
+	return MigrateCrypto(ctx, from, to, opts)
+}
+
+// MigrateV2ToV4 rewrites every object in the backend that was written with a v2
+// key of the keyring with its primary key, which must use v4 crypto. Unlike
+// RotateKeys, every object is verified before the v2 object is removed, and
+// conflicts are reported. See MigrateCrypto.
+func MigrateV2ToV4(ctx context.Context, backend LingioStore, keyring Keyring, opts MigrateCryptoOptions) (CryptoMigrationReport, error) {
+	if keyring.Versions[keyring.Primary] != 4 {
+		return CryptoMigrationReport{}, fmt.Errorf("encrypted store: primary key %q must use v4 crypto", keyring.Primary)
+	}
+	v2 := Keyring{Keys: make(map[string]string)}
+	v4 := Keyring{Primary: keyring.Primary, Keys: make(map[string]string), Versions: make(map[string]int)}
+	for id, key := range keyring.Keys {
+		if keyring.Versions[id] == 4 {
+			v4.Keys[id], v4.Versions[id] = key, 4
+		} else {
+			v2.Keys[id] = key
+		}
+	}
+	if len(v2.Keys) == 0 {
+		return CryptoMigrationReport{}, errors.New("encrypted store: keyring has no v2 keys to migrate")
+	}
+	v2.Primary = slices.Min(slices.Collect(maps.Keys(v2.Keys)))
+	from, err := NewKeyringEncryptedStore(backend, v2)
+	if err != nil {
+		return CryptoMigrationReport{}, err
+	}
+	to, err := NewKeyringEncryptedStore(backend, v4)
+	if err != nil {
+		return CryptoMigrationReport{}, err
+	}
+	return MigrateCrypto(ctx, from, to, opts)
+}
+
+// MigrateCrypto rewrites every object of the shared backend that the target store
+// cannot decrypt but the source store can. Each object is decrypted, written to
+// the target store unless it already exists there, read back and compared, and
+// only then removed from the source. Content type, metadata and tags are kept.
+//
+// The migration can be repeated at any time; objects already readable by the
+// target store are skipped without being read.
+func MigrateCrypto(ctx context.Context, from, to *EncryptedStore, opts MigrateCryptoOptions) (report CryptoMigrationReport, err error) {
+	ctx, span := tracer.Start(ctx, "encrypted_store.MigrateCrypto")
+	defer span.End()
+	defer span.RecordError(err)
+
+	if !sameStore(from.backend, to.backend) {
+		return report, NewErrorE(http.StatusBadRequest, ErrNotSupported).
+			Str("from", from.StoreName()).Str("to", to.StoreName()).Msg("Crypto migration requires a shared backend.")
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultBatchConcurrency
+	}
+	report.Checkpoint = opts.StartAfter
+	report.Failed = make(map[string]string)
+
+	var (
+		mu      sync.Mutex
+		pending []string // listed keys in order, until processed
+		done    = make(map[string]bool)
+	)
+	finish := func(key string, outcome migrationOutcome, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		report.Scanned++
+		switch outcome {
+		case migrationMigrated:
+			report.Migrated++
+		case migrationCurrent:
+			report.Current++
+		case migrationConflict:
+			report.Conflicts = append(report.Conflicts, key)
+		case migrationUndecryptable:
+			report.Undecryptable = append(report.Undecryptable, key)
+		case migrationFailed:
+			report.Failed[key] = err.Error()
+			zl.Warn().Str("component", "EncryptedStore").Str("bucket", to.StoreName()).Str("file", key).
+				Err(err).Msg("could not migrate object")
+		}
+		done[key] = true
+		for len(pending) > 0 && done[pending[0]] {
+			report.Checkpoint = pending[0]
+			delete(done, pending[0])
+			pending = pending[1:]
+		}
+		if opts.Progress != nil {
+			opts.Progress(report)
+		}
+	}
+
+	grp, gctx := errgroup.WithContext(ctx)
+	grp.SetLimit(concurrency)
+	for info := range to.backend.ListObjectsWithOptions(gctx, ListOptions{StartAfter: opts.StartAfter}) {
+		if info.Err != nil {
+			grp.Wait()
+			return report, info.Err
+		}
+		mu.Lock()
+		pending = append(pending, info.Key)
+		mu.Unlock()
+		grp.Go(func() error {
+			outcome, err := migrateObject(gctx, from, to, info.Key, opts)
+			finish(info.Key, outcome, err)
+			return nil
+		})
+	}
+	grp.Wait()
+
+	zl.Info().Str("component", "EncryptedStore").Str("bucket", to.StoreName()).Bool("dryRun", opts.DryRun).
+		Int("scanned", report.Scanned).Int("migrated", report.Migrated).Int("current", report.Current).
+		Int("conflicts", len(report.Conflicts)).Int("undecryptable", len(report.Undecryptable)).
+		Int("failed", len(report.Failed)).Msg("migrated crypto")
+	return report, ctx.Err()
+}
+
+type migrationOutcome int
+
+const (
+	migrationMigrated migrationOutcome = iota
+	migrationCurrent
+	migrationConflict
+	migrationUndecryptable
+	migrationFailed
+)
+
+func migrateObject(ctx context.Context, from, to *EncryptedStore, key string, opts MigrateCryptoOptions) (migrationOutcome, error) {
+	if _, err := tryDecryptFilename(to, key); err == nil {
+		return migrationCurrent, nil
+	}
+	file, err := tryDecryptFilename(from, key)
+	if err != nil {
+		return migrationUndecryptable, nil
+	}
+
+	data, info, err := from.backend.GetObject(ctx, key)
+	if errors.Is(err, ErrObjectNotFound) {
+		return migrationCurrent, nil // removed concurrently
+	} else if err != nil {
+		return migrationFailed, err
+	}
+	plaintext, _, err := from.decryptBlob(ctx, file, key, data)
+	if err != nil && !errors.Is(err, ErrDecryptionFailed) {
+		return migrationFailed, err
+	}
+	if err == nil && opts.Validate != nil {
+		err = opts.Validate(file, plaintext)
+	}
+	if err != nil {
+		return migrationUndecryptable, nil
+	}
+	if opts.DryRun {
+		return migrationMigrated, nil
+	}
+
+	_, err = to.PutObjectWithOptions(ctx, file, bytes.Clone(plaintext), PutOptions{
+		IfNoneMatch:     true,
+		ContentType:     info.ContentType,
+		ContentEncoding: info.ContentEncoding,
+		Metadata:        info.Metadata,
+		Tags:            info.Tags,
+	})
+	if err != nil && !errors.Is(err, ErrPreconditionFailed) {
+		return migrationFailed, err
+	}
+	// verify the migrated object, or compare with the object written by a previous run or by the service
+	written, _, err := to.GetObject(ctx, file)
+	if err != nil {
+		return migrationFailed, err
+	}
+	if !bytes.Equal(written, plaintext) {
+		return migrationConflict, nil
+	}
+
+	err = from.backend.DeleteObjectWithOptions(ctx, key, DeleteOptions{IfMatch: info.ETag})
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return migrationFailed, err
+	}
+	return migrationMigrated, nil
+}
+
+// tryDecryptFilename decrypts the backend key. Since v1 crypto is not
+// authenticated, the decrypted filename must at least be valid UTF-8.
+func tryDecryptFilename(es *EncryptedStore, key string) (string, error) {
+	file, err := es.decryptFilename(key)
+	if err == nil && !utf8.ValidString(file) {
+		err = fmt.Errorf("%w: invalid utf-8 filename", ErrDecryptionFailed)
+	}
+	return file, err
+}
@@ -0,0 +1,98 @@
+package common
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestMigrateV1ToV2(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryStore("test")
+	v1, err := NewInsecureEncryptedStore(backend, testKeyOld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := NewEncryptedStore(backend, testKeyOld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"person/00000001.json", "person/00000002.json", "person/00000003.json"} {
+		if _, err := v1.PutObjectWithOptions(ctx, file, []byte(`{"name":"`+file+`"}`), PutOptions{ContentType: "application/json"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := v2.PutObject(ctx, "person/00000003.json", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.PutObject(ctx, "not-encrypted", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := MigrateV1ToV2(ctx, backend, testKeyOld, MigrateCryptoOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrated != 3 || len(backend.Keys()) != 5 {
+		t.Errorf("expected dry run to report 3 objects without migrating but got %+v", report)
+	}
+
+	report, err = MigrateV1ToV2(ctx, backend, testKeyOld, MigrateCryptoOptions{Concurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Scanned != 5 || report.Migrated != 2 || report.Current != 1 || len(report.Conflicts) != 1 ||
+		len(report.Undecryptable) != 1 || len(report.Failed) != 0 {
+		t.Errorf("expected 2 migrated, 1 current, 1 conflict and 1 undecryptable object but got %+v", report)
+	}
+	if report.Checkpoint != backend.Keys()[len(backend.Keys())-1] {
+		t.Errorf("expected checkpoint after the last key but got %q", report.Checkpoint)
+	}
+	data, info, err := v2.GetObject(ctx, "person/00000001.json")
+	if err != nil || string(data) != `{"name":"person/00000001.json"}` || info.ContentType != "application/json" {
+		t.Errorf("expected migrated object with content type but got %q %+v (%v)", data, info, err)
+	}
+
+	report, err = MigrateV1ToV2(ctx, backend, testKeyOld, MigrateCryptoOptions{})
+	if err != nil || report.Migrated != 0 || report.Current != 3 {
+		t.Errorf("expected repeated migration to find 3 current objects but got %+v (%v)", report, err)
+	}
+}
+
+func TestMigrateV2ToV4(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryStore("test")
+	v2, err := NewEncryptedStore(backend, testKeyOld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"person/00000001.json", "person/00000002.json"} {
+		if _, err := v2.PutObjectWithOptions(ctx, file, []byte(`{"name":"`+file+`"}`), PutOptions{ContentType: "application/json"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := MigrateV2ToV4(ctx, backend, Keyring{Primary: "", Keys: map[string]string{"": testKeyOld}}, MigrateCryptoOptions{}); err == nil {
+		t.Error("expected migration to a v2 key to be refused")
+	}
+
+	keyring, err := ParseKeyring("v4:2028:" + testKeyNew + "," + testKeyOld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := MigrateV2ToV4(ctx, backend, keyring, MigrateCryptoOptions{})
+	if err != nil || report.Scanned != 2 || report.Migrated != 2 || len(report.Failed) != 0 {
+		t.Errorf("expected 2 migrated objects but got %+v (%v)", report, err)
+	}
+	v4, err := NewKeyringEncryptedStore(backend, keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{v4.encryptFilename("person/00000001.json"), v4.encryptFilename("person/00000002.json")}
+	if keys := backend.Keys(); !slices.Equal(keys, slices.Sorted(slices.Values(want))) {
+		t.Errorf("expected only v4 filenames but got %v", keys)
+	}
+	data, info, err := v4.GetObject(ctx, "person/00000001.json")
+	if err != nil || string(data) != `{"name":"person/00000001.json"}` || info.ContentType != "application/json" {
+		t.Errorf("expected migrated object with content type but got %q %+v (%v)", data, info, err)
+	}
+}
@@ -0,0 +1,109 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/http"
+)
+
+// v3Crypto is v2 crypto that authenticates associated data with the object data.
+// EncryptedStore passes the bucket and plaintext filename, so objects cannot be
+// swapped between filenames or buckets without detection. Filenames are
+// encrypted like v2, so v2 and v3 objects of a file share the same key.
+//
+// v3 objects are marked by a flag of their header, see blobMagic. Removing the flag
+// does not help an attacker, since the ciphertext must then be authenticated
+// without the associated data.
+type v3Crypto struct {
+	v2Crypto
+}
+
+func (c v3Crypto) encryptData(nonce, data, ad []byte) []byte {
+	return c.seal(nonce, data, ad)
+}
+
+func (c v3Crypto) decryptData(data, ad []byte) ([]byte, error) {
+	return c.open(data, ad)
+}
+
+// boundModule returns v3 crypto with the data key of the v2 or v4 crypto module.
+func boundModule(cm cryptoModule) (cryptoModule, bool) {
+	switch c := cm.(type) {
+	case v2Crypto:
+		return v3Crypto{c}, true
+	case v4Crypto:
+		return v3Crypto{c.v2Crypto}, true
+	}
+	return nil, false
+}
+
+// BindOptions configures EncryptedStore.Bind.
+type BindOptions struct {
+	// Bucket is authenticated with every object. It defaults to the name of the
+	// backend. Objects remain readable in a copy of the bucket with another name,
+	// e.g. with a bucket prefix, only if the same bucket is configured there.
+	Bucket string
+	// ReadOnly keeps writing v2 objects. Deploy it first, so that every instance
+	// can read v3 objects before any instance writes them.
+	ReadOnly bool
+	// Require refuses v2 objects, which could still be swapped. Enable it once
+	// RotateKeys has rewritten all objects with v3 crypto.
+	Require bool
+}
+
+// Bind returns a store that writes objects with v3 crypto, which authenticates
+// the bucket and filename of each object. Objects written with v2 crypto remain
+// readable, and are rewritten with v3 crypto by RotateKeys.
+//
+// Every store reads v3 objects, authenticating the name of the backend unless
+// Bind configures another bucket. Since the ciphertext depends on the filename,
+// CopyObject and MoveObject re-encrypt v3 objects instead of copying them
+// server-side.
+func (es *EncryptedStore) Bind(opts BindOptions) (*EncryptedStore, error) {
+	if _, ok := boundModule(es.crypto); !ok && !opts.ReadOnly {
+		return nil, errors.New("encrypted store: v3 crypto requires v2 or v4 keys")
+	}
+	bound := *es
+	bound.bind = opts
+	bound.bound = !opts.ReadOnly
+	return &bound, nil
+}
+
+// associatedData returns the associated data of v3 objects of the file. Both the
+// bucket and the filename are length prefixed, so that no other pair of bucket and
+// filename, e.g. "a/b" and "c" for "a" and "b/c", has the same associated data.
+func (es *EncryptedStore) associatedData(file string) []byte {
+	bucket := es.bindBucket()
+	ad := binary.AppendUvarint(nil, uint64(len(bucket)))
+	ad = append(ad, bucket...)
+	ad = binary.AppendUvarint(ad, uint64(len(file)))
+	return append(ad, file...)
+}
+
+func (es *EncryptedStore) bindBucket() string {
+	if es.bind.Bucket == "" {
+		return es.backend.StoreName()
+	}
+	return es.bind.Bucket
+}
+
+// module returns the crypto module of the key, v3 crypto if the object is bound.
+func (es *EncryptedStore) module(keyID string, bound bool) (cryptoModule, error) {
+	cm, ok := es.keys[keyID]
+	if !ok || keyID == envelopeKeyID {
+		return nil, unknownKeyError(keyID)
+	}
+	if !bound {
+		return cm, nil
+	}
+	if cm, ok = boundModule(cm); !ok {
+		return nil, NewErrorE(http.StatusNotImplemented, ErrNotSupported).Str("keyID", keyID).
+			Msg("Crypto scheme does not support associated data.")
+	}
+	return cm, nil
+}
+
+func (es *EncryptedStore) unboundError(file string) error {
+	return NewErrorE(http.StatusInternalServerError, ErrDecryptionFailed).Caller(1).
+		Str("bucket", es.StoreName()).Str("file", file).Msg("Object is not bound to its filename.")
+}
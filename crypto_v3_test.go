@@ -0,0 +1,139 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func readAllObject(t *testing.T, store *EncryptedStore, file string) ([]byte, error) {
+	t.Helper()
+	r, _, err := store.GetObjectReader(context.Background(), file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func TestEncryptedStoreBind(t *testing.T) {
+	ctx := context.Background()
+	es, backend := newTestEncryptedStore(t)
+	if _, err := es.PutObject(ctx, "v2", []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+
+	bound, err := es.Bind(BindOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bound.PutObject(ctx, "a", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	stream := bytes.Repeat([]byte("lingio"), streamChunkSize)
+	for _, file := range []string{"b", "c"} {
+		if _, err := bound.PutObjectReader(ctx, file, bytes.NewReader(stream), int64(len(stream)), PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, store := range []*EncryptedStore{es, bound} {
+		if data, _, err := store.GetObject(ctx, "a"); err != nil || string(data) != "a" {
+			t.Errorf("expected v3 object to be readable but got %q (%v)", data, err)
+		}
+		if data, err := readAllObject(t, store, "b"); err != nil || !bytes.Equal(data, stream) {
+			t.Errorf("expected v3 stream to be readable but got %d bytes (%v)", len(data), err)
+		}
+	}
+
+	// swap the ciphertexts of b and c
+	b, _, _ := backend.GetObject(ctx, es.encryptFilename("b"))
+	if _, err := backend.PutObject(ctx, es.encryptFilename("c"), b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readAllObject(t, bound, "c"); err == nil {
+		t.Error("expected ciphertext of another file to be refused")
+	}
+	other := NewMemoryStore("other")
+	if _, err := other.PutObject(ctx, es.encryptFilename("b"), b); err != nil {
+		t.Fatal(err)
+	}
+	copied, err := NewEncryptedStore(other, "0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readAllObject(t, copied, "b"); err == nil {
+		t.Error("expected ciphertext of another bucket to be refused")
+	}
+	if copied, err = copied.Bind(BindOptions{Bucket: "test", ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readAllObject(t, copied, "b"); err != nil {
+		t.Errorf("expected copy with the bound bucket to be readable but got %v", err)
+	}
+
+	if _, err := bound.CopyObject(ctx, "a", "a2", CopyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bound.MoveObject(ctx, "b", "b2", CopyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _, err := bound.GetObject(ctx, "a2"); err != nil || string(data) != "a" {
+		t.Errorf("expected copied v3 object to be re-encrypted but got %q (%v)", data, err)
+	}
+	if data, err := readAllObject(t, bound, "b2"); err != nil || !bytes.Equal(data, stream) {
+		t.Errorf("expected moved v3 stream to be re-encrypted but got %d bytes (%v)", len(data), err)
+	}
+	if _, _, err := bound.GetObject(ctx, "b"); err == nil {
+		t.Error("expected moved object to be removed")
+	}
+
+	strict, err := es.Bind(BindOptions{Require: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := strict.GetObject(ctx, "v2"); err == nil {
+		t.Error("expected v2 object to be refused")
+	}
+	if err := bound.DeleteObject(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+	result, err := strict.RotateKeys(ctx, RotateOptions{})
+	if err != nil || result.Rotated != 1 || result.Failed != 0 {
+		t.Errorf("expected v2 object to be rewritten but got %+v (%v)", result, err)
+	}
+	if data, _, err := strict.GetObject(ctx, "v2"); err != nil || string(data) != "v2" {
+		t.Errorf("expected rewritten object to be bound but got %q (%v)", data, err)
+	}
+}
+
+func TestEncryptedStoreBindAssociatedData(t *testing.T) {
+	ctx := context.Background()
+	es, backend := newTestEncryptedStore(t)
+	bound, err := es.Bind(BindOptions{Bucket: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := es.Bind(BindOptions{Bucket: "a/b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(bound.associatedData("b/c"), other.associatedData("c")) {
+		t.Error("expected associated data to tell bucket and filename apart")
+	}
+
+	if _, err := bound.PutObject(ctx, "b/c", []byte("b/c")); err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := backend.GetObject(ctx, es.encryptFilename("b/c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.PutObject(ctx, es.encryptFilename("c"), data); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := other.GetObject(ctx, "c"); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("expected object swapped to another bucket and filename to be refused but got %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package common
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+)
+
+// v4Crypto encrypts object data like v2, but encrypts filenames with a synthetic
+// IV: the IV is a MAC of the filename, so equal filenames still encrypt to the
+// same name, while different filenames never share a nonce. v2 crypto derives
+// the nonce of a filename from its first 12 bytes, so filenames with a common
+// prefix reuse a GCM nonce.
+//
+// Separate keys for data, filename encryption and the filename MAC are derived
+// from the key with HKDF. Data is encrypted with v2 crypto under the data key,
+// so v4 keys support streaming and v3 binding like v2 keys.
+type v4Crypto struct {
+	v2Crypto
+	filenameBlock cipher.Block
+	filenameMAC   []byte
+}
+
+const v4IVSize = aes.BlockSize
+
+func newV4Crypto(key []byte) (cryptoModule, error) {
+	derive := func(info string) ([]byte, error) {
+		return hkdf.Key(sha256.New, key, nil, "lingio encrypted store v4 "+info, 32)
+	}
+	dataKey, err := derive("data")
+	if err != nil {
+		return nil, fmt.Errorf("hkdf: %w", err)
+	}
+	filenameKey, err := derive("filename")
+	if err != nil {
+		return nil, fmt.Errorf("hkdf: %w", err)
+	}
+	macKey, err := derive("filename mac")
+	if err != nil {
+		return nil, fmt.Errorf("hkdf: %w", err)
+	}
+
+	data, err := newV2Crypto(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(filenameKey)
+	if err != nil {
+		return nil, fmt.Errorf("cipher: %w", err)
+	}
+	return v4Crypto{data.(v2Crypto), block, macKey}, nil
+}
+
+// syntheticIV returns the IV of the filename.
+func (c v4Crypto) syntheticIV(plaintext []byte) []byte {
+	mac := hmac.New(sha256.New, c.filenameMAC)
+	mac.Write(plaintext)
+	return mac.Sum(nil)[:v4IVSize]
+}
+
+// encryptFilename encrypts the filename as iv || AES-CTR(plaintext).
+func (c v4Crypto) encryptFilename(plaintext string) string {
+	iv := c.syntheticIV([]byte(plaintext))
+	ciphertext := make([]byte, v4IVSize+len(plaintext))
+	copy(ciphertext, iv)
+	cipher.NewCTR(c.filenameBlock, iv).XORKeyStream(ciphertext[v4IVSize:], []byte(plaintext))
+	return base32.StdEncoding.EncodeToString(ciphertext)
+}
+
+func (c v4Crypto) decryptFilename(ciphertext string) (string, error) {
+	decodedCiphertext, err := base32.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("%w: base32 decode: %q: %w", ErrDecryptionFailed, ciphertext, err)
+	}
+	if len(decodedCiphertext) < v4IVSize {
+		return "", fmt.Errorf("%w: filename too short", ErrDecryptionFailed)
+	}
+	iv, encrypted := decodedCiphertext[:v4IVSize], decodedCiphertext[v4IVSize:]
+	plaintext := make([]byte, len(encrypted))
+	cipher.NewCTR(c.filenameBlock, iv).XORKeyStream(plaintext, encrypted)
+	// the synthetic IV authenticates the filename
+	if !hmac.Equal(iv, c.syntheticIV(plaintext)) {
+		return "", fmt.Errorf("%w: filename authentication failed", ErrDecryptionFailed)
+	}
+	return string(plaintext), nil
+}
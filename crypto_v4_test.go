@@ -0,0 +1,98 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"errors"
+	"testing"
+)
+
+func TestV4CryptoFilenames(t *testing.T) {
+	cm, err := newV4Crypto([]byte(testKeyNew))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := cm.encryptFilename("users/0123456789/a.json"), cm.encryptFilename("users/0123456789/b.json")
+	if a != cm.encryptFilename("users/0123456789/a.json") {
+		t.Error("expected filename encryption to be deterministic")
+	}
+	decodedA, _ := base32.StdEncoding.DecodeString(a)
+	decodedB, _ := base32.StdEncoding.DecodeString(b)
+	if bytes.Equal(decodedA[:v4IVSize], decodedB[:v4IVSize]) {
+		t.Error("expected filenames with a common prefix to use different IVs")
+	}
+	if file, err := cm.decryptFilename(a); err != nil || file != "users/0123456789/a.json" {
+		t.Errorf("expected filename to be decrypted but got %q (%v)", file, err)
+	}
+
+	tampered := flipBit(decodedA, len(decodedA)-1)
+	if _, err := cm.decryptFilename(base32.StdEncoding.EncodeToString(tampered)); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("expected tampered filename to be refused but got %v", err)
+	}
+	v2, err := newV2Crypto([]byte(testKeyNew))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cm.decryptFilename(v2.encryptFilename("a")); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("expected v2 filename to be refused but got %v", err)
+	}
+}
+
+func TestEncryptedStoreV4Migration(t *testing.T) {
+	ctx := context.Background()
+	es, backend := newTestEncryptedStore(t)
+	for _, key := range []string{"a", "b"} {
+		if _, err := es.PutObject(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keyring, err := ParseKeyring("v4:2028:" + testKeyNew + "," + testKeyOld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyring.Primary != "2028" || keyring.Versions["2028"] != 4 || keyring.Versions[""] != 0 {
+		t.Errorf("expected primary v4 key but got %+v", keyring)
+	}
+	if _, err := NewKeyringEncryptedStore(backend, Keyring{Keys: map[string]string{"": testKeyNew}, Versions: map[string]int{"": 4}}); err == nil {
+		t.Error("expected v4 key without an id to be refused")
+	}
+	for _, s := range []string{"v4:" + testKeyNew, "v4::" + testKeyNew, "v4:v4:" + testKeyNew} {
+		if keyring, err := ParseKeyring(s); err == nil {
+			t.Errorf("expected %q to be refused but got %+v", s, keyring)
+		}
+	}
+	if _, err := NewKeyringEncryptedStore(backend, Keyring{Primary: "v4", Keys: map[string]string{"v4": testKeyNew}}); err == nil {
+		t.Error("expected key id v4 to be refused")
+	}
+
+	rotating, err := NewKeyringEncryptedStore(backend, keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := rotating.RotateKeys(ctx, RotateOptions{})
+	if err != nil || result.Rotated != 2 || result.Failed != 0 {
+		t.Errorf("expected v2 objects to be rotated but got %+v (%v)", result, err)
+	}
+	v4, err := NewKeyringEncryptedStore(backend, Keyring{Primary: "2028", Keys: map[string]string{"2028": testKeyNew}, Versions: map[string]int{"2028": 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if data, _, err := v4.GetObject(ctx, key); err != nil || string(data) != key {
+			t.Errorf("expected %q to be readable with the v4 key only but got %q (%v)", key, data, err)
+		}
+	}
+
+	bound, err := v4.Bind(BindOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bound.PutObject(ctx, "c", []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := readAllObject(t, v4, "c"); err != nil || string(data) != "c" {
+		t.Errorf("expected bound v4 object to be readable but got %q (%v)", data, err)
+	}
+}
@@ -240,6 +240,23 @@ func RespondFile(ctx echo.Context, statusCode int, file []byte, fileName string,
 	return ctx.Blob(statusCode, contentType, file)
 }
 
+// RespondPresigned responds with a presigned request as json, e.g. for clients
+// that upload directly to the bucket. The response must not be cached.
+func RespondPresigned(ctx echo.Context, statusCode int, req PresignedRequest) error {
+	ctx.Response().Header().Set("Pragma", "no-cache")
+	ctx.Response().Header().Set("Cache-Control", "no-store")
+	return ctx.JSON(statusCode, req)
+}
+
+// RedirectPresigned redirects the client to a presigned download URL.
+func RedirectPresigned(ctx echo.Context, req PresignedRequest) error {
+	if req.Method != http.MethodGet || len(req.Header) > 0 {
+		return NewError(http.StatusInternalServerError).Str("method", req.Method).Msg("Only plain GET requests can be redirected.")
+	}
+	ctx.Response().Header().Set("Cache-Control", "no-store")
+	return ctx.Redirect(http.StatusTemporaryRedirect, req.URL)
+}
+
 // RespondError is deprecated. Return an error directly in the middleware instead.
 func RespondError(ctx echo.Context, le *Error) error {
 	// returning le directly will busy loop somewhere in echo
@@ -1,6 +1,8 @@
 package common
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
@@ -11,44 +13,72 @@ import (
 	"hash/fnv"
 	"io"
 	"net/http"
+	"sort"
+	"strings"
 
+	zl "github.com/rs/zerolog/log"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 )
 
-// EncryptedStore
+// EncryptedStore encrypts object data and filenames before they reach the backend.
+// Content type, metadata and tags are stored in plaintext. Listings report the
+// size of the encrypted object, while reads and writes report the plaintext size.
+//
+// Objects are written with the primary key of the keyring. While the keyring holds
+// several keys, objects are looked up under every key, primary first. Conditional
+// writes and deletes cost an additional listing per key to find the current object,
+// and remove it from the other keys.
 type EncryptedStore struct {
-	backend LingioStore
-	crypto  cryptoModule
+	backend  LingioStore
+	crypto   cryptoModule // primary key
+	keyID    string
+	keyIDs   []string // primary first
+	keys     map[string]cryptoModule
+	envelope *envelopeCrypto // encrypts data instead of the primary key, if set
+	bind     BindOptions
+	bound    bool // writes v3 crypto
 }
 
-// cryptoModule is a simple wrapper for AEAD crypto.
+// ErrDecryptionFailed is wrapped by errors of objects and filenames that cannot be
+// decrypted, because they are corrupted, truncated or were tampered with.
+var ErrDecryptionFailed = errors.New("encrypted store: decryption failed")
+
+// cryptoModule is a simple wrapper for AEAD crypto. The associated data of
+// encryptData and decryptData is ignored by schemes before v3.
 type cryptoModule interface {
 	encryptFilename(plaintext string) string
 	decryptFilename(ciphertext string) (string, error)
 
-	encryptData(nonce, data []byte) []byte
-	decryptData(ciphertext []byte) []byte
+	encryptData(nonce, data, ad []byte) []byte
+	decryptData(ciphertext, ad []byte) ([]byte, error)
 }
 
-// NewEncryptedStore initializes a lingio store with secure v2 crypto.
+// NewEncryptedStore initializes a lingio store with v2 crypto. v2 filename
+// encryption reuses nonces, so new buckets should use a keyring with a v4 key.
 func NewEncryptedStore(backend LingioStore, cipherKey string) (*EncryptedStore, error) {
 	if len(cipherKey) != 32 {
 		return nil, errors.New("encrypted store: cipherKey must be 32 chars")
 	}
+	return NewKeyringEncryptedStore(backend, Keyring{Keys: map[string]string{"": cipherKey}})
+}
 
-	cm, err := newV2Crypto([]byte(cipherKey))
-	if err != nil {
-		return nil, fmt.Errorf("encrypted store: v2 crypto: %w", err)
+// NewKeyringEncryptedStore initializes a lingio store that writes with the primary
+// key of the keyring and reads with any of its keys.
+func NewKeyringEncryptedStore(backend LingioStore, keyring Keyring) (*EncryptedStore, error) {
+	if err := keyring.validate(); err != nil {
+		return nil, fmt.Errorf("encrypted store: %w", err)
 	}
 
-	return &EncryptedStore{
-		backend: backend,
-		crypto:  cm,
-	}, nil
+	keys, err := keyring.modules()
+	if err != nil {
+		return nil, err
+	}
+	return newEncryptedStore(backend, keyring.Primary, keys), nil
 }
 
 // NewInsecureEncryptedStore initializes a lingio store with insecure v1 crypto.
+// Use MigrateV1ToV2 to move existing objects to v2 crypto.
 func NewInsecureEncryptedStore(backend LingioStore, cipherKey string) (*EncryptedStore, error) {
 	if len(cipherKey) != 32 {
 		return nil, errors.New("encrypted store: cipherKey must be 32 chars")
@@ -59,10 +89,24 @@ func NewInsecureEncryptedStore(backend LingioStore, cipherKey string) (*Encrypte
 		return nil, fmt.Errorf("encrypted store: v1 crypto: %w", err)
 	}
 
-	return &EncryptedStore{
+	return newEncryptedStore(backend, "", map[string]cryptoModule{"": cm}), nil
+}
+
+func newEncryptedStore(backend LingioStore, keyID string, keys map[string]cryptoModule) *EncryptedStore {
+	es := &EncryptedStore{
 		backend: backend,
-		crypto:  cm,
-	}, nil
+		crypto:  keys[keyID],
+		keyID:   keyID,
+		keyIDs:  []string{keyID},
+		keys:    keys,
+	}
+	for id := range keys {
+		if id != keyID {
+			es.keyIDs = append(es.keyIDs, id)
+		}
+	}
+	sort.Strings(es.keyIDs[1:])
+	return es
 }
 
 func (es *EncryptedStore) GetObject(ctx context.Context, file string) (plaintext []byte, info ObjectInfo, err error) {
@@ -72,76 +116,843 @@ func (es *EncryptedStore) GetObject(ctx context.Context, file string) (plaintext
 	defer span.End()
 	defer span.RecordError(err)
 
-	data, info, err := es.backend.GetObject(ctx, es.crypto.encryptFilename(file))
+	var data []byte
+	var encfile string
+	err = es.locate(file, func(name string) (err error) {
+		encfile = name
+		data, info, err = es.backend.GetObject(ctx, encfile)
+		return err
+	})
 	if err != nil {
 		return nil, ObjectInfo{}, err
 	}
 
-	plaintext = es.crypto.decryptData(data)
-	info.Key, err = es.crypto.decryptFilename(info.Key)
+	plaintext, hdr, err := es.decryptBlob(ctx, file, encfile, data)
 	if err != nil {
-		return nil, ObjectInfo{}, NewErrorE(http.StatusInternalServerError, err).Msg("Could not decrypt filename.")
+		return nil, ObjectInfo{}, err
 	}
+	info.Key = file
+	info.Size = int64(len(plaintext))
+	info.ContentEncoding = hdr.contentEncoding(info)
 
 	return plaintext, info, nil
 }
 
-func (es *EncryptedStore) PutObject(ctx context.Context, file string, data []byte) (info ObjectInfo, err error) {
+func (es *EncryptedStore) PutObject(ctx context.Context, file string, data []byte) (ObjectInfo, error) {
+	return es.PutObjectWithOptions(ctx, file, data, PutOptions{})
+}
+
+// PutObjectWithOptions encrypts and stores the object. Preconditions are passed
+// through to the backend and refer to the ETag of the encrypted object.
+func (es *EncryptedStore) PutObjectWithOptions(ctx context.Context, file string, data []byte, opts PutOptions) (info ObjectInfo, err error) {
 	ctx, span := tracer.Start(ctx, "encrypted_store.PutObject", trace.WithAttributes(
 		attribute.String("file", file),
 	))
 	defer span.End()
 	defer span.RecordError(err)
 
-	encdata := es.crypto.encryptData(nil, data) // generate new nonce for every write
-	encfile := es.crypto.encryptFilename(file)
+	encdata, err := es.encryptBlob(ctx, file, opts.ContentEncoding, data) // generate new nonce for every write
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err = es.put(ctx, file, opts, func(encfile string, opts PutOptions) (ObjectInfo, error) {
+		return es.backend.PutObjectWithOptions(ctx, encfile, encdata, opts)
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info.Key = file
+	info.Size = int64(len(data))
+	info.ContentEncoding = opts.ContentEncoding
+	return info, nil
+}
+
+// GetObjectReader opens the file for reading and decrypts it while it is read.
+// Objects written by PutObject are decrypted in memory.
+func (es *EncryptedStore) GetObjectReader(ctx context.Context, file string) (_ io.ReadCloser, info ObjectInfo, err error) {
+	ctx, span := tracer.Start(ctx, "encrypted_store.GetObjectReader", trace.WithAttributes(
+		attribute.String("file", file),
+	))
+	defer span.End()
+	defer span.RecordError(err)
+
+	var r io.ReadCloser
+	var encfile string
+	err = es.locate(file, func(name string) (err error) {
+		encfile = name
+		r, info, err = GetObjectReader(ctx, es.backend, encfile)
+		return err
+	})
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	info.Key = file
+
+	var hdr blobHeader
+	r, info.Size, hdr, err = es.openBlob(ctx, file, encfile, r, info.Size)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	info.ContentEncoding = hdr.contentEncoding(info)
+	return r, info, nil
+}
+
+// PutObjectReader encrypts and uploads the contents of r in chunks, so memory
+// use stays bounded regardless of the object size.
+func (es *EncryptedStore) PutObjectReader(ctx context.Context, file string, r io.Reader, size int64, opts PutOptions) (info ObjectInfo, err error) {
+	ctx, span := tracer.Start(ctx, "encrypted_store.PutObjectReader", trace.WithAttributes(
+		attribute.String("file", file),
+		attribute.Int64("size", size),
+	))
+	defer span.End()
+	defer span.RecordError(err)
+
+	aead, header, ad, err := es.streamKey(ctx, file, opts.ContentEncoding)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	er, err := newEncryptReader(aead, r, ad)
+	if err != nil {
+		return ObjectInfo{}, NewErrorE(http.StatusInternalServerError, err).Msg("Could not encrypt object.")
+	}
+	encsize := encryptedStreamSize(aead, size)
+	if encsize >= 0 {
+		encsize += int64(len(header))
+	}
 
-	info, err = es.backend.PutObject(ctx, encfile, encdata)
+	info, err = es.put(ctx, file, opts, func(encfile string, opts PutOptions) (ObjectInfo, error) {
+		return PutObjectReader(ctx, es.backend, encfile, io.MultiReader(bytes.NewReader(header), er), encsize, opts)
+	})
 	if err != nil {
 		return ObjectInfo{}, err
 	}
 	info.Key = file
+	info.Size = plaintextStreamSize(aead, info.Size-int64(len(header)))
+	info.ContentEncoding = opts.ContentEncoding
 	return info, nil
 }
 
-func (es EncryptedStore) DeleteObject(ctx context.Context, file string) (err error) {
+func streamAEAD(cm cryptoModule) (cipher.AEAD, error) {
+	ap, ok := cm.(aeadProvider)
+	if !ok {
+		return nil, NewErrorE(http.StatusNotImplemented, ErrNotSupported).Msg("Crypto scheme does not support streaming.")
+	}
+	return ap.aead(), nil
+}
+
+// newBlobHeader returns the header of a new object with the content encoding.
+func (es *EncryptedStore) newBlobHeader(encoding string) blobHeader {
+	hdr := blobHeader{version: cryptoVersion(es.crypto), keyID: es.keyID, bound: es.bound}
+	if es.envelope != nil {
+		// data keys encrypt like v2 keys, whatever the filename key
+		hdr.version, hdr.keyID = 2, envelopeKeyID
+	}
+	if isCompression(Compression(encoding)) {
+		hdr.compression = Compression(encoding)
+	}
+	return hdr
+}
+
+// streamKey returns the AEAD, header and associated data for a new streamed object.
+func (es *EncryptedStore) streamKey(ctx context.Context, file, encoding string) (aead cipher.AEAD, header, ad []byte, err error) {
+	hdr := es.newBlobHeader(encoding)
+	hdr.stream = true
+	if es.bound {
+		ad = es.associatedData(file)
+	}
+	if es.envelope != nil {
+		dk, err := es.envelope.dataKey(ctx)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		hdr.masterKeyID, hdr.wrapped = dk.masterKeyID, dk.wrapped
+		return dk.aead, appendBlobHeader(nil, hdr), ad, nil
+	}
+	aead, err = streamAEAD(es.crypto)
+	return aead, appendBlobHeader(nil, hdr), ad, err
+}
+
+// encryptBlob encrypts the data of the file with the primary key, or a data key
+// if envelope encryption is used.
+func (es *EncryptedStore) encryptBlob(ctx context.Context, file, encoding string, data []byte) ([]byte, error) {
+	hdr := es.newBlobHeader(encoding)
+	var ad []byte
+	cm := es.crypto
+	if es.bound {
+		ad = es.associatedData(file)
+		cm, _ = boundModule(cm)
+	}
+	if es.envelope != nil {
+		return es.envelope.seal(ctx, hdr, data, ad)
+	}
+	return append(appendBlobHeader(nil, hdr), cm.encryptData(nil, data, ad)...), nil
+}
+
+// decryptBlob decrypts data of the file stored under the encrypted filename,
+// written by either PutObject or PutObjectReader.
+func (es *EncryptedStore) decryptBlob(ctx context.Context, file, encfile string, data []byte) ([]byte, blobHeader, error) {
+	var plaintext []byte
+	hdr, n, err := es.sniffBlobHeader(encfile, data)
+	if err == nil {
+		plaintext, err = es.decryptBlobData(ctx, file, hdr, data[n:])
+	} else {
+		err = es.decryptionError(file, err)
+	}
+	if err != nil && hdr.maybeRaw {
+		if plaintext, rerr := es.decryptBlobData(ctx, file, blobHeader{}, data); rerr == nil {
+			return plaintext, blobHeader{}, nil
+		}
+	}
+	return plaintext, hdr, err
+}
+
+// decryptBlobData decrypts the data following the header.
+func (es *EncryptedStore) decryptBlobData(ctx context.Context, file string, hdr blobHeader, data []byte) ([]byte, error) {
+	ad, err := es.blobAssociatedData(file, hdr)
+	if err != nil {
+		return nil, err
+	}
+	cm, aead, err := es.blobKey(ctx, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	var plaintext []byte
+	if hdr.stream {
+		plaintext, err = decryptStreamBlob(aead, data, ad)
+	} else {
+		plaintext, err = decryptData(cm, aead, data, ad)
+	}
+	if err != nil {
+		return nil, es.decryptionError(file, err)
+	}
+	return plaintext, nil
+}
+
+func decryptStreamBlob(aead cipher.AEAD, data, ad []byte) ([]byte, error) {
+	dr, err := newDecryptReader(aead, bytes.NewReader(data), ad)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(dr)
+}
+
+// decryptData decrypts data written by PutObject with the data key of envelope
+// encryption, if any, or the crypto module.
+func decryptData(cm cryptoModule, aead cipher.AEAD, data, ad []byte) ([]byte, error) {
+	if aead != nil {
+		return openEnvelopeData(aead, data, ad)
+	}
+	return cm.decryptData(data, ad)
+}
+
+// blobAssociatedData returns the associated data of the object, if it is bound.
+func (es *EncryptedStore) blobAssociatedData(file string, hdr blobHeader) ([]byte, error) {
+	if !hdr.bound {
+		if es.bind.Require {
+			return nil, es.unboundError(file)
+		}
+		return nil, nil
+	}
+	return es.associatedData(file), nil
+}
+
+// blobKey returns the crypto module that decrypts the object, and the AEAD of
+// streams or the data key of envelope encryption.
+func (es *EncryptedStore) blobKey(ctx context.Context, hdr blobHeader) (cryptoModule, cipher.AEAD, error) {
+	if hdr.keyID == envelopeKeyID {
+		if es.envelope == nil {
+			return nil, nil, unknownKeyError(envelopeKeyID)
+		}
+		aead, err := es.envelope.unwrap(ctx, hdr.masterKeyID, hdr.wrapped)
+		return nil, aead, err
+	}
+	cm, err := es.module(hdr.keyID, hdr.bound)
+	if err != nil {
+		return nil, nil, err
+	}
+	if version := cryptoVersion(es.keys[hdr.keyID]); hdr.version != 0 && hdr.version != version {
+		return nil, nil, NewErrorE(http.StatusInternalServerError, ErrDecryptionFailed).Str("keyID", hdr.keyID).
+			Int("version", hdr.version).Int("keyVersion", version).Msg("Object is encrypted with another crypto version than its key.")
+	}
+	if !hdr.stream {
+		return cm, nil, nil
+	}
+	aead, err := streamAEAD(cm)
+	return cm, aead, err
+}
+
+// decryptionError reports an object of the file that cannot be decrypted.
+func (es *EncryptedStore) decryptionError(file string, err error) *Error {
+	if !errors.Is(err, ErrDecryptionFailed) {
+		err = fmt.Errorf("%w: %w", ErrDecryptionFailed, err)
+	}
+	return NewErrorE(http.StatusInternalServerError, err).Caller(1).
+		Str("bucket", es.StoreName()).Str("file", file).Msg("Could not decrypt object.")
+}
+
+// openBlob decrypts an encrypted object of the file with the given size, stored
+// under the encrypted filename, while it
+// is read. It returns the plaintext reader and size, and how the object was
+// encrypted. Objects written by PutObject are decrypted in memory.
+func (es *EncryptedStore) openBlob(ctx context.Context, file, encfile string, r io.ReadCloser, size int64) (_ io.ReadCloser, _ int64, hdr blobHeader, err error) {
+	br := bufio.NewReader(r)
+	defer func() {
+		if err != nil {
+			r.Close()
+		}
+	}()
+
+	hdr, n, err := es.peekBlobHeader(encfile, br)
+	if err != nil && !hdr.maybeRaw {
+		if errors.Is(err, ErrDecryptionFailed) {
+			err = es.decryptionError(file, err)
+		}
+		return nil, 0, hdr, err
+	}
+	if hdr.maybeRaw && !es.opensStream(ctx, file, hdr, br, n) {
+		// only decryption tells whether the object has a header
+		defer r.Close()
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return nil, 0, hdr, NewErrorE(http.StatusInternalServerError, err).Msg("Could not read object data.")
+		}
+		plaintext, hdr, err := es.decryptBlob(ctx, file, encfile, data)
+		if err != nil {
+			return nil, 0, hdr, err
+		}
+		return io.NopCloser(bytes.NewReader(plaintext)), int64(len(plaintext)), hdr, nil
+	}
+	ad, err := es.blobAssociatedData(file, hdr)
+	if err != nil {
+		return nil, 0, hdr, err
+	}
+	cm, aead, err := es.blobKey(ctx, hdr)
+	if err != nil {
+		return nil, 0, hdr, err
+	}
+	br.Discard(n)
+	size -= int64(n)
+
+	if !hdr.stream {
+		defer r.Close()
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return nil, 0, hdr, NewErrorE(http.StatusInternalServerError, err).Msg("Could not read object data.")
+		}
+		plaintext, err := decryptData(cm, aead, data, ad)
+		if err != nil {
+			return nil, 0, hdr, es.decryptionError(file, err)
+		}
+		return io.NopCloser(bytes.NewReader(plaintext)), int64(len(plaintext)), hdr, nil
+	}
+
+	dr, err := newDecryptReader(aead, br, ad)
+	if err != nil {
+		return nil, 0, hdr, es.decryptionError(file, err)
+	}
+	return decryptReadCloser{dr, r}, dr.plaintextSize(size), hdr, nil
+}
+
+// opensStream reports whether the stream key following the header of n bytes
+// decrypts, which proves that the object has the header without reading it all.
+func (es *EncryptedStore) opensStream(ctx context.Context, file string, hdr blobHeader, br *bufio.Reader, n int) bool {
+	if !hdr.stream {
+		return false
+	}
+	ad, err := es.blobAssociatedData(file, hdr)
+	if err != nil {
+		return false
+	}
+	_, aead, err := es.blobKey(ctx, hdr)
+	if err != nil {
+		return false
+	}
+	data, _ := br.Peek(n + streamHeaderSize(aead))
+	if len(data) < n || !bytes.HasPrefix(data[n:], streamKeyMagic) {
+		return false
+	}
+	_, err = newDecryptReader(aead, bytes.NewReader(data[n:]), ad)
+	return err == nil
+}
+
+func (es EncryptedStore) DeleteObject(ctx context.Context, file string) error {
+	return es.DeleteObjectWithOptions(ctx, file, DeleteOptions{})
+}
+
+// DeleteObjectWithOptions removes the object if the preconditions hold.
+func (es EncryptedStore) DeleteObjectWithOptions(ctx context.Context, file string, opts DeleteOptions) (err error) {
 	ctx, span := tracer.Start(ctx, "encrypted_store.DeleteObject", trace.WithAttributes(
 		attribute.String("file", file),
 	))
 	defer span.End()
 	defer span.RecordError(err)
-	return es.backend.DeleteObject(ctx, es.crypto.encryptFilename(file))
+
+	if opts.VersionID != "" {
+		return es.locate(file, func(encfile string) error {
+			return es.backend.DeleteObjectWithOptions(ctx, encfile, opts)
+		})
+	}
+	encfile, stored, err := es.current(ctx, file)
+	if err != nil {
+		return err
+	}
+	if len(stored) > 0 && opts.IfMatch != "" && stored[0].ETag != opts.IfMatch {
+		return es.preconditionFailed(file)
+	}
+	if err := es.backend.DeleteObjectWithOptions(ctx, encfile, opts); err != nil {
+		return err
+	}
+	es.removeStale(ctx, encfile, stored)
+	return nil
+}
+
+// CopyObject copies the encrypted object to the encrypted destination filename,
+// server-side if the backend supports it. Objects written with v3 crypto are
+// re-encrypted, see Bind. SourceETag refers to the encrypted object.
+func (es EncryptedStore) CopyObject(ctx context.Context, src, dst string, opts CopyOptions) (info ObjectInfo, err error) {
+	ctx, span := tracer.Start(ctx, "encrypted_store.CopyObject", trace.WithAttributes(
+		attribute.String("src", src),
+		attribute.String("dst", dst),
+	))
+	defer span.End()
+	defer span.RecordError(err)
+
+	srcfile, _, err := es.current(ctx, src)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	r, srcinfo, err := es.openBound(ctx, srcfile)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if r != nil {
+		return es.reencrypt(ctx, src, srcfile, dst, r, srcinfo, opts)
+	}
+	info, err = es.put(ctx, dst, PutOptions{IfNoneMatch: opts.IfNoneMatch}, func(encfile string, popts PutOptions) (ObjectInfo, error) {
+		return es.backend.CopyObject(ctx, srcfile, encfile, CopyOptions{SourceETag: opts.SourceETag, IfNoneMatch: popts.IfNoneMatch})
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info.Key = dst
+	return info, nil
+}
+
+// MoveObject moves the encrypted object to the encrypted destination filename.
+func (es EncryptedStore) MoveObject(ctx context.Context, src, dst string, opts CopyOptions) (info ObjectInfo, err error) {
+	ctx, span := tracer.Start(ctx, "encrypted_store.MoveObject", trace.WithAttributes(
+		attribute.String("src", src),
+		attribute.String("dst", dst),
+	))
+	defer span.End()
+	defer span.RecordError(err)
+
+	srcfile, stored, err := es.current(ctx, src)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	r, srcinfo, err := es.openBound(ctx, srcfile)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if r != nil {
+		if info, err = es.reencrypt(ctx, src, srcfile, dst, r, srcinfo, opts); err != nil {
+			return ObjectInfo{}, err
+		}
+		err = es.backend.DeleteObjectWithOptions(ctx, srcfile, DeleteOptions{IfMatch: srcinfo.ETag})
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			return ObjectInfo{}, err
+		}
+		es.removeStale(ctx, srcfile, stored)
+		return info, nil
+	}
+	info, err = es.put(ctx, dst, PutOptions{IfNoneMatch: opts.IfNoneMatch}, func(encfile string, popts PutOptions) (ObjectInfo, error) {
+		return es.backend.MoveObject(ctx, srcfile, encfile, CopyOptions{SourceETag: opts.SourceETag, IfNoneMatch: popts.IfNoneMatch})
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	es.removeStale(ctx, srcfile, stored)
+	info.Key = dst
+	return info, nil
+}
+
+// openBound opens the stored object if it was written with v3 crypto, which
+// cannot be copied server-side. Otherwise no reader is returned.
+func (es EncryptedStore) openBound(ctx context.Context, encfile string) (io.ReadCloser, ObjectInfo, error) {
+	r, info, err := GetObjectReader(ctx, es.backend, encfile)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	br := bufio.NewReader(r)
+	if hdr, _, err := es.peekBlobHeader(encfile, br); err != nil || !hdr.bound {
+		r.Close()
+		return nil, ObjectInfo{}, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{br, r}, info, nil
+}
+
+// reencrypt decrypts the opened source object, stored under the encrypted filename
+// srcfile, and writes it to dst.
+func (es EncryptedStore) reencrypt(ctx context.Context, src, srcfile, dst string, r io.ReadCloser, srcinfo ObjectInfo, opts CopyOptions) (ObjectInfo, error) {
+	if opts.SourceETag != "" && opts.SourceETag != srcinfo.ETag {
+		r.Close()
+		return ObjectInfo{}, es.preconditionFailed(src)
+	}
+	pr, size, hdr, err := es.openBlob(ctx, src, srcfile, r, srcinfo.Size)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer pr.Close()
+	return es.PutObjectReader(ctx, dst, pr, size, PutOptions{
+		IfNoneMatch:     opts.IfNoneMatch,
+		ContentType:     srcinfo.ContentType,
+		ContentEncoding: hdr.contentEncoding(srcinfo),
+		Metadata:        srcinfo.Metadata,
+		Tags:            srcinfo.Tags,
+	})
+}
+
+// DeleteObjects removes the files, in bulk if the backend implements BatchDeleter.
+func (es EncryptedStore) DeleteObjects(ctx context.Context, files []string) []BatchResult {
+	if es.rotating() {
+		return forEach(ctx, files, DefaultBatchConcurrency, func(i int) BatchResult {
+			return BatchResult{Key: files[i], Err: es.DeleteObject(ctx, files[i])}
+		})
+	}
+	encfiles := make([]string, len(files))
+	for i, file := range files {
+		encfiles[i] = es.encryptFilename(file)
+	}
+	results := DeleteObjects(ctx, es.backend, encfiles, DefaultBatchConcurrency)
+	for i := range results {
+		results[i].Key = files[i]
+	}
+	return results
 }
 
 // ListObjects will list all decryptable objects.
 func (es EncryptedStore) ListObjects(ctx context.Context) <-chan ObjectInfo {
+	return withoutListingErrors(es.ListObjectsWithOptions(ctx, ListOptions{}))
+}
+
+// ListObjectsWithOptions will list decryptable objects in the order of their
+// encrypted keys. Since encrypted keys do not share prefixes, the whole bucket
+// is listed and filtered on the decrypted key. StartAfter must be the
+// decrypted key of an object from a previous listing.
+//
+// While the keyring holds several keys, the order of an object depends on the key
+// it is stored under, which changes when it is rotated, so a listing cannot be
+// continued: StartAfter is refused with ErrNotSupported. Objects that are briefly
+// stored under two keys are only listed once within a listing.
+func (es EncryptedStore) ListObjectsWithOptions(ctx context.Context, opts ListOptions) <-chan ObjectInfo {
 	ctx, span := tracer.Start(ctx, "encrypted_store.ListObjects")
+	ctx, cancel := context.WithCancel(ctx)
 
-	listing := es.backend.ListObjects(ctx)
 	objects := make(chan ObjectInfo, 10)
 	go func() {
 		defer span.End()
 		defer close(objects)
+		defer cancel()
+
+		backendOpts := ListOptions{Skipped: opts.Skipped}
+		if opts.StartAfter != "" {
+			if es.rotating() {
+				objects <- ObjectInfo{Err: NewErrorE(http.StatusBadRequest, ErrNotSupported).Str("bucket", es.StoreName()).
+					Msg("Listings cannot be continued while keys are rotated.")}
+				return
+			}
+			backendOpts.StartAfter = es.encryptFilename(opts.StartAfter)
+		}
+		listing := es.backend.ListObjectsWithOptions(ctx, backendOpts)
 
+		// an object can briefly be stored under two keys while it is rewritten
+		var seen map[string]bool
+		if es.rotating() {
+			seen = make(map[string]bool)
+		}
+		var n int
 		for info := range listing {
-			// If backing store contains objects encrypted with another key or
-			// scheme, we should silently ignore them for now since the channel
-			// consumer cannot do anything worthwhile with that object anyway.
-			key, err := es.crypto.decryptFilename(info.Key)
-			if err != nil {
-				continue
+			if info.Err == nil {
+				// Objects encrypted with another key or scheme are left out, since
+				// the channel consumer cannot do anything worthwhile with them, but
+				// can be reported to find corrupted data.
+				if info.Key == envelopeKeyObject {
+					continue
+				}
+				key, err := es.decryptFilename(info.Key)
+				if err != nil {
+					if opts.Skipped != nil {
+						opts.Skipped(info.Key, err)
+					}
+					continue
+				}
+				if !strings.HasPrefix(key, opts.Prefix) || seen[key] {
+					continue
+				}
+				if seen != nil {
+					seen[key] = true
+				}
+				info.Key = key
+			}
+			select {
+			case objects <- info:
+			case <-ctx.Done():
+				return
+			}
+			if n++; info.Err != nil || n == opts.MaxKeys {
+				return
 			}
-			info.Key = key
-			objects <- info
 		}
 	}()
 	return objects
 }
 
+// ListenObjectEvents reports changes to decryptable objects with the plaintext
+// key prefix. The backend must implement NotifyingStore. Like listings, the
+// whole bucket is watched and filtered on the decrypted key.
+func (es EncryptedStore) ListenObjectEvents(ctx context.Context, prefix string) <-chan ObjectEvent {
+	backendEvents, err := ListenObjectEvents(ctx, es.backend, "")
+	if err != nil {
+		return failedObjectEvents(err)
+	}
+	events := make(chan ObjectEvent, 10)
+	go func() {
+		defer close(events)
+		for event := range backendEvents {
+			if event.Err == nil {
+				key, err := es.decryptFilename(event.Key)
+				if err != nil || !strings.HasPrefix(key, prefix) {
+					continue
+				}
+				event.Key = key
+			}
+			if !sendObjectEvent(ctx, events, event) {
+				return
+			}
+		}
+	}()
+	return events
+}
+
+// GetObjectVersion decrypts a specific version of the file. The backend must implement VersionedStore.
+func (es *EncryptedStore) GetObjectVersion(ctx context.Context, file, versionID string) (plaintext []byte, info ObjectInfo, err error) {
+	ctx, span := tracer.Start(ctx, "encrypted_store.GetObjectVersion", trace.WithAttributes(
+		attribute.String("file", file),
+		attribute.String("versionID", versionID),
+	))
+	defer span.End()
+	defer span.RecordError(err)
+
+	vs, err := versionedBackend(es.backend)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	var data []byte
+	var encfile string
+	err = es.locate(file, func(name string) (err error) {
+		encfile = name
+		data, info, err = vs.GetObjectVersion(ctx, encfile, versionID)
+		return err
+	})
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	info.Key = file
+	plaintext, hdr, err := es.decryptBlob(ctx, file, encfile, data)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	info.ContentEncoding = hdr.contentEncoding(info)
+	return plaintext, info, nil
+}
+
+// ListObjectVersions lists all versions of the file, under any key of the keyring.
+// The backend must implement VersionedStore.
+func (es *EncryptedStore) ListObjectVersions(ctx context.Context, file string) (_ []ObjectInfo, err error) {
+	ctx, span := tracer.Start(ctx, "encrypted_store.ListObjectVersions", trace.WithAttributes(
+		attribute.String("file", file),
+	))
+	defer span.End()
+	defer span.RecordError(err)
+
+	vs, err := versionedBackend(es.backend)
+	if err != nil {
+		return nil, err
+	}
+	var versions []ObjectInfo
+	for _, encfile := range es.filenames(file) {
+		v, err := vs.ListObjectVersions(ctx, encfile)
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			return nil, err
+		}
+		versions = append(versions, v...)
+	}
+	for i := range versions {
+		versions[i].Key = file
+	}
+	return versions, nil
+}
+
+// RestoreObjectVersion makes an old version the latest version of the file. The backend must implement VersionedStore.
+func (es *EncryptedStore) RestoreObjectVersion(ctx context.Context, file, versionID string) (info ObjectInfo, err error) {
+	ctx, span := tracer.Start(ctx, "encrypted_store.RestoreObjectVersion", trace.WithAttributes(
+		attribute.String("file", file),
+		attribute.String("versionID", versionID),
+	))
+	defer span.End()
+	defer span.RecordError(err)
+
+	vs, err := versionedBackend(es.backend)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	_, stored, err := es.current(ctx, file)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	var restored string
+	err = es.locate(file, func(encfile string) (err error) {
+		info, err = vs.RestoreObjectVersion(ctx, encfile, versionID)
+		restored = encfile
+		return err
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	es.removeStale(ctx, restored, stored)
+	info.Key = file
+	return info, nil
+}
+
 func (es EncryptedStore) StoreName() string {
 	return es.backend.StoreName()
 }
 
+// rotating reports whether the keyring holds several keys, in which case objects
+// may be stored under any of them.
+func (es *EncryptedStore) rotating() bool {
+	return len(es.keyIDs) > 1
+}
+
+// encryptFilename returns the encrypted filename under the primary key.
+func (es *EncryptedStore) encryptFilename(file string) string {
+	return keyedFilename(es.keyID, es.crypto.encryptFilename(file))
+}
+
+// filenames returns the encrypted filenames of the file under every key, primary first.
+func (es *EncryptedStore) filenames(file string) []string {
+	encfiles := make([]string, len(es.keyIDs))
+	for i, keyID := range es.keyIDs {
+		encfiles[i] = keyedFilename(keyID, es.keys[keyID].encryptFilename(file))
+	}
+	return encfiles
+}
+
+func (es *EncryptedStore) decryptFilename(name string) (string, error) {
+	keyID, encfile := splitKeyedFilename(name)
+	cm, ok := es.keys[keyID]
+	if !ok {
+		return "", ErrUnknownKey
+	}
+	return cm.decryptFilename(encfile)
+}
+
+// locate calls fn with the encrypted filenames of the file, primary key first,
+// until fn finds the object.
+func (es *EncryptedStore) locate(file string, fn func(encfile string) error) error {
+	var err error
+	for _, encfile := range es.filenames(file) {
+		if err = fn(encfile); !errors.Is(err, ErrObjectNotFound) {
+			return err
+		}
+	}
+	return err
+}
+
+// current returns the encrypted filename of the current object and the objects
+// stored under every key, primary first. If the object does not exist the
+// primary filename is returned. With a single key, no request is made.
+func (es *EncryptedStore) current(ctx context.Context, file string) (string, []ObjectInfo, error) {
+	if !es.rotating() {
+		return es.encryptFilename(file), nil, nil
+	}
+	var stored []ObjectInfo
+	for _, encfile := range es.filenames(file) {
+		page, err := ListObjectPage(ctx, es.backend, ListOptions{Prefix: encfile, MaxKeys: 1})
+		if err != nil {
+			return "", nil, err
+		}
+		if len(page) == 1 && page[0].Key == encfile {
+			stored = append(stored, page[0])
+		}
+	}
+	if len(stored) == 0 {
+		return es.encryptFilename(file), nil, nil
+	}
+	return stored[0].Key, stored, nil
+}
+
+// put writes the file under the primary key. While the keyring holds several keys,
+// preconditions are checked against the current object under any key, and the
+// object is removed from the other keys after the write. Unconditional writes skip
+// the lookup: reads prefer the primary key, and RotateKeys removes the previous
+// object under another key.
+//
+// The content encoding is recorded in the blob header and not passed to the
+// backend, since it does not apply to the ciphertext: HTTP clients would try to
+// decode the object, e.g. when downloading it with a presigned request.
+func (es *EncryptedStore) put(ctx context.Context, file string, opts PutOptions, write func(encfile string, opts PutOptions) (ObjectInfo, error)) (ObjectInfo, error) {
+	opts.ContentEncoding = ""
+	encfile := es.encryptFilename(file)
+	if !opts.IfNoneMatch && opts.IfMatch == "" {
+		return write(encfile, opts)
+	}
+	_, stored, err := es.current(ctx, file)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if len(stored) > 0 && stored[0].Key != encfile {
+		// the object is only stored under another key, so the primary filename must stay free
+		if opts.IfNoneMatch || opts.IfMatch != "" && opts.IfMatch != stored[0].ETag {
+			return ObjectInfo{}, es.preconditionFailed(file)
+		}
+		if opts.IfMatch != "" {
+			opts.IfMatch, opts.IfNoneMatch = "", true
+		}
+	}
+	info, err := write(encfile, opts)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	es.removeStale(ctx, encfile, stored)
+	return info, nil
+}
+
+// removeStale removes the stored objects except keep, unless they have changed.
+// Failures are logged, since reads prefer the primary key anyway.
+func (es *EncryptedStore) removeStale(ctx context.Context, keep string, stored []ObjectInfo) {
+	for _, info := range stored {
+		if info.Key == keep {
+			continue
+		}
+		err := es.backend.DeleteObjectWithOptions(ctx, info.Key, DeleteOptions{IfMatch: info.ETag})
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			zl.Warn().Str("component", "EncryptedStore").Str("bucket", es.StoreName()).Str("file", info.Key).
+				Err(err).Msg("could not remove object stored under previous key")
+		}
+	}
+}
+
+func (es *EncryptedStore) preconditionFailed(file string) error {
+	return NewErrorE(http.StatusPreconditionFailed, ErrPreconditionFailed).Caller(1).
+		Str("bucket", es.StoreName()).Str("file", file).Msg("Object ETag does not match.")
+}
+
 // v1Crypto implements partial object+filename encryption.
 type v1Crypto struct {
 	cipher cipher.Block
@@ -164,23 +975,33 @@ func (c v1Crypto) encryptFilename(plaintext string) string {
 func (c v1Crypto) decryptFilename(ciphertext string) (string, error) {
 	decodedCiphertext, err := base32.StdEncoding.DecodeString(ciphertext)
 	if err != nil {
-		return "", fmt.Errorf("base32 decode: %q: %w", ciphertext, err)
+		return "", fmt.Errorf("%w: base32 decode: %q: %w", ErrDecryptionFailed, ciphertext, err)
 	}
-	return string(c.decryptData(decodedCiphertext)), nil
+	plaintext, err := c.decryptData(decodedCiphertext, nil)
+	return string(plaintext), err
 }
 
-func (c v1Crypto) encryptData(nonce, data []byte) []byte {
-	// nonce is not used
+func (c v1Crypto) encryptData(nonce, data, ad []byte) []byte {
+	// nonce and associated data are not used
 	c.cipher.Encrypt(data, data)
 	return data
 }
 
-func (c v1Crypto) decryptData(data []byte) []byte {
+func (c v1Crypto) decryptData(data, ad []byte) ([]byte, error) {
+	// v1 is not authenticated, so only data too short to be encrypted is detected
+	if len(data) < c.cipher.BlockSize() {
+		return nil, fmt.Errorf("%w: ciphertext too short", ErrDecryptionFailed)
+	}
 	c.cipher.Decrypt(data, data)
-	return data
+	return data, nil
 }
 
 // v2Crypto implements full object+filename encryption.
+//
+// Deprecated: v2 filenames are encrypted with a nonce derived from their first 12
+// bytes, so filenames with a common prefix reuse a GCM nonce, which leaks their XOR
+// and can expose the authentication key. Use v4 keys for new buckets, and move
+// existing objects to a v4 key with RotateKeys or MigrateV2ToV4.
 type v2Crypto struct {
 	aesgcm cipher.AEAD
 }
@@ -199,26 +1020,43 @@ func newV2Crypto(key []byte) (cryptoModule, error) {
 	return v2Crypto{aesgcm}, nil
 }
 
+func (c v2Crypto) aead() cipher.AEAD {
+	return c.aesgcm
+}
+
 func (c v2Crypto) encryptFilename(plaintext string) string {
 	key := []byte(plaintext)
 
-	// deterministic nonce so we can find encoded ciphertext in object store in GetObject
-	nonce := fnv.New128a().Sum(key) // fnv128a has decent avalance properties and is fast
+	// deterministic nonce so we can find encoded ciphertext in object store in GetObject.
+	// Sum appends the hash to the filename, so the nonce is the first 12 bytes of the
+	// filename and is reused by filenames with a common prefix. Use v4 keys instead.
+	nonce := fnv.New128a().Sum(key)
 	nonce = nonce[:c.aesgcm.NonceSize()]
 
-	ciphertext := c.encryptData(nonce, key)
+	ciphertext := c.encryptData(nonce, key, nil)
 	return base32.StdEncoding.EncodeToString(ciphertext)
 }
 
 func (c v2Crypto) decryptFilename(ciphertext string) (string, error) {
 	decodedCiphertext, err := base32.StdEncoding.DecodeString(ciphertext)
 	if err != nil {
-		return "", fmt.Errorf("base32 decode: %q: %w", ciphertext, err)
+		return "", fmt.Errorf("%w: base32 decode: %q: %w", ErrDecryptionFailed, ciphertext, err)
 	}
-	return string(c.decryptData(decodedCiphertext)), nil
+	plaintext, err := c.decryptData(decodedCiphertext, nil)
+	return string(plaintext), err
 }
 
-func (c v2Crypto) encryptData(nonce, data []byte) []byte {
+func (c v2Crypto) encryptData(nonce, data, ad []byte) []byte {
+	// associated data is not used
+	return c.seal(nonce, data, nil)
+}
+
+func (c v2Crypto) decryptData(data, ad []byte) ([]byte, error) {
+	// associated data is not used
+	return c.open(data, nil)
+}
+
+func (c v2Crypto) seal(nonce, data, ad []byte) []byte {
 	if nonce == nil {
 		nonce = make([]byte, c.aesgcm.NonceSize())
 		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
@@ -227,7 +1065,7 @@ func (c v2Crypto) encryptData(nonce, data []byte) []byte {
 	}
 
 	// ciphertext reuses data slice
-	ciphertext := c.aesgcm.Seal(data[:0], nonce, data, nil)
+	ciphertext := c.aesgcm.Seal(data[:0], nonce, data, ad)
 
 	// nonce||ciphertext
 	var blob []byte
@@ -236,13 +1074,16 @@ func (c v2Crypto) encryptData(nonce, data []byte) []byte {
 	return blob
 }
 
-func (c v2Crypto) decryptData(data []byte) []byte {
+func (c v2Crypto) open(data, ad []byte) ([]byte, error) {
+	if len(data) < c.aesgcm.NonceSize() {
+		return nil, fmt.Errorf("%w: ciphertext too short", ErrDecryptionFailed)
+	}
 	nonce := data[:c.aesgcm.NonceSize()]
 	ciphertext := data[c.aesgcm.NonceSize():]
 
-	plaintext, err := c.aesgcm.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := c.aesgcm.Open(nil, nonce, ciphertext, ad)
 	if err != nil {
-		panic(fmt.Errorf("encrypted store: decrypt: %w", err))
+		return nil, fmt.Errorf("%w: %w", ErrDecryptionFailed, err)
 	}
-	return plaintext
+	return plaintext, nil
 }
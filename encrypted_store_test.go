@@ -0,0 +1,339 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func newTestEncryptedStore(t *testing.T) (*EncryptedStore, *MemoryStore) {
+	t.Helper()
+	backend := NewMemoryStore("test")
+	es, err := NewEncryptedStore(backend, "0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return es, backend
+}
+
+func TestEncryptedStoreRoundtrip(t *testing.T) {
+	ctx := context.Background()
+	es, backend := newTestEncryptedStore(t)
+
+	info, err := es.PutObjectWithOptions(ctx, "person/1.json", []byte(`{"id":1}`), PutOptions{IfNoneMatch: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := backend.Keys(); len(keys) != 1 || keys[0] == "person/1.json" {
+		t.Errorf("expected a single encrypted key in backend but got %v", keys)
+	}
+
+	data, _, err := es.GetObject(ctx, "person/1.json")
+	if err != nil || string(data) != `{"id":1}` {
+		t.Errorf("expected original data but got %q (%v)", data, err)
+	}
+
+	if _, err := es.PutObjectWithOptions(ctx, "person/1.json", nil, PutOptions{IfNoneMatch: true}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected ErrPreconditionFailed but got %v", err)
+	}
+	if err := es.DeleteObjectWithOptions(ctx, "person/1.json", DeleteOptions{IfMatch: info.ETag}); err != nil {
+		t.Errorf("expected delete with current etag to succeed but got %v", err)
+	}
+}
+
+func TestEncryptedStoreListing(t *testing.T) {
+	ctx := context.Background()
+	es, _ := newTestEncryptedStore(t)
+	for _, key := range []string{"a/1", "a/2", "b/1"} {
+		if _, err := es.PutObject(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if keys := listKeys(t, es, ListOptions{Prefix: "a/"}); len(keys) != 2 {
+		t.Errorf("expected 2 keys with prefix a/ but got %v", keys)
+	}
+
+	// encrypted keys do not sort like plaintext keys, so page through everything
+	var all []string
+	opts := ListOptions{MaxKeys: 1}
+	for {
+		page, err := ListObjectPage(ctx, es, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		all = append(all, page[0].Key)
+		opts.StartAfter = page[0].Key
+	}
+	if len(all) != 3 {
+		t.Errorf("expected to page through 3 keys but got %v", all)
+	}
+
+	// the prefix filters decrypted keys, and MaxKeys counts matching keys only
+	var prefixed []string
+	opts = ListOptions{Prefix: "a/", MaxKeys: 1}
+	for {
+		page, err := ListObjectPage(ctx, es, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		if len(page) != 1 || !strings.HasPrefix(page[0].Key, "a/") {
+			t.Fatalf("expected a page with one key with prefix a/ but got %v", page)
+		}
+		prefixed = append(prefixed, page[0].Key)
+		opts.StartAfter = page[0].Key
+	}
+	if slices.Sort(prefixed); !slices.Equal(prefixed, []string{"a/1", "a/2"}) {
+		t.Errorf("expected to page through the keys with prefix a/ but got %v", prefixed)
+	}
+}
+
+func TestEncryptedStoreListingErrors(t *testing.T) {
+	ctx := context.Background()
+	es, backend := newTestEncryptedStore(t)
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := es.PutObject(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	failure := errors.New("injected")
+	backend.InjectFault(Fault{Op: OpListObjects, Err: failure, After: 2})
+
+	var keys []string
+	var listErr error
+	for info := range es.ListObjectsWithOptions(ctx, ListOptions{}) {
+		if info.Err != nil {
+			listErr = info.Err
+			continue
+		}
+		keys = append(keys, info.Key)
+	}
+	if len(keys) != 2 || listErr != failure {
+		t.Errorf("expected 2 keys and the backend error in-band but got %v and %v", keys, listErr)
+	}
+	backend.ClearFaults()
+	backend.InjectFault(Fault{Op: OpListObjects, Err: failure, After: 2})
+	if _, err := ListObjectPage(ctx, es, ListOptions{}); err != failure {
+		t.Errorf("expected page to fail with %v but got %v", failure, err)
+	}
+	backend.ClearFaults()
+	backend.InjectFault(Fault{Op: OpListObjects, Err: failure, After: 2})
+	var listed int
+	for info := range es.ListObjects(ctx) {
+		if info.Err != nil {
+			t.Errorf("expected ListObjects to leave out listing errors but got %v", info.Err)
+		}
+		listed++
+	}
+	if listed != 2 {
+		t.Errorf("expected ListObjects to list 2 keys but got %d", listed)
+	}
+}
+
+func TestEncryptedStoreReader(t *testing.T) {
+	ctx := context.Background()
+	es, _ := newTestEncryptedStore(t)
+
+	plaintext := bytes.Repeat([]byte("lingio"), streamChunkSize)
+	if _, err := es.PutObjectReader(ctx, "blob", bytes.NewReader(plaintext), int64(len(plaintext)), PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, _, err := es.GetObjectReader(ctx, "blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(plaintext, data) {
+		t.Error("expected streamed data to match plaintext")
+	}
+}
+
+func TestEncryptedStoreMetadata(t *testing.T) {
+	ctx := context.Background()
+	es, _ := newTestEncryptedStore(t)
+
+	_, err := es.PutObjectWithOptions(ctx, "a", []byte("hello"), PutOptions{
+		ContentType: "text/plain",
+		Metadata:    map[string]string{"schema-version": "2"},
+		Tags:        map[string]string{"partner": "p1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, info, err := es.GetObject(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 5 || info.ContentType != "text/plain" || info.Metadata["Schema-Version"] != "2" || info.Tags["partner"] != "p1" {
+		t.Errorf("expected plaintext size, content type, metadata and tags but got %+v", info)
+	}
+}
+
+func TestEncryptedStoreDecryptionErrors(t *testing.T) {
+	ctx := context.Background()
+	es, backend := newTestEncryptedStore(t)
+	for _, file := range []string{"flipped", "truncated", "empty"} {
+		if _, err := es.PutObject(ctx, file, []byte(`{"id":1}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream := bytes.Repeat([]byte("lingio"), streamChunkSize)
+	if _, err := es.PutObjectReader(ctx, "stream", bytes.NewReader(stream), int64(len(stream)), PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := map[string]func([]byte) []byte{
+		"flipped":   func(data []byte) []byte { return flipBit(data, len(data)-1) },
+		"truncated": func(data []byte) []byte { return data[:5] },
+		"empty":     func(data []byte) []byte { return nil },
+		"stream":    func(data []byte) []byte { return flipBit(data, len(data)/2) },
+	}
+	for file, fn := range corrupt {
+		data, _, err := backend.GetObject(ctx, es.encryptFilename(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := backend.PutObject(ctx, es.encryptFilename(file), fn(data)); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := es.GetObject(ctx, file); !errors.Is(err, ErrDecryptionFailed) || errorStatus(err) != 500 {
+			t.Errorf("%s: expected ErrDecryptionFailed but got %v", file, err)
+		}
+	}
+	r, _, err := es.GetObjectReader(ctx, "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("expected corrupted stream to fail with ErrDecryptionFailed but got %v", err)
+	}
+
+	if _, err := backend.PutObject(ctx, "not-encrypted", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	skipped := make(map[string]error)
+	keys := listKeys(t, es, ListOptions{Skipped: func(key string, err error) { skipped[key] = err }})
+	if len(keys) != 4 || len(skipped) != 1 || !errors.Is(skipped["not-encrypted"], ErrDecryptionFailed) {
+		t.Errorf("expected 4 keys and the unencrypted key to be skipped but got %v and %v", keys, skipped)
+	}
+}
+
+// versionedMemoryStore keeps every version written to a MemoryStore, similar to a
+// versioned bucket.
+type versionedMemoryStore struct {
+	*MemoryStore
+	versions map[string][]memoryObject
+}
+
+func newVersionedMemoryStore() *versionedMemoryStore {
+	return &versionedMemoryStore{MemoryStore: NewMemoryStore("test"), versions: make(map[string][]memoryObject)}
+}
+
+func (vs *versionedMemoryStore) PutObject(ctx context.Context, file string, data []byte) (ObjectInfo, error) {
+	return vs.PutObjectWithOptions(ctx, file, data, PutOptions{})
+}
+
+func (vs *versionedMemoryStore) PutObjectWithOptions(ctx context.Context, file string, data []byte, opts PutOptions) (ObjectInfo, error) {
+	info, err := vs.MemoryStore.PutObjectWithOptions(ctx, file, data, opts)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info.VersionID = fmt.Sprintf("%s@%d", file, len(vs.versions[file]))
+	vs.versions[file] = append(vs.versions[file], memoryObject{bytes.Clone(data), info})
+	return info, nil
+}
+
+func (vs *versionedMemoryStore) GetObjectVersion(ctx context.Context, file, versionID string) ([]byte, ObjectInfo, error) {
+	for _, v := range vs.versions[file] {
+		if v.info.VersionID == versionID {
+			return bytes.Clone(v.data), v.info, nil
+		}
+	}
+	return nil, ObjectInfo{}, vs.notFound(file)
+}
+
+func (vs *versionedMemoryStore) ListObjectVersions(ctx context.Context, file string) ([]ObjectInfo, error) {
+	var versions []ObjectInfo
+	for _, v := range vs.versions[file] {
+		versions = append(versions, v.info)
+	}
+	return versions, nil
+}
+
+func (vs *versionedMemoryStore) RestoreObjectVersion(ctx context.Context, file, versionID string) (ObjectInfo, error) {
+	data, info, err := vs.GetObjectVersion(ctx, file, versionID)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return vs.PutObjectWithOptions(ctx, file, data, PutOptions{ContentEncoding: info.ContentEncoding})
+}
+
+func TestEncryptedStoreVersions(t *testing.T) {
+	ctx := context.Background()
+	unversioned, _ := newTestEncryptedStore(t)
+	if _, _, err := unversioned.GetObjectVersion(ctx, "a", "v1"); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expected unversioned backend to be refused but got %v", err)
+	}
+
+	backend := newVersionedMemoryStore()
+	old, err := NewEncryptedStore(backend, testKeyOld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1, err := old.PutObject(ctx, "a", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, err := NewKeyringEncryptedStore(backend, Keyring{Primary: "2027", Keys: map[string]string{"": testKeyOld, "2027": testKeyNew}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := es.PutObject(ctx, "a", []byte("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := es.ListObjectVersions(ctx, "a")
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("expected versions under both keys but got %+v (%v)", versions, err)
+	}
+	for _, v := range versions {
+		if v.Key != "a" || v.VersionID != v1.VersionID && v.VersionID != v2.VersionID {
+			t.Errorf("expected version of the plaintext key but got %+v", v)
+		}
+	}
+	if data, info, err := es.GetObjectVersion(ctx, "a", v1.VersionID); err != nil || string(data) != "1" || info.Key != "a" {
+		t.Errorf("expected version under the previous key to be decrypted but got %q %+v (%v)", data, info, err)
+	}
+	if _, _, err := es.GetObjectVersion(ctx, "a", "unknown"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expected ErrObjectNotFound for unknown version but got %v", err)
+	}
+
+	if _, err := es.RestoreObjectVersion(ctx, "a", v1.VersionID); err != nil {
+		t.Fatal(err)
+	}
+	if data, _, err := es.GetObject(ctx, "a"); err != nil || string(data) != "1" {
+		t.Errorf("expected restored version to be the latest but got %q (%v)", data, err)
+	}
+	if keys := backend.Keys(); len(keys) != 1 || keys[0] != old.encryptFilename("a") {
+		t.Errorf("expected the object only under the restored key but got %v", keys)
+	}
+}
@@ -0,0 +1,216 @@
+package common
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Streamed objects are encrypted in fixed-size chunks so that neither reads nor
+// writes need to hold the whole object in memory. The format is:
+//
+//	magic (4) || nonce (12) || sealed stream key (32 + 16) || chunk_0 || ... || chunk_n
+//
+// Every stream is encrypted with a random stream key, which is sealed with the key
+// of the store under a random nonce, like the data of PutObject. Every chunk is
+// sealed with the stream key and zero (7) || big-endian chunk counter (4) || final
+// flag (1) as nonce, with the associated data of v3 crypto, if any. All chunks
+// except the last hold exactly streamChunkSize bytes of plaintext, and the last
+// chunk is always present (possibly empty), so truncation, reordering and chunk
+// removal are all detected.
+const (
+	streamChunkSize   = 64 * 1024
+	streamKeySize     = 32
+	streamNoncePrefix = 7
+)
+
+// streamKeyMagic prefixes all data written with the chunked stream format.
+var streamKeyMagic = []byte("LSE2")
+
+var errStreamTruncated = fmt.Errorf("%w: encrypted stream truncated", ErrDecryptionFailed)
+
+// aeadProvider is implemented by crypto modules that can be used for streaming encryption.
+type aeadProvider interface {
+	aead() cipher.AEAD
+}
+
+// streamHeaderSize returns the size of the stream header with the sealed stream key.
+func streamHeaderSize(aead cipher.AEAD) int {
+	return len(streamKeyMagic) + aead.NonceSize() + streamKeySize + aead.Overhead()
+}
+
+// encryptedStreamSize returns the ciphertext size for a plaintext of the given size,
+// or -1 if the plaintext size is unknown.
+func encryptedStreamSize(aead cipher.AEAD, size int64) int64 {
+	if size < 0 {
+		return -1
+	}
+	chunks := size/streamChunkSize + 1
+	return int64(streamHeaderSize(aead)) + size + chunks*int64(aead.Overhead())
+}
+
+// plaintextStreamSize is the inverse of encryptedStreamSize. It returns 0 for
+// sizes that are too small to be a valid stream.
+func plaintextStreamSize(aead cipher.AEAD, size int64) int64 {
+	return plaintextChunksSize(aead, size-int64(streamHeaderSize(aead)))
+}
+
+// plaintextChunksSize returns the plaintext size of the chunks of a stream.
+func plaintextChunksSize(aead cipher.AEAD, size int64) int64 {
+	chunk := int64(streamChunkSize + aead.Overhead())
+	chunks := size/chunk + 1
+	if size -= chunks * int64(aead.Overhead()); size < 0 {
+		return 0
+	}
+	return size
+}
+
+func streamNonce(counter uint32, final bool) []byte {
+	nonce := make([]byte, streamNoncePrefix, streamNoncePrefix+5)
+	nonce = binary.BigEndian.AppendUint32(nonce, counter)
+	if final {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// encryptReader encrypts plaintext from src into the chunked stream format.
+type encryptReader struct {
+	aead    cipher.AEAD
+	src     io.Reader
+	ad      []byte
+	counter uint32
+	plain   []byte
+	buf     []byte // pending ciphertext
+	done    bool
+}
+
+func newEncryptReader(aead cipher.AEAD, src io.Reader, ad []byte) (*encryptReader, error) {
+	if aead.NonceSize() != streamNoncePrefix+5 {
+		return nil, fmt.Errorf("encrypted stream: unsupported nonce size %d", aead.NonceSize())
+	}
+	key := make([]byte, streamKeySize+aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("encrypted stream: could not generate stream key: %w", err)
+	}
+	key, nonce := key[:streamKeySize], key[streamKeySize:]
+	chunks, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	r := &encryptReader{
+		aead:  chunks,
+		src:   src,
+		ad:    ad,
+		plain: make([]byte, streamChunkSize),
+	}
+	r.buf = append(r.buf, streamKeyMagic...)
+	r.buf = append(r.buf, nonce...)
+	r.buf = aead.Seal(r.buf, nonce, key, ad)
+	return r, nil
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(r.src, r.plain)
+		final := false
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			final = true
+		} else if err != nil {
+			return 0, err
+		}
+		if r.counter == ^uint32(0) {
+			return 0, errors.New("encrypted stream: too many chunks")
+		}
+		r.buf = r.aead.Seal(r.buf[:0], streamNonce(r.counter, final), r.plain[:n], r.ad)
+		r.counter++
+		r.done = final
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// decryptReader decrypts ciphertext in the chunked stream format.
+type decryptReader struct {
+	aead    cipher.AEAD
+	src     io.Reader
+	ad      []byte
+	header  int // size of the stream header
+	counter uint32
+	chunk   []byte
+	buf     []byte // pending plaintext
+	done    bool
+}
+
+func newDecryptReader(aead cipher.AEAD, src io.Reader, ad []byte) (*decryptReader, error) {
+	header := make([]byte, streamHeaderSize(aead))
+	if _, err := io.ReadFull(src, header); err != nil {
+		return nil, fmt.Errorf("%w: encrypted stream header: %w", ErrDecryptionFailed, err)
+	}
+	if !bytes.HasPrefix(header, streamKeyMagic) {
+		return nil, fmt.Errorf("%w: invalid encrypted stream header", ErrDecryptionFailed)
+	}
+	nonce, sealed := header[len(streamKeyMagic):len(streamKeyMagic)+aead.NonceSize()], header[len(streamKeyMagic)+aead.NonceSize():]
+	key, err := aead.Open(nil, nonce, sealed, ad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: encrypted stream key: %w", ErrDecryptionFailed, err)
+	}
+	chunks, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		aead:   chunks,
+		src:    src,
+		ad:     ad,
+		header: len(header),
+		chunk:  make([]byte, streamChunkSize+chunks.Overhead()),
+	}, nil
+}
+
+// plaintextSize returns the plaintext size of the stream of the given size.
+func (r *decryptReader) plaintextSize(size int64) int64 {
+	return plaintextChunksSize(r.aead, size-int64(r.header))
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(r.src, r.chunk)
+		final := false
+		if err == io.EOF {
+			// a full chunk must always be followed by a final chunk
+			return 0, errStreamTruncated
+		} else if err == io.ErrUnexpectedEOF {
+			final = true
+		} else if err != nil {
+			return 0, err
+		}
+		plaintext, err := r.aead.Open(r.chunk[:0], streamNonce(r.counter, final), r.chunk[:n], r.ad)
+		if err != nil {
+			return 0, fmt.Errorf("%w: encrypted stream chunk %d: %w", ErrDecryptionFailed, r.counter, err)
+		}
+		r.buf = plaintext
+		r.counter++
+		r.done = final
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// decryptReadCloser closes the underlying ciphertext reader.
+type decryptReadCloser struct {
+	*decryptReader
+	io.Closer
+}
@@ -0,0 +1,122 @@
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func newTestStreamAEAD(t *testing.T) aeadProvider {
+	t.Helper()
+	cm, err := newV2Crypto([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cm.(aeadProvider)
+}
+
+func TestEncryptedStreamRoundtrip(t *testing.T) {
+	aead := newTestStreamAEAD(t).aead()
+
+	for _, size := range []int{0, 1, streamChunkSize - 1, streamChunkSize, streamChunkSize + 1, 3*streamChunkSize + 17} {
+		plaintext := make([]byte, size)
+		if _, err := rand.Read(plaintext); err != nil {
+			t.Fatal(err)
+		}
+
+		er, err := newEncryptReader(aead, bytes.NewReader(plaintext), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphertext, err := io.ReadAll(er)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := encryptedStreamSize(aead, int64(size)); int64(len(ciphertext)) != expected {
+			t.Errorf("size %d: expected ciphertext size %d but got %d", size, expected, len(ciphertext))
+		}
+		if actual := plaintextStreamSize(aead, int64(len(ciphertext))); actual != int64(size) {
+			t.Errorf("size %d: expected plaintext size %d but got %d", size, size, actual)
+		}
+
+		dr, err := newDecryptReader(aead, bytes.NewReader(ciphertext), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := io.ReadAll(dr)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(plaintext, decrypted) {
+			t.Errorf("size %d: decrypted data does not match plaintext", size)
+		}
+	}
+}
+
+func TestEncryptedStreamTampering(t *testing.T) {
+	aead := newTestStreamAEAD(t).aead()
+
+	plaintext := make([]byte, 2*streamChunkSize+100)
+	er, err := newEncryptReader(aead, bytes.NewReader(plaintext), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := io.ReadAll(er)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunk := streamChunkSize + aead.Overhead()
+	header := streamHeaderSize(aead)
+
+	var variants = map[string][]byte{
+		"truncated at chunk boundary": ciphertext[:header+2*chunk],
+		"truncated mid chunk":         ciphertext[:header+chunk+10],
+		"final chunk removed":         ciphertext[:header+chunk],
+		"chunks reordered":            append(append(append([]byte{}, ciphertext[:header]...), ciphertext[header+chunk:header+2*chunk]...), ciphertext[header:header+chunk]...),
+		"bit flipped":                 flipBit(ciphertext, header+5),
+	}
+
+	for name, data := range variants {
+		dr, err := newDecryptReader(aead, bytes.NewReader(data), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(dr); err == nil {
+			t.Errorf("%s: expected decryption error", name)
+		}
+	}
+}
+
+func TestEncryptedStreamKeys(t *testing.T) {
+	aead := newTestStreamAEAD(t).aead()
+	plaintext := bytes.Repeat([]byte("lingio"), streamChunkSize)
+	encrypt := func() []byte {
+		er, err := newEncryptReader(aead, bytes.NewReader(plaintext), []byte("ad"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphertext, err := io.ReadAll(er)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ciphertext
+	}
+	a, b := encrypt(), encrypt()
+	header := streamHeaderSize(aead)
+	if !bytes.HasPrefix(a, streamKeyMagic) || bytes.Equal(a[:header], b[:header]) {
+		t.Error("expected every stream to be encrypted with its own stream key")
+	}
+	if dr, err := newDecryptReader(aead, bytes.NewReader(a), nil); err == nil {
+		_, err = io.ReadAll(dr)
+		t.Errorf("expected stream key to be bound to the associated data but got %v", err)
+	}
+
+}
+
+func flipBit(data []byte, i int) []byte {
+	data = append([]byte{}, data...)
+	data[i] ^= 1
+	return data
+}
@@ -0,0 +1,472 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	zl "github.com/rs/zerolog/log"
+)
+
+// KeyManager wraps and unwraps data keys with master keys that never leave it,
+// e.g. a cloud KMS. Envelope encrypted stores only store wrapped data keys, so the
+// master key can be rotated by rewrapping data keys instead of re-encrypting data,
+// and revoked by removing it from the key manager.
+type KeyManager interface {
+	// WrapKey encrypts the data key with the current master key and returns
+	// the ID of the master key, e.g. a KMS key version.
+	WrapKey(ctx context.Context, key []byte) (masterKeyID string, wrapped []byte, err error)
+	// UnwrapKey decrypts a data key wrapped by the master key with the ID.
+	UnwrapKey(ctx context.Context, masterKeyID string, wrapped []byte) ([]byte, error)
+}
+
+// LocalKeyManager wraps data keys with AES-GCM master keys read from files, e.g.
+// mounted secrets created with `openssl rand -base64 32`. Master keys are
+// identified by a fingerprint, so files can be renamed freely.
+type LocalKeyManager struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// NewLocalKeyManager reads base64 encoded 32 byte master keys from the files. The
+// first key wraps new data keys, the other keys can only unwrap.
+func NewLocalKeyManager(paths ...string) (*LocalKeyManager, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("local key manager: no master key files")
+	}
+	km := &LocalKeyManager{keys: make(map[string]cipher.AEAD)}
+	for i, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("local key manager: %w", err)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("local key manager: %s must contain a base64 encoded 32 byte key", path)
+		}
+		aead, err := newAESGCM(key)
+		if err != nil {
+			return nil, fmt.Errorf("local key manager: %w", err)
+		}
+		sum := sha256.Sum256(key)
+		id := hex.EncodeToString(sum[:8])
+		if i == 0 {
+			km.primary = id
+		}
+		km.keys[id] = aead
+	}
+	return km, nil
+}
+
+func (km *LocalKeyManager) WrapKey(ctx context.Context, key []byte) (string, []byte, error) {
+	aead := km.keys[km.primary]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", nil, fmt.Errorf("local key manager: could not generate nonce: %w", err)
+	}
+	return km.primary, aead.Seal(nonce, nonce, key, []byte(km.primary)), nil
+}
+
+func (km *LocalKeyManager) UnwrapKey(ctx context.Context, masterKeyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := km.keys[masterKeyID]
+	if !ok {
+		return nil, fmt.Errorf("local key manager: master key %q: %w", masterKeyID, ErrUnknownKey)
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("local key manager: wrapped key too short")
+	}
+	key, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(masterKeyID))
+	if err != nil {
+		return nil, fmt.Errorf("local key manager: unwrap: %w", err)
+	}
+	return key, nil
+}
+
+// KMSKeyManager adapts a cloud KMS to a KeyManager, without depending on its SDK.
+// With Google Cloud KMS for example:
+//
+//	km := common.KMSKeyManager{
+//		Encrypt: func(ctx context.Context, plaintext []byte) ([]byte, string, error) {
+//			resp, err := client.Encrypt(ctx, &kmspb.EncryptRequest{Name: keyName, Plaintext: plaintext})
+//			if err != nil {
+//				return nil, "", err
+//			}
+//			return resp.Ciphertext, resp.Name, nil
+//		},
+//		Decrypt: func(ctx context.Context, ciphertext []byte) ([]byte, error) {
+//			resp, err := client.Decrypt(ctx, &kmspb.DecryptRequest{Name: keyName, Ciphertext: ciphertext})
+//			if err != nil {
+//				return nil, err
+//			}
+//			return resp.Plaintext, nil
+//		},
+//	}
+type KMSKeyManager struct {
+	// Encrypt encrypts with the primary version of the key and returns the
+	// ciphertext and the name of the key version.
+	Encrypt func(ctx context.Context, plaintext []byte) (ciphertext []byte, keyVersion string, err error)
+	// Decrypt decrypts a ciphertext returned by Encrypt.
+	Decrypt func(ctx context.Context, ciphertext []byte) ([]byte, error)
+}
+
+func (km KMSKeyManager) WrapKey(ctx context.Context, key []byte) (string, []byte, error) {
+	wrapped, version, err := km.Encrypt(ctx, key)
+	if err != nil {
+		return "", nil, fmt.Errorf("kms key manager: wrap: %w", err)
+	}
+	return version, wrapped, nil
+}
+
+func (km KMSKeyManager) UnwrapKey(ctx context.Context, masterKeyID string, wrapped []byte) ([]byte, error) {
+	key, err := km.Decrypt(ctx, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("kms key manager: unwrap: %w", err)
+	}
+	return key, nil
+}
+
+// EnvelopeOptions configures NewEnvelopeEncryptedStore.
+type EnvelopeOptions struct {
+	// Keyring holds the keys of objects written before envelope encryption was
+	// enabled. They remain readable and are rewritten by RotateKeys. The primary
+	// key of the keyring is ignored.
+	Keyring Keyring
+}
+
+// envelopeKeyID is the key ID of filenames encrypted with the envelope filename
+// key, and marks envelope encrypted data in blob headers.
+const envelopeKeyID = "env"
+
+// envelopeKeyObject holds the wrapped filename key of an envelope encrypted bucket.
+// It is not valid base32, so it is never mistaken for an encrypted filename.
+const envelopeKeyObject = "lingio-envelope-key"
+
+// NewEnvelopeEncryptedStore initializes a lingio store that encrypts every object
+// with its own data key, wrapped by the key manager on every write. The wrapped
+// data key is stored with the object. Filenames must be encrypted deterministically, so they use a single
+// filename key that is stored wrapped in the bucket and created on first use.
+// Filenames are encrypted with v4 crypto.
+func NewEnvelopeEncryptedStore(ctx context.Context, backend LingioStore, km KeyManager, opts EnvelopeOptions) (*EncryptedStore, error) {
+	if _, ok := opts.Keyring.Keys[envelopeKeyID]; ok {
+		return nil, fmt.Errorf("encrypted store: key id %q is reserved for envelope encryption", envelopeKeyID)
+	}
+	if err := opts.Keyring.validateKeys(); err != nil {
+		return nil, fmt.Errorf("encrypted store: %w", err)
+	}
+	keys, err := opts.Keyring.modules()
+	if err != nil {
+		return nil, err
+	}
+	envelope := &envelopeCrypto{
+		km:   km,
+		keys: make(map[string]cipher.AEAD),
+	}
+	filenameKey, err := envelope.loadFilenameKey(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+	if keys[envelopeKeyID], err = newV4Crypto(filenameKey); err != nil {
+		return nil, fmt.Errorf("encrypted store: v4 crypto: %w", err)
+	}
+
+	es := newEncryptedStore(backend, envelopeKeyID, keys)
+	es.envelope = envelope
+	return es, nil
+}
+
+// The wrapped filename key is stored as:
+//
+//	magic (4) || master key id length (1) || master key id || wrapped key length (2) || wrapped key
+var envelopeMagic = []byte("LEK1")
+
+// envelopeCrypto encrypts every object with a new data key wrapped by a key
+// manager. Unwrapped data keys are cached, so reads rarely call the key manager.
+type envelopeCrypto struct {
+	km KeyManager
+
+	mu   sync.Mutex
+	keys map[string]cipher.AEAD // unwrapped data keys by header
+}
+
+type dataKey struct {
+	masterKeyID string
+	wrapped     []byte
+	aead        cipher.AEAD
+}
+
+// maxWrappedKeySize keeps envelope headers within the buffer of a bufio.Reader.
+const maxWrappedKeySize = 2048
+
+// maxCachedDataKeys bounds the number of unwrapped data keys kept in memory.
+const maxCachedDataKeys = 1024
+
+// dataKey generates and wraps a data key for a new object.
+func (ec *envelopeCrypto) dataKey(ctx context.Context) (*dataKey, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("encrypted store: could not generate data key: %w", err)
+	}
+	masterKeyID, wrapped, err := ec.km.WrapKey(ctx, key)
+	if err != nil {
+		return nil, NewErrorE(http.StatusServiceUnavailable, err).Msg("Could not wrap data key.")
+	}
+	if len(masterKeyID) > 255 || len(wrapped) > maxWrappedKeySize {
+		return nil, NewError(http.StatusInternalServerError).Msg("Wrapped data key is too large.")
+	}
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &dataKey{masterKeyID: masterKeyID, wrapped: wrapped, aead: aead}, nil
+}
+
+// unwrap returns the unwrapped data key, using the cache if possible.
+func (ec *envelopeCrypto) unwrap(ctx context.Context, masterKeyID string, wrapped []byte) (cipher.AEAD, error) {
+	header := string(appendEnvelopeHeader(nil, masterKeyID, wrapped))
+	ec.mu.Lock()
+	aead, ok := ec.keys[header]
+	ec.mu.Unlock()
+	if ok {
+		return aead, nil
+	}
+
+	key, err := ec.km.UnwrapKey(ctx, masterKeyID, wrapped)
+	if errors.Is(err, ErrUnknownKey) {
+		return nil, NewErrorE(http.StatusInternalServerError, err).Str("masterKeyID", masterKeyID).Msg("Could not unwrap data key.")
+	} else if err != nil {
+		return nil, NewErrorE(http.StatusServiceUnavailable, err).Str("masterKeyID", masterKeyID).Msg("Could not unwrap data key.")
+	}
+	if aead, err = newAESGCM(key); err != nil {
+		return nil, err
+	}
+	ec.mu.Lock()
+	if len(ec.keys) >= maxCachedDataKeys {
+		clear(ec.keys)
+	}
+	ec.keys[header] = aead
+	ec.mu.Unlock()
+	return aead, nil
+}
+
+// seal encrypts the data with a new data key and appends it to the header,
+// which records the wrapped data key.
+func (ec *envelopeCrypto) seal(ctx context.Context, hdr blobHeader, data, ad []byte) ([]byte, error) {
+	dk, err := ec.dataKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hdr.masterKeyID, hdr.wrapped = dk.masterKeyID, dk.wrapped
+	blob := appendBlobHeader(nil, hdr)
+	nonce := make([]byte, dk.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("encrypted store: could not generate nonce: %w", err)
+	}
+	blob = append(blob, nonce...)
+	return dk.aead.Seal(blob, nonce, data, ad), nil
+}
+
+// openEnvelopeData decrypts data encrypted with a data key.
+func openEnvelopeData(aead cipher.AEAD, data, ad []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("encrypted store: ciphertext too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], ad)
+}
+
+// loadFilenameKey unwraps the filename key stored in the backend, creating it if
+// the bucket has none yet.
+func (ec *envelopeCrypto) loadFilenameKey(ctx context.Context, backend LingioStore) ([]byte, error) {
+	for range 2 {
+		data, _, err := backend.GetObject(ctx, envelopeKeyObject)
+		if errors.Is(err, ErrObjectNotFound) {
+			key := make([]byte, 32)
+			if _, err := io.ReadFull(rand.Reader, key); err != nil {
+				return nil, fmt.Errorf("encrypted store: could not generate filename key: %w", err)
+			}
+			masterKeyID, wrapped, err := ec.km.WrapKey(ctx, key)
+			if err != nil {
+				return nil, fmt.Errorf("encrypted store: wrap filename key: %w", err)
+			}
+			_, err = backend.PutObjectWithOptions(ctx, envelopeKeyObject, appendEnvelopeHeader(nil, masterKeyID, wrapped), PutOptions{IfNoneMatch: true})
+			if errors.Is(err, ErrPreconditionFailed) {
+				continue // created concurrently
+			} else if err != nil {
+				return nil, fmt.Errorf("encrypted store: store filename key: %w", err)
+			}
+			return key, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("encrypted store: load filename key: %w", err)
+		}
+
+		masterKeyID, wrapped, _, ok := cutEnvelopeHeader(data)
+		if !ok {
+			return nil, errors.New("encrypted store: invalid filename key object")
+		}
+		key, err := ec.km.UnwrapKey(ctx, masterKeyID, wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("encrypted store: unwrap filename key: %w", err)
+		}
+		return key, nil
+	}
+	return nil, errors.New("encrypted store: could not create filename key")
+}
+
+// RewrapKeys rewraps the data keys of all envelope encrypted objects with the
+// current master key of the key manager, without re-encrypting any data. Objects
+// that are modified concurrently are left to the writer. Once it reports no
+// failures, previous master keys can be revoked. Objects that are encrypted with
+// a key of the keyring must be rewritten by RotateKeys first.
+func (es *EncryptedStore) RewrapKeys(ctx context.Context, opts RotateOptions) (result RotateResult, err error) {
+	ctx, span := tracer.Start(ctx, "encrypted_store.RewrapKeys")
+	defer span.End()
+	defer span.RecordError(err)
+
+	if es.envelope == nil {
+		return result, NewErrorE(http.StatusBadRequest, ErrNotSupported).Str("bucket", es.StoreName()).
+			Msg("Store does not use envelope encryption.")
+	}
+	masterKeyID, err := es.envelope.rewrapFilenameKey(ctx, es.backend)
+	if err != nil {
+		return result, err
+	}
+
+	result, err = es.rewriteObjects(ctx, opts, func(ctx context.Context, info ObjectInfo) (bool, error) {
+		return es.rewrapObject(ctx, info, masterKeyID)
+	})
+	zl.Info().Str("component", "EncryptedStore").Str("bucket", es.StoreName()).Str("masterKeyID", masterKeyID).
+		Int("scanned", result.Scanned).Int("rewrapped", result.Rotated).
+		Int("skipped", result.Skipped).Int("failed", result.Failed).
+		Msg("rewrapped data keys")
+	return result, err
+}
+
+// rewrapObject replaces the wrapped data key in the header of the object, unless
+// it is already wrapped with the master key.
+func (es *EncryptedStore) rewrapObject(ctx context.Context, info ObjectInfo, masterKeyID string) (bool, error) {
+	r, binfo, err := GetObjectReader(ctx, es.backend, info.Key)
+	if errors.Is(err, ErrObjectNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	br := bufio.NewReader(r)
+	hdr, n, err := es.peekBlobHeader(info.Key, br)
+	if err != nil {
+		return false, err
+	}
+	if hdr.keyID != envelopeKeyID || hdr.masterKeyID == masterKeyID {
+		return false, nil
+	}
+	if hdr.masterKeyID, hdr.wrapped, err = es.envelope.rewrap(ctx, hdr.masterKeyID, hdr.wrapped); err != nil {
+		return false, err
+	}
+	if _, err := br.Discard(n); err != nil {
+		return false, err
+	}
+	hdr.compression = Compression(hdr.contentEncoding(binfo))
+
+	header := appendBlobHeader(nil, hdr)
+	size := binfo.Size - int64(n) + int64(len(header))
+	_, err = PutObjectReader(ctx, es.backend, info.Key, io.MultiReader(bytes.NewReader(header), br), size, PutOptions{
+		IfMatch:     binfo.ETag,
+		ContentType: binfo.ContentType,
+		Metadata:    binfo.Metadata,
+		Tags:        binfo.Tags,
+	})
+	if errors.Is(err, ErrPreconditionFailed) || errors.Is(err, ErrObjectNotFound) {
+		return false, nil // written with a new data key, or removed
+	}
+	return err == nil, err
+}
+
+// rewrap wraps the data key with the current master key, and returns its ID.
+func (ec *envelopeCrypto) rewrap(ctx context.Context, masterKeyID string, wrapped []byte) (string, []byte, error) {
+	key, err := ec.km.UnwrapKey(ctx, masterKeyID, wrapped)
+	if err != nil {
+		return "", nil, fmt.Errorf("encrypted store: unwrap data key: %w", err)
+	}
+	masterKeyID, wrapped, err = ec.km.WrapKey(ctx, key)
+	if err != nil {
+		return "", nil, fmt.Errorf("encrypted store: wrap data key: %w", err)
+	}
+	if len(masterKeyID) > 255 || len(wrapped) > maxWrappedKeySize {
+		return "", nil, errors.New("encrypted store: wrapped data key is too large")
+	}
+	return masterKeyID, wrapped, nil
+}
+
+// rewrapFilenameKey rewraps the stored filename key with the current master key,
+// which it returns.
+func (ec *envelopeCrypto) rewrapFilenameKey(ctx context.Context, backend LingioStore) (string, error) {
+	data, info, err := backend.GetObject(ctx, envelopeKeyObject)
+	if err != nil {
+		return "", fmt.Errorf("encrypted store: load filename key: %w", err)
+	}
+	oldID, wrapped, _, ok := cutEnvelopeHeader(data)
+	if !ok {
+		return "", errors.New("encrypted store: invalid filename key object")
+	}
+	masterKeyID, wrapped, err := ec.rewrap(ctx, oldID, wrapped)
+	if err != nil {
+		return "", err
+	}
+	if masterKeyID == oldID {
+		return masterKeyID, nil
+	}
+	_, err = backend.PutObjectWithOptions(ctx, envelopeKeyObject, appendEnvelopeHeader(nil, masterKeyID, wrapped), PutOptions{IfMatch: info.ETag})
+	if err != nil && !errors.Is(err, ErrPreconditionFailed) {
+		return "", fmt.Errorf("encrypted store: store filename key: %w", err)
+	}
+	return masterKeyID, nil
+}
+
+func appendEnvelopeHeader(dst []byte, masterKeyID string, wrapped []byte) []byte {
+	dst = append(dst, envelopeMagic...)
+	dst = append(dst, byte(len(masterKeyID)))
+	dst = append(dst, masterKeyID...)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(wrapped)))
+	return append(dst, wrapped...)
+}
+
+// cutEnvelopeHeader returns the master key ID and wrapped data key of the
+// envelope header, and the data following it.
+func cutEnvelopeHeader(data []byte) (masterKeyID string, wrapped, rest []byte, ok bool) {
+	if len(data) < len(envelopeMagic)+1 || string(data[:len(envelopeMagic)]) != string(envelopeMagic) {
+		return "", nil, data, false
+	}
+	data = data[len(envelopeMagic):]
+	n := int(data[0])
+	if len(data) < 1+n+2 {
+		return "", nil, data, false
+	}
+	masterKeyID, data = string(data[1:1+n]), data[1+n:]
+	m := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+m {
+		return "", nil, data, false
+	}
+	return masterKeyID, data[2 : 2+m], data[2+m:], true
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
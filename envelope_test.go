@@ -0,0 +1,143 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func writeMasterKey(t *testing.T, name string) string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEnvelopeEncryptedStore(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryStore("test")
+	master1, master2 := writeMasterKey(t, "master1"), writeMasterKey(t, "master2")
+
+	legacy, err := NewEncryptedStore(backend, testKeyOld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := legacy.PutObject(ctx, "legacy", []byte("legacy")); err != nil {
+		t.Fatal(err)
+	}
+
+	km1, err := NewLocalKeyManager(master1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, err := NewEnvelopeEncryptedStore(ctx, backend, km1, EnvelopeOptions{Keyring: Keyring{Keys: map[string]string{"": testKeyOld}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := es.PutObject(ctx, "a", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := es.keys[envelopeKeyID].(v4Crypto); !ok || es.keyID != envelopeKeyID {
+		t.Errorf("expected filenames to be encrypted with v4 crypto but got %T", es.keys[envelopeKeyID])
+	}
+	stream := bytes.Repeat([]byte("lingio"), streamChunkSize)
+	if _, err := es.PutObjectReader(ctx, "stream", bytes.NewReader(stream), int64(len(stream)), PutOptions{ContentType: "text/plain"}); err != nil {
+		t.Fatal(err)
+	}
+	var wrapped [][]byte
+	for _, key := range []string{"a", "stream"} {
+		data, _, err := backend.GetObject(ctx, es.encryptFilename(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr, _, err := parseBlobHeader(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wrapped = append(wrapped, hdr.wrapped)
+	}
+	if bytes.Equal(wrapped[0], wrapped[1]) {
+		t.Error("expected every object to be encrypted with its own data key")
+	}
+	if keys := listKeys(t, es, ListOptions{}); !slices.Equal(slices.Sorted(slices.Values(keys)), []string{"a", "legacy", "stream"}) {
+		t.Errorf("expected envelope and legacy objects without the filename key but got %v", keys)
+	}
+	if data, _, err := es.GetObject(ctx, "legacy"); err != nil || string(data) != "legacy" {
+		t.Errorf("expected legacy object to be readable but got %q (%v)", data, err)
+	}
+	if _, _, err := legacy.GetObject(ctx, "a"); err == nil {
+		t.Error("expected envelope object to be unreadable by the legacy store")
+	}
+
+	result, err := es.RotateKeys(ctx, RotateOptions{})
+	if err != nil || result.Rotated != 1 || result.Failed != 0 {
+		t.Errorf("expected legacy object to be rotated but got %+v (%v)", result, err)
+	}
+
+	km2, err := NewLocalKeyManager(master2, master1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, err = NewEnvelopeEncryptedStore(ctx, backend, km2, EnvelopeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _, err := es.GetObject(ctx, "a"); err != nil || string(data) != "a" {
+		t.Errorf("expected filename key to be loaded from the bucket but got %q (%v)", data, err)
+	}
+	if result, err = es.RewrapKeys(ctx, RotateOptions{Concurrency: 1}); err != nil || result.Rotated != 3 || result.Failed != 0 {
+		t.Errorf("expected 3 data keys to be rewrapped but got %+v (%v)", result, err)
+	}
+	if result, err = es.RewrapKeys(ctx, RotateOptions{}); err != nil || result.Rotated != 0 {
+		t.Errorf("expected repeated rewrap to be a no-op but got %+v (%v)", result, err)
+	}
+
+	km3, err := NewLocalKeyManager(master2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, err = NewEnvelopeEncryptedStore(ctx, backend, km3, EnvelopeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"a": "a", "legacy": "legacy"} {
+		if data, _, err := es.GetObject(ctx, key); err != nil || string(data) != want {
+			t.Errorf("expected %q to be readable without the revoked master key but got %q (%v)", key, data, err)
+		}
+	}
+	r, info, err := es.GetObjectReader(ctx, "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if data, err := io.ReadAll(r); err != nil || !bytes.Equal(data, stream) || info.ContentType != "text/plain" {
+		t.Errorf("expected rewrapped stream with content type but got %d bytes of %s (%v)", len(data), info.ContentType, err)
+	}
+
+	bound, err := es.Bind(BindOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bound.PutObjectReader(ctx, "bound", bytes.NewReader(stream), int64(len(stream)), PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := readAllObject(t, es, "bound"); err != nil || !bytes.Equal(data, stream) {
+		t.Errorf("expected bound envelope stream to be readable but got %d bytes (%v)", len(data), err)
+	}
+
+	if _, err := NewEnvelopeEncryptedStore(ctx, backend, km1, EnvelopeOptions{}); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected revoked master key to be refused but got %v", err)
+	}
+}
@@ -229,6 +229,16 @@ func (e *Error) Is(target error) bool {
 	}
 }
 
+// errorStatus returns the status code of the first lingio error in the chain,
+// or 500 if there is none.
+func errorStatus(err error) int {
+	var lerr *Error
+	if errors.As(err, &lerr) {
+		return lerr.HttpStatusCode
+	}
+	return http.StatusInternalServerError
+}
+
 func getErrorTrace(skip int) string {
 	_, filename, line, ok := runtime.Caller(skip + 1)
 	if ok == false {
@@ -0,0 +1,465 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileMetaDir is the directory, relative to the bucket directory, holding the metadata sidecars.
+const fileMetaDir = ".meta"
+
+const (
+	// maxKeyLength is the maximum length of an S3 object key in bytes.
+	maxKeyLength = 1024
+	// maxKeySegmentLength is the longest path segment most filesystems allow,
+	// less the extension of the metadata sidecar.
+	maxKeySegmentLength = 255 - len(".json")
+)
+
+// FileStore implements the Lingio CRUD database interface on top of a local directory.
+// It is intended for local development: every bucket is a directory under the root,
+// every object a file, and ETag, content type and expiration are kept in JSON sidecar
+// files under <root>/<bucket>/.meta. Preconditions are only enforced within a process.
+//
+// Files without a sidecar, for example written by script/tofile, are listed and read
+// with an ETag computed from their content.
+//
+// Writes replace the sidecar before the file. A sidecar whose recorded size does
+// not match the file, e.g. after a crash between the two renames, is ignored.
+type FileStore struct {
+	dir        string
+	bucketName string
+	config     ObjectStoreConfig
+
+	mu        sync.Mutex
+	lifecycle time.Duration
+}
+
+// fileMeta is the sidecar content of a stored file.
+type fileMeta struct {
+	ETag            string            `json:"etag"`
+	ContentType     string            `json:"contentType,omitempty"`
+	ContentEncoding string            `json:"contentEncoding,omitempty"`
+	Size            int64             `json:"size"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	Tags            map[string]string `json:"tags,omitempty"`
+	LastModified    time.Time         `json:"lastModified"`
+	Expiration      time.Time         `json:"expiration,omitempty"`
+}
+
+// NewFileStore creates the bucket directory under root if it does not already exist.
+func NewFileStore(root, bucketName string, config ObjectStoreConfig) (*FileStore, error) {
+	dir := filepath.Join(root, bucketName)
+	if err := os.MkdirAll(filepath.Join(dir, fileMetaDir), 0755); err != nil {
+		return nil, NewErrorE(http.StatusInternalServerError, err).
+			Str("bucket", bucketName).Str("dir", dir).Msg("Could not create bucket directory.")
+	}
+	return &FileStore{
+		dir:        dir,
+		bucketName: bucketName,
+		config:     config,
+	}, nil
+}
+
+// SetLifecycle makes objects expire d after they were last written,
+// similar to a bucket lifecycle rule. Zero disables expiration.
+func (fs *FileStore) SetLifecycle(d time.Duration) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.lifecycle = d
+}
+
+// GetObject reads the file and its metadata.
+func (fs *FileStore) GetObject(ctx context.Context, file string) ([]byte, ObjectInfo, error) {
+	rc, info, err := fs.GetObjectReader(ctx, file)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, ObjectInfo{}, fs.fileError(err, file, "Could not read object data.")
+	}
+	return data, info, nil
+}
+
+// GetObjectReader opens the file for reading. The caller must close the returned reader.
+func (fs *FileStore) GetObjectReader(ctx context.Context, file string) (io.ReadCloser, ObjectInfo, error) {
+	path, err := fs.path(file)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	info, err := fs.stat(file)
+	if err != nil {
+		return nil, ObjectInfo{}, fs.fileError(err, file, "Could not get object stat info.")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, ObjectInfo{}, fs.fileError(err, file, "Could not get object")
+	}
+	return f, info, nil
+}
+
+// PutObject writes the file with the pre-configured content type.
+func (fs *FileStore) PutObject(ctx context.Context, file string, data []byte) (ObjectInfo, error) {
+	return fs.PutObjectWithOptions(ctx, file, data, PutOptions{})
+}
+
+// PutObjectWithOptions writes the file if the provided preconditions hold.
+func (fs *FileStore) PutObjectWithOptions(ctx context.Context, file string, data []byte, opts PutOptions) (ObjectInfo, error) {
+	return fs.PutObjectReader(ctx, file, bytes.NewReader(data), int64(len(data)), opts)
+}
+
+// PutObjectReader writes the file from r. The file is replaced atomically once r is fully read.
+func (fs *FileStore) PutObjectReader(ctx context.Context, file string, r io.Reader, size int64, opts PutOptions) (ObjectInfo, error) {
+	path, err := fs.path(file)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(fs.dir, fileMetaDir), ".upload-*")
+	if err != nil {
+		return ObjectInfo{}, fs.fileError(err, file, "Could not create temporary file.")
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := md5.New()
+	written, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return ObjectInfo{}, fs.fileError(err, file, "Could not write object data.")
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	current, err := fs.stat(file)
+	exists := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return ObjectInfo{}, fs.fileError(err, file, "Could not get object stat info.")
+	}
+	if opts.IfNoneMatch && exists {
+		return ObjectInfo{}, fs.preconditionFailed(file)
+	}
+	if opts.IfMatch != "" && (!exists || current.ETag != opts.IfMatch) {
+		return ObjectInfo{}, fs.preconditionFailed(file)
+	}
+
+	meta := fileMeta{
+		ETag:            hex.EncodeToString(hash.Sum(nil)),
+		ContentType:     fs.config.ContentType,
+		ContentEncoding: opts.ContentEncoding,
+		Size:            written,
+		Metadata:        canonicalMetadata(opts.Metadata),
+		Tags:            maps.Clone(nonEmpty(opts.Tags)),
+		LastModified:    time.Now().UTC(),
+	}
+	if opts.ContentType != "" {
+		meta.ContentType = opts.ContentType
+	} else if meta.ContentType == "" {
+		meta.ContentType = "application/json"
+	}
+	if fs.lifecycle > 0 {
+		meta.Expiration = meta.LastModified.Add(fs.lifecycle)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return ObjectInfo{}, fs.fileError(err, file, "Could not create object directory.")
+	}
+	// the sidecar goes first, so that the new file is never read with the metadata of the old one
+	previous, err := os.ReadFile(fs.metaPath(path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return ObjectInfo{}, fs.fileError(err, file, "Could not read object metadata.")
+	}
+	if err := fs.writeMeta(path, meta); err != nil {
+		return ObjectInfo{}, fs.fileError(err, file, "Could not write object metadata.")
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		if previous != nil {
+			err = errors.Join(err, fs.replaceFile(fs.metaPath(path), previous))
+		} else {
+			err = errors.Join(err, os.Remove(fs.metaPath(path)))
+		}
+		return ObjectInfo{}, fs.fileError(err, file, "Could not write object data.")
+	}
+	return meta.objectInfo(file), nil
+}
+
+// DeleteObject removes the file and its metadata.
+func (fs *FileStore) DeleteObject(ctx context.Context, file string) error {
+	return fs.DeleteObjectWithOptions(ctx, file, DeleteOptions{})
+}
+
+// DeleteObjectWithOptions removes the file if the provided preconditions hold.
+// Like S3, deleting a missing file is not an error.
+func (fs *FileStore) DeleteObjectWithOptions(ctx context.Context, file string, opts DeleteOptions) error {
+	path, err := fs.path(file)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if opts.IfMatch != "" {
+		info, err := fs.stat(file)
+		if err != nil {
+			return fs.fileError(err, file, "Could not get object stat info.")
+		}
+		if info.ETag != opts.IfMatch {
+			return fs.preconditionFailed(file)
+		}
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fs.fileError(err, file, "Could not remove object.")
+	}
+	if err := os.Remove(fs.metaPath(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fs.fileError(err, file, "Could not remove object metadata.")
+	}
+	return nil
+}
+
+// CopyObject copies the file and its metadata. The preconditions are checked
+// before the copy starts.
+func (fs *FileStore) CopyObject(ctx context.Context, src, dst string, opts CopyOptions) (ObjectInfo, error) {
+	rc, info, err := fs.GetObjectReader(ctx, src)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer rc.Close()
+	if opts.SourceETag != "" && info.ETag != opts.SourceETag {
+		return ObjectInfo{}, fs.preconditionFailed(src)
+	}
+	return fs.PutObjectReader(ctx, dst, rc, info.Size, PutOptions{
+		IfNoneMatch:     opts.IfNoneMatch,
+		ContentType:     info.ContentType,
+		ContentEncoding: info.ContentEncoding,
+		Metadata:        info.Metadata,
+		Tags:            info.Tags,
+	})
+}
+
+// MoveObject copies the file and its metadata and removes the source.
+func (fs *FileStore) MoveObject(ctx context.Context, src, dst string, opts CopyOptions) (ObjectInfo, error) {
+	return moveObject(ctx, fs, src, dst, opts)
+}
+
+// ListObjects lists all non-expired files in the bucket directory.
+func (fs *FileStore) ListObjects(ctx context.Context) <-chan ObjectInfo {
+	return withoutListingErrors(fs.ListObjectsWithOptions(ctx, ListOptions{}))
+}
+
+// ListObjectsWithOptions lists files in key order.
+func (fs *FileStore) ListObjectsWithOptions(ctx context.Context, opts ListOptions) <-chan ObjectInfo {
+	objects := make(chan ObjectInfo, 10)
+	go func() {
+		defer close(objects)
+		send := func(info ObjectInfo) bool {
+			select {
+			case objects <- info:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		var keys []string
+		err := filepath.WalkDir(fs.dir, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() && path == filepath.Join(fs.dir, fileMetaDir) {
+				return filepath.SkipDir
+			}
+			if d.Type().IsRegular() {
+				rel, err := filepath.Rel(fs.dir, path)
+				if err != nil {
+					return err
+				}
+				keys = append(keys, filepath.ToSlash(rel))
+			}
+			return nil
+		})
+		if err != nil {
+			send(ObjectInfo{Err: NewErrorE(http.StatusInternalServerError, err).
+				Str("bucket", fs.bucketName).Msg("Could not list objects.")})
+			return
+		}
+		sort.Strings(keys)
+
+		count := 0
+		for _, key := range keys {
+			if !strings.HasPrefix(key, opts.Prefix) || key <= opts.StartAfter {
+				continue
+			}
+			if opts.MaxKeys > 0 && count == opts.MaxKeys {
+				return
+			}
+			info, err := fs.stat(key)
+			if errors.Is(err, os.ErrNotExist) {
+				continue // removed or expired since the walk
+			} else if err != nil {
+				info = ObjectInfo{Err: fs.fileError(err, key, "Could not get object stat info.")}
+			}
+			if !send(info) || info.Err != nil {
+				return
+			}
+			count++
+		}
+	}()
+	return objects
+}
+
+// StoreName returns the bucket name.
+func (fs *FileStore) StoreName() string {
+	return fs.bucketName
+}
+
+// path returns the file path of the key, refusing keys that would escape the bucket
+// directory or that are too long to be stored as a file.
+func (fs *FileStore) path(file string) (string, error) {
+	local := filepath.FromSlash(file)
+	if !filepath.IsLocal(local) || strings.SplitN(file, "/", 2)[0] == fileMetaDir {
+		return "", NewErrorE(http.StatusBadRequest, os.ErrInvalid).
+			Str("bucket", fs.bucketName).Str("file", file).Msg("Invalid object key.")
+	}
+	if len(file) > maxKeyLength || slices.ContainsFunc(strings.Split(file, "/"), func(segment string) bool {
+		return len(segment) > maxKeySegmentLength
+	}) {
+		return "", NewErrorE(http.StatusBadRequest, os.ErrInvalid).
+			Str("bucket", fs.bucketName).Str("file", file).Msg("Object key is too long.")
+	}
+	return filepath.Join(fs.dir, local), nil
+}
+
+func (fs *FileStore) metaPath(path string) string {
+	rel, _ := filepath.Rel(fs.dir, path)
+	return filepath.Join(fs.dir, fileMetaDir, rel+".json")
+}
+
+// stat returns the object info of a file, falling back to a content hash if the
+// file has no metadata sidecar. Expired files are reported as not existing.
+func (fs *FileStore) stat(file string) (ObjectInfo, error) {
+	path, err := fs.path(file)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	var meta fileMeta
+	data, err := os.ReadFile(fs.metaPath(path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return ObjectInfo{}, err
+	} else if err == nil {
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return ObjectInfo{}, err
+		}
+	}
+	// a missing sidecar, or one of a write that did not complete, is replaced by the content hash
+	if err != nil || meta.Size != fi.Size() {
+		etag, err := fileETag(path)
+		if err != nil {
+			return ObjectInfo{}, err
+		}
+		meta = fileMeta{ETag: etag, Size: fi.Size(), LastModified: fi.ModTime().UTC()}
+	}
+
+	if !meta.Expiration.IsZero() && !time.Now().Before(meta.Expiration) {
+		return ObjectInfo{}, os.ErrNotExist
+	}
+	return meta.objectInfo(file), nil
+}
+
+// writeMeta replaces the sidecar of the file at path.
+func (fs *FileStore) writeMeta(path string, meta fileMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return fs.replaceFile(fs.metaPath(path), data)
+}
+
+// replaceFile atomically replaces the content of the file at path.
+func (fs *FileStore) replaceFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Join(fs.dir, fileMetaDir), ".meta-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// fileError is a helper function for wrapping file-op errors.
+func (fs *FileStore) fileError(err error, file, msg string) error {
+	var lerr *Error
+	if errors.As(err, &lerr) {
+		return err
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		lerr = NewErrorE(http.StatusNotFound, errors.Join(ErrObjectNotFound, err))
+	} else {
+		lerr = NewErrorE(http.StatusInternalServerError, err)
+	}
+	return lerr.Caller(1).Str("bucket", fs.bucketName).Str("file", file).Msg(msg)
+}
+
+func (fs *FileStore) preconditionFailed(file string) error {
+	return NewErrorE(http.StatusPreconditionFailed, ErrPreconditionFailed).Caller(1).
+		Str("bucket", fs.bucketName).Str("file", file).Msg("Object ETag does not match.")
+}
+
+func (meta fileMeta) objectInfo(file string) ObjectInfo {
+	return ObjectInfo{
+		Key:             file,
+		ETag:            meta.ETag,
+		Expiration:      meta.Expiration,
+		LastModified:    meta.LastModified,
+		ContentType:     meta.ContentType,
+		ContentEncoding: meta.ContentEncoding,
+		Size:            meta.Size,
+		Metadata:        meta.Metadata,
+		Tags:            meta.Tags,
+	}
+}
+
+func fileETag(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
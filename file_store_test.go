@@ -0,0 +1,66 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	fs, err := NewFileStore(root, "test", ObjectStoreConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := fs.PutObjectWithOptions(ctx, "a/1.json", []byte(`{}`), PutOptions{IfNoneMatch: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.PutObjectWithOptions(ctx, "a/1.json", []byte(`{}`), PutOptions{IfNoneMatch: true}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected ErrPreconditionFailed but got %v", err)
+	}
+	data, got, err := fs.GetObject(ctx, "a/1.json")
+	if err != nil || string(data) != `{}` || got.ETag != info.ETag {
+		t.Errorf("expected data %q with etag %s but got %q with etag %s (%v)", `{}`, info.ETag, data, got.ETag, err)
+	}
+
+	// files written without the store, e.g. by script/tofile, are readable too
+	if err := os.WriteFile(filepath.Join(root, "test", "a.json"), []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if keys := listKeys(t, fs, ListOptions{}); !reflect.DeepEqual(keys, []string{"a.json", "a/1.json"}) {
+		t.Errorf("expected keys [a.json a/1.json] but got %v", keys)
+	}
+	if _, got, err := fs.GetObject(ctx, "a.json"); err != nil || got.ETag != info.ETag {
+		t.Errorf("expected computed etag %s but got %s (%v)", info.ETag, got.ETag, err)
+	}
+
+	if err := fs.DeleteObject(ctx, "a/1.json"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fs.GetObject(ctx, "a/1.json"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expected ErrObjectNotFound but got %v", err)
+	}
+
+	// a sidecar of a write that did not complete is ignored
+	if err := fs.writeMeta(filepath.Join(root, "test", "a.json"), fileMeta{ETag: "new", Size: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if _, got, err := fs.GetObject(ctx, "a.json"); err != nil || got.ETag != info.ETag {
+		t.Errorf("expected computed etag %s but got %s (%v)", info.ETag, got.ETag, err)
+	}
+
+	for _, key := range []string{"../escape", ".meta/a.json.json", strings.Repeat("a", 251), strings.Repeat("a/", 513)} {
+		var lerr *Error
+		if _, err := fs.PutObject(ctx, key, nil); !errors.As(err, &lerr) || lerr.HttpStatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected bad request but got %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	zl "github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
+)
+
+// Keyring holds the keys of an EncryptedStore. Objects are written with the
+// primary key and can be read with any key in the keyring, so keys can be
+// rotated without downtime:
+//
+//  1. add the new key to the keyring of every instance,
+//  2. make the new key primary once all instances accept it,
+//  3. run EncryptedStore.RotateKeys to re-encrypt the remaining objects,
+//  4. remove the old key.
+//
+// The ID of the key is stored with every encrypted filename and object. Objects
+// written before key IDs were introduced belong to the key with the empty ID.
+//
+// Keys use v2 crypto unless Versions says otherwise. New keys should use v4
+// crypto, which encrypts filenames without reusing nonces.
+type Keyring struct {
+	// Primary is the ID of the key used for writes.
+	Primary string
+	// Keys maps key IDs to 32 char keys.
+	Keys map[string]string
+	// Versions maps key IDs to their crypto version, 2 or 4. Keys without a
+	// version use v2 crypto. Keys with v4 crypto must have an ID.
+	Versions map[string]int
+}
+
+// ErrUnknownKey is returned when an object was encrypted with a key that is not in the keyring.
+var ErrUnknownKey = errors.New("encrypted store: unknown key")
+
+// ParseKeyring parses a comma separated list of keys in the form "id:key", or
+// "v4:id:key" for keys with v4 crypto, e.g. from an environment variable. The
+// first key is the primary key. A key without an ID is the legacy key, so a
+// single 32 char key is a valid keyring. "v4" is not a valid key ID, so that
+// "v4:key" cannot be read as a v2 key with ID "v4".
+func ParseKeyring(s string) (Keyring, error) {
+	keyring := Keyring{Keys: make(map[string]string), Versions: make(map[string]int)}
+	for i, entry := range strings.Split(s, ",") {
+		version := 2
+		if rest, ok := strings.CutPrefix(entry, "v4:"); ok && len(entry) != 32 {
+			entry, version = rest, 4
+		}
+		id, key := "", entry
+		if len(entry) != 32 {
+			var ok bool
+			if id, key, ok = strings.Cut(entry, ":"); !ok {
+				return Keyring{}, fmt.Errorf("keyring: entry %d is neither a 32 char key nor an id:key pair", i+1)
+			}
+		}
+		if _, ok := keyring.Keys[id]; ok {
+			return Keyring{}, fmt.Errorf("keyring: duplicate key id %q", id)
+		}
+		if i == 0 {
+			keyring.Primary = id
+		}
+		keyring.Keys[id] = key
+		if version != 2 {
+			keyring.Versions[id] = version
+		}
+	}
+	return keyring, keyring.validate()
+}
+
+func (kr Keyring) validate() error {
+	if _, ok := kr.Keys[kr.Primary]; !ok {
+		return fmt.Errorf("keyring: primary key %q is missing", kr.Primary)
+	}
+	return kr.validateKeys()
+}
+
+func (kr Keyring) validateKeys() error {
+	for id, key := range kr.Keys {
+		if !validKeyID(id) {
+			return fmt.Errorf("keyring: key id %q must be at most 32 letters, digits, '-' or '_'", id)
+		}
+		if id == "v4" {
+			return errors.New("keyring: key id \"v4\" is reserved for the crypto version")
+		}
+		if len(key) != 32 {
+			return fmt.Errorf("keyring: key %q must be 32 chars", id)
+		}
+	}
+	for id, version := range kr.Versions {
+		if _, ok := kr.Keys[id]; !ok {
+			return fmt.Errorf("keyring: version of missing key %q", id)
+		}
+		if version != 2 && version != 4 {
+			return fmt.Errorf("keyring: key %q has unsupported crypto version %d", id, version)
+		}
+		// legacy filenames have no key id, so they must keep using v2 crypto
+		if version == 4 && id == "" {
+			return errors.New("keyring: keys with v4 crypto must have an id")
+		}
+	}
+	return nil
+}
+
+// modules returns the crypto of every key of the keyring.
+func (kr Keyring) modules() (map[string]cryptoModule, error) {
+	keys := make(map[string]cryptoModule, len(kr.Keys))
+	for id, key := range kr.Keys {
+		var (
+			cm  cryptoModule
+			err error
+		)
+		switch version := kr.Versions[id]; version {
+		case 0, 2:
+			cm, err = newV2Crypto([]byte(key))
+		case 4:
+			cm, err = newV4Crypto([]byte(key))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("encrypted store: crypto: key %q: %w", id, err)
+		}
+		keys[id] = cm
+	}
+	return keys, nil
+}
+
+func validKeyID(id string) bool {
+	if len(id) > 32 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Encrypted filenames are prefixed with "<key id>." unless they were encrypted
+// with the legacy key. Base32 never contains '.', so legacy filenames cannot be
+// mistaken for prefixed ones.
+func keyedFilename(keyID, encfile string) string {
+	if keyID == "" {
+		return encfile
+	}
+	return keyID + "." + encfile
+}
+
+func splitKeyedFilename(name string) (keyID, encfile string) {
+	if keyID, encfile, ok := strings.Cut(name, "."); ok {
+		return keyID, encfile
+	}
+	return "", name
+}
+
+func unknownKeyError(keyID string) *Error {
+	return NewErrorE(http.StatusInternalServerError, ErrUnknownKey).Caller(1).
+		Str("keyID", keyID).Msg("Object is encrypted with a key that is not in the keyring.")
+}
+
+// RotateOptions configures EncryptedStore.RotateKeys.
+type RotateOptions struct {
+	// Concurrency bounds the number of objects re-encrypted at once. Zero uses DefaultBatchConcurrency.
+	Concurrency int
+	// Progress is called with the running totals after each object is checked.
+	Progress func(RotateResult)
+}
+
+// RotateResult counts the objects checked by RotateKeys.
+type RotateResult struct {
+	// Scanned objects, including objects already encrypted with the primary key.
+	Scanned int
+	// Rotated objects were re-encrypted with the primary key.
+	Rotated int
+	// Skipped objects are encrypted with keys that are not in the keyring.
+	Skipped int
+	// Failed objects are logged and left as they are.
+	Failed int
+}
+
+// RotateKeys re-encrypts every object that is not encrypted with the primary key,
+// including its filename, and every v2 object if the store is bound (see Bind).
+// Objects that are modified concurrently are left to the writer. RotateKeys can
+// be stopped and repeated at any time; once it reports no failures, keys other
+// than the primary key can be removed from the keyring.
+func (es *EncryptedStore) RotateKeys(ctx context.Context, opts RotateOptions) (result RotateResult, err error) {
+	ctx, span := tracer.Start(ctx, "encrypted_store.RotateKeys")
+	defer span.End()
+	defer span.RecordError(err)
+
+	if _, err := streamAEAD(es.crypto); err != nil {
+		return result, err
+	}
+	result, err = es.rewriteObjects(ctx, opts, es.rotateObject)
+	zl.Info().Str("component", "EncryptedStore").Str("bucket", es.StoreName()).Str("keyID", es.keyID).
+		Int("scanned", result.Scanned).Int("rotated", result.Rotated).
+		Int("skipped", result.Skipped).Int("failed", result.Failed).
+		Msg("rotated keys")
+	return result, err
+}
+
+// rewriteObjects calls rewrite for every object of the backend and counts the results.
+func (es *EncryptedStore) rewriteObjects(ctx context.Context, opts RotateOptions, rewrite func(context.Context, ObjectInfo) (bool, error)) (result RotateResult, err error) {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultBatchConcurrency
+	}
+
+	var mu sync.Mutex
+	grp, gctx := errgroup.WithContext(ctx)
+	grp.SetLimit(concurrency)
+	for info := range es.backend.ListObjectsWithOptions(gctx, ListOptions{}) {
+		if info.Err != nil {
+			grp.Wait()
+			return result, info.Err
+		}
+		if info.Key == envelopeKeyObject {
+			continue
+		}
+		grp.Go(func() error {
+			rotated, err := rewrite(gctx, info)
+
+			mu.Lock()
+			defer mu.Unlock()
+			result.Scanned++
+			switch {
+			case errors.Is(err, ErrUnknownKey):
+				result.Skipped++
+			case err != nil:
+				result.Failed++
+				zl.Warn().Str("component", "EncryptedStore").Str("bucket", es.StoreName()).Str("file", info.Key).
+					Err(err).Msg("could not rotate object key")
+			case rotated:
+				result.Rotated++
+			}
+			if opts.Progress != nil {
+				opts.Progress(result)
+			}
+			return nil
+		})
+	}
+	grp.Wait()
+	return result, ctx.Err()
+}
+
+// rotateObject re-encrypts the object stored under the encrypted filename with
+// the primary key, unless both filename and data already use the primary key
+// and the object is bound if the store binds objects. Only the header of objects
+// under the primary filename key is read to tell, so repeated rotations are cheap.
+func (es *EncryptedStore) rotateObject(ctx context.Context, info ObjectInfo) (bool, error) {
+	keyID, _ := splitKeyedFilename(info.Key)
+	file, err := es.decryptFilename(info.Key)
+	if errors.Is(err, ErrUnknownKey) {
+		return false, err
+	} else if err != nil {
+		return false, Errorf(err, "Could not decrypt filename.")
+	}
+
+	r, binfo, err := GetObjectReader(ctx, es.backend, info.Key)
+	if errors.Is(err, ErrObjectNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	rotated := func(hdr blobHeader) bool {
+		return keyID == es.keyID && hdr.keyID == es.newBlobHeader("").keyID && (hdr.bound || !es.bound)
+	}
+	br := bufio.NewReader(r)
+	if hdr, _, err := es.peekBlobHeader(info.Key, br); err == nil && !hdr.maybeRaw && rotated(hdr) {
+		r.Close()
+		return false, nil
+	}
+	reader := *es
+	reader.bind.Require = false // v2 objects are rewritten
+	pr, size, hdr, err := reader.openBlob(ctx, file, info.Key, struct {
+		io.Reader
+		io.Closer
+	}{br, r}, binfo.Size)
+	if err != nil {
+		return false, err
+	}
+	defer pr.Close()
+	if rotated(hdr) {
+		return false, nil // a header that might have been ciphertext
+	}
+
+	_, err = es.PutObjectReader(ctx, file, pr, size, PutOptions{
+		IfMatch:         binfo.ETag,
+		ContentType:     binfo.ContentType,
+		ContentEncoding: hdr.contentEncoding(binfo),
+		Metadata:        binfo.Metadata,
+		Tags:            binfo.Tags,
+	})
+	if errors.Is(err, ErrPreconditionFailed) || errors.Is(err, ErrObjectNotFound) {
+		// The object was written or removed concurrently. A newer object under
+		// the primary key makes this one obsolete.
+		if keyID != es.keyID {
+			es.removeStale(ctx, "", []ObjectInfo{binfo})
+		}
+		return false, nil
+	}
+	return err == nil, err
+}
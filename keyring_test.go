@@ -0,0 +1,182 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+const (
+	testKeyOld = "0123456789abcdef0123456789abcdef"
+	testKeyNew = "fedcba9876543210fedcba9876543210"
+)
+
+func TestParseKeyring(t *testing.T) {
+	keyring, err := ParseKeyring("2027:" + testKeyNew + "," + testKeyOld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyring.Primary != "2027" || keyring.Keys["2027"] != testKeyNew || keyring.Keys[""] != testKeyOld {
+		t.Errorf("expected primary 2027 and legacy key but got %+v", keyring)
+	}
+	if keyring, err := ParseKeyring(testKeyOld); err != nil || keyring.Primary != "" || len(keyring.Keys) != 1 {
+		t.Errorf("expected single legacy key but got %+v (%v)", keyring, err)
+	}
+	for _, s := range []string{"", "a:short", "a.b:" + testKeyNew, "a:" + testKeyNew + ",a:" + testKeyOld} {
+		if _, err := ParseKeyring(s); err == nil {
+			t.Errorf("expected %q to be refused", s)
+		}
+	}
+}
+
+func TestEncryptedStoreKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryStore("test")
+	old, err := NewEncryptedStore(backend, testKeyOld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := old.PutObject(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream := bytes.Repeat([]byte("lingio"), streamChunkSize)
+	if _, err := old.PutObjectReader(ctx, "stream", bytes.NewReader(stream), int64(len(stream)), PutOptions{ContentType: "text/plain"}); err != nil {
+		t.Fatal(err)
+	}
+	_, binfo, err := old.GetObject(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	es, err := NewKeyringEncryptedStore(backend, Keyring{Primary: "2027", Keys: map[string]string{"": testKeyOld, "2027": testKeyNew}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _, err := es.GetObject(ctx, "a"); err != nil || string(data) != "a" {
+		t.Errorf("expected object written with old key to be readable but got %q (%v)", data, err)
+	}
+	if _, err := es.PutObject(ctx, "a", []byte("a2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := es.PutObjectWithOptions(ctx, "b", []byte("b2"), PutOptions{IfMatch: "stale"}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected stale etag of object under old key to fail but got %v", err)
+	}
+	if _, err := es.PutObjectWithOptions(ctx, "b", []byte("b2"), PutOptions{IfMatch: binfo.ETag}); err != nil {
+		t.Errorf("expected etag of object under old key to match but got %v", err)
+	}
+	if _, err := es.PutObjectWithOptions(ctx, "c", nil, PutOptions{IfNoneMatch: true}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected object under old key to exist but got %v", err)
+	}
+	// only the conditional write of b removes the object under the old key
+	if keys := backend.Keys(); len(keys) != 5 {
+		t.Errorf("expected a under both keys and b under the new key only but got %v", keys)
+	}
+	if keys := listKeys(t, es, ListOptions{}); len(keys) != 4 {
+		t.Errorf("expected 4 objects under both keys but got %v", keys)
+	}
+
+	var progress []RotateResult
+	result, err := es.RotateKeys(ctx, RotateOptions{Concurrency: 1, Progress: func(r RotateResult) { progress = append(progress, r) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rotated != 2 || result.Failed != 0 || len(progress) != result.Scanned {
+		t.Errorf("expected c and stream to be rotated but got %+v after %d progress reports", result, len(progress))
+	}
+	for _, key := range backend.Keys() {
+		if !strings.HasPrefix(key, "2027.") {
+			t.Errorf("expected all filenames to use the new key but got %q", key)
+		}
+	}
+
+	rotated, err := NewKeyringEncryptedStore(backend, Keyring{Primary: "2027", Keys: map[string]string{"2027": testKeyNew}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"a": "a2", "b": "b2", "c": "c"} {
+		if data, _, err := rotated.GetObject(ctx, key); err != nil || string(data) != want {
+			t.Errorf("expected %q to be readable with the new key only but got %q (%v)", key, data, err)
+		}
+	}
+	r, info, err := rotated.GetObjectReader(ctx, "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if data, err := io.ReadAll(r); err != nil || !bytes.Equal(data, stream) || info.ContentType != "text/plain" {
+		t.Errorf("expected rotated stream with content type but got %d bytes of %s (%v)", len(data), info.ContentType, err)
+	}
+
+	// objects of the primary key are recognized by their header, without decrypting them
+	data, _, err := backend.GetObject(ctx, es.encryptFilename("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.PutObject(ctx, es.encryptFilename("c"), flipBit(data, len(data)-1)); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := es.RotateKeys(ctx, RotateOptions{}); err != nil || result.Rotated != 0 || result.Failed != 0 {
+		t.Errorf("expected rotated objects to be skipped by their header but got %+v (%v)", result, err)
+	}
+}
+
+func TestEncryptedStoreListingAcrossRotation(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryStore("test")
+	old, err := NewEncryptedStore(backend, testKeyOld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := old.PutObject(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	page, err := ListObjectPage(ctx, old, ListOptions{MaxKeys: 1})
+	if err != nil || len(page) != 1 {
+		t.Fatalf("expected a page with one key but got %v (%v)", page, err)
+	}
+
+	es, err := NewKeyringEncryptedStore(backend, Keyring{Primary: "2027", Keys: map[string]string{"": testKeyOld, "2027": testKeyNew}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := es.PutObject(ctx, page[0].Key, []byte("rotated")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListObjectPage(ctx, es, ListOptions{MaxKeys: 1, StartAfter: page[0].Key}); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expected listing to be refused to continue while keys are rotated but got %v", err)
+	}
+	if keys := listKeys(t, es, ListOptions{}); len(keys) != 3 {
+		t.Errorf("expected every object to be listed once while keys are rotated but got %v", keys)
+	}
+
+	if _, err := es.RotateKeys(ctx, RotateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := NewKeyringEncryptedStore(backend, Keyring{Primary: "2027", Keys: map[string]string{"2027": testKeyNew}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	opts := ListOptions{MaxKeys: 1}
+	for {
+		page, err := ListObjectPage(ctx, rotated, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		keys = append(keys, page[0].Key)
+		opts.StartAfter = page[0].Key
+	}
+	if len(keys) != 3 {
+		t.Errorf("expected to page through 3 keys after the rotation but got %v", keys)
+	}
+}
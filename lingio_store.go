@@ -1,7 +1,13 @@
 package common
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -19,27 +25,244 @@ func (b *AtomicBool) SetFalse()   { atomic.StoreInt32((*int32)(b), 0) }
 type LingioStore interface {
 	GetObject(ctx context.Context, file string) ([]byte, ObjectInfo, error)
 	PutObject(ctx context.Context, file string, data []byte) (ObjectInfo, error)
+	PutObjectWithOptions(ctx context.Context, file string, data []byte, opts PutOptions) (ObjectInfo, error)
 	DeleteObject(ctx context.Context, file string) error
+	DeleteObjectWithOptions(ctx context.Context, file string, opts DeleteOptions) error
+	CopyObject(ctx context.Context, src, dst string, opts CopyOptions) (ObjectInfo, error)
+	MoveObject(ctx context.Context, src, dst string, opts CopyOptions) (ObjectInfo, error)
 	ListObjects(context.Context) <-chan ObjectInfo
+	ListObjectsWithOptions(context.Context, ListOptions) <-chan ObjectInfo
 	StoreName() string
 }
 
+// Operation names used by store wrappers for fault injection and instrumentation.
+const (
+	OpGetObject    = "GetObject"
+	OpPutObject    = "PutObject"
+	OpDeleteObject = "DeleteObject"
+	OpCopyObject   = "CopyObject"
+	OpListObjects  = "ListObjects"
+)
+
+// ErrNotSupported is returned when a store cannot perform the requested operation.
+var ErrNotSupported = errors.New("operation not supported by store")
+
+// VersionedStore is implemented by stores that keep previous versions of objects.
+type VersionedStore interface {
+	GetObjectVersion(ctx context.Context, file, versionID string) ([]byte, ObjectInfo, error)
+	ListObjectVersions(ctx context.Context, file string) ([]ObjectInfo, error)
+	RestoreObjectVersion(ctx context.Context, file, versionID string) (ObjectInfo, error)
+}
+
+func versionedBackend(backend LingioStore) (VersionedStore, error) {
+	vs, ok := backend.(VersionedStore)
+	if !ok {
+		return nil, NewErrorE(http.StatusNotImplemented, ErrNotSupported).
+			Str("store", backend.StoreName()).Msg("Backend does not support object versioning.")
+	}
+	return vs, nil
+}
+
+// StreamingStore is implemented by stores that can read and write objects
+// without buffering the whole object in memory.
+type StreamingStore interface {
+	// GetObjectReader opens the object for reading. The caller must close the reader.
+	GetObjectReader(ctx context.Context, file string) (io.ReadCloser, ObjectInfo, error)
+	// PutObjectReader uploads size bytes read from r. Use size -1 if the size is unknown.
+	PutObjectReader(ctx context.Context, file string, r io.Reader, size int64, opts PutOptions) (ObjectInfo, error)
+}
+
+// GetObjectReader opens the object for reading, falling back to a buffered read
+// if the store does not implement StreamingStore.
+func GetObjectReader(ctx context.Context, store LingioStore, file string) (io.ReadCloser, ObjectInfo, error) {
+	if ss, ok := store.(StreamingStore); ok {
+		return ss.GetObjectReader(ctx, file)
+	}
+	data, info, err := store.GetObject(ctx, file)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), info, nil
+}
+
+// PutObjectReader uploads the contents of r, falling back to a buffered write
+// if the store does not implement StreamingStore.
+func PutObjectReader(ctx context.Context, store LingioStore, file string, r io.Reader, size int64, opts PutOptions) (ObjectInfo, error) {
+	if ss, ok := store.(StreamingStore); ok {
+		return ss.PutObjectReader(ctx, file, r, size, opts)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return ObjectInfo{}, Errorf(err, "Could not read object data.")
+	}
+	return store.PutObjectWithOptions(ctx, file, data, opts)
+}
+
+// PutOptions describes optional conditions and metadata for a single object write.
+type PutOptions struct {
+	// IfMatch requires the stored object to have this ETag.
+	IfMatch string
+	// IfNoneMatch requires that no object is stored under the same key.
+	IfNoneMatch bool
+
+	// ContentType overrides the content type configured for the store.
+	ContentType string
+	// ContentEncoding is stored as-is, e.g. "gzip".
+	ContentEncoding string
+	// Metadata is stored as user metadata. Keys are returned in canonical
+	// MIME header form, e.g. "schema-version" is returned as "Schema-Version".
+	Metadata map[string]string
+	// Tags are stored as user-defined object tags.
+	Tags map[string]string
+}
+
+// DeleteOptions describes optional conditions for a single object delete.
+type DeleteOptions struct {
+	// IfMatch requires the stored object to have this ETag.
+	//
+	// ObjectStore sends the ETag as an If-Match header of the delete request, so
+	// the server must support conditional deletes. A NotImplemented answer is
+	// returned as ErrNotSupported.
+	IfMatch string
+	// VersionID permanently removes a specific version instead of the latest object.
+	VersionID string
+}
+
+// CopyOptions describes optional conditions for copying or moving an object.
+type CopyOptions struct {
+	// SourceETag requires the source object to have this ETag. When moving,
+	// it also makes sure that a concurrently updated source is not removed.
+	SourceETag string
+	// IfNoneMatch requires that no object is stored under the destination key.
+	IfNoneMatch bool
+}
+
+// ListOptions scopes and paginates an object listing.
+type ListOptions struct {
+	// Prefix only lists keys starting with this prefix.
+	Prefix string
+	// StartAfter only lists keys after this key. Use the last key of the
+	// previous page to continue a paginated listing.
+	StartAfter string
+	// MaxKeys limits the number of listed objects. Zero means no limit.
+	MaxKeys int
+	// WithMetadata includes content type, user metadata and tags in the listing.
+	// This is a MinIO extension and is ignored by other S3 providers.
+	WithMetadata bool
+	// Skipped is called with the key of every object that a store leaves out of
+	// the listing because it cannot be read, e.g. an EncryptedStore with an object
+	// whose filename cannot be decrypted. The key is the one of the store that
+	// skipped it. Skipped is called from the listing goroutine.
+	Skipped func(key string, err error)
+}
+
 // ObjectInfo
 type ObjectInfo struct {
-	Key        string
-	Expiration time.Time
-	ETag       string
+	Key          string
+	Expiration   time.Time
+	ETag         string
+	Size         int64
+	LastModified time.Time
+
+	ContentType     string
+	ContentEncoding string
+	// Metadata holds the user metadata with keys in canonical MIME header form.
+	Metadata map[string]string
+	Tags     map[string]string
+
+	// Versioning related information, only set by versioned buckets.
+	VersionID      string
+	IsLatest       bool
+	IsDeleteMarker bool
+
+	// Err is set on the last listed object if the listing failed.
+	Err error `json:"-"`
 }
 
 func objectInfoFromMinio(info minio.ObjectInfo) ObjectInfo {
-	// TODO: Add support for these as well?
-	// info.Err
-	// info.VersionID
-	// info.IsLatest
-	// info.LastModified
-	return ObjectInfo{
-		ETag:       info.ETag,
-		Expiration: info.Expiration,
-		Key:        info.Key,
+	oi := ObjectInfo{
+		ETag:            info.ETag,
+		Expiration:      info.Expiration,
+		Key:             info.Key,
+		Size:            info.Size,
+		LastModified:    info.LastModified,
+		ContentType:     info.ContentType,
+		ContentEncoding: info.Metadata.Get("Content-Encoding"),
+		Tags:            nonEmpty(info.UserTags),
+		VersionID:       info.VersionID,
+		IsLatest:        info.IsLatest,
+		IsDeleteMarker:  info.IsDeleteMarker,
+	}
+	// Stat has already stripped the X-Amz-Meta- prefix, but listings with
+	// metadata return the raw headers including content type and encoding.
+	for k, v := range info.UserMetadata {
+		k = textproto.CanonicalMIMEHeaderKey(k)
+		switch {
+		case k == "Content-Type":
+			if oi.ContentType == "" {
+				oi.ContentType = v
+			}
+		case k == "Content-Encoding":
+			oi.ContentEncoding = v
+		case strings.HasPrefix(k, "X-Amz-Meta-"):
+			oi.setMetadata(strings.TrimPrefix(k, "X-Amz-Meta-"), v)
+		case strings.HasPrefix(k, "X-Amz-") || strings.HasPrefix(k, "X-Minio-"):
+		default:
+			oi.setMetadata(k, v)
+		}
+	}
+	return oi
+}
+
+func (oi *ObjectInfo) setMetadata(k, v string) {
+	if oi.Metadata == nil {
+		oi.Metadata = make(map[string]string)
+	}
+	oi.Metadata[textproto.CanonicalMIMEHeaderKey(k)] = v
+}
+
+// canonicalMetadata returns a copy of the user metadata with keys in canonical MIME header form.
+func canonicalMetadata(metadata map[string]string) map[string]string {
+	var oi ObjectInfo
+	for k, v := range metadata {
+		oi.setMetadata(k, v)
+	}
+	return oi.Metadata
+}
+
+func nonEmpty(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+// withoutListingErrors drops failed entries from an object listing.
+func withoutListingErrors(listing <-chan ObjectInfo) <-chan ObjectInfo {
+	objects := make(chan ObjectInfo, 10)
+	go func() {
+		defer close(objects)
+		for info := range listing {
+			if info.Err == nil {
+				objects <- info
+			}
+		}
+	}()
+	return objects
+}
+
+// ListObjectPage collects one page of an object listing. The next page starts
+// after the key of the last returned object. An empty page ends the listing.
+func ListObjectPage(ctx context.Context, store LingioStore, opts ListOptions) ([]ObjectInfo, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var page []ObjectInfo
+	for info := range store.ListObjectsWithOptions(ctx, opts) {
+		if info.Err != nil {
+			return nil, info.Err
+		}
+		page = append(page, info)
 	}
+	return page, nil
 }
@@ -0,0 +1,38 @@
+package common
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func TestObjectInfoFromMinio(t *testing.T) {
+	// listings with metadata return raw headers
+	listed := objectInfoFromMinio(minio.ObjectInfo{
+		UserMetadata: map[string]string{
+			"content-type":                 "application/json",
+			"Content-Encoding":             "gzip",
+			"X-Amz-Meta-Partner-Id":        "p1",
+			"X-Amz-Server-Side-Encryption": "AES256",
+		},
+	})
+	// stat strips the user metadata prefix
+	stat := objectInfoFromMinio(minio.ObjectInfo{
+		ContentType:  "application/json",
+		Metadata:     http.Header{"Content-Encoding": []string{"gzip"}},
+		UserMetadata: map[string]string{"partner-id": "p1"},
+	})
+
+	expected := ObjectInfo{
+		ContentType:     "application/json",
+		ContentEncoding: "gzip",
+		Metadata:        map[string]string{"Partner-Id": "p1"},
+	}
+	for name, info := range map[string]ObjectInfo{"listed": listed, "stat": stat} {
+		if !reflect.DeepEqual(info, expected) {
+			t.Errorf("%s: expected %+v but got %+v", name, expected, info)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package common
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"maps"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an in-process LingioStore intended for tests. It mimics the
+// ETag, precondition and lifecycle expiration semantics of ObjectStore and
+// supports injecting latency, errors and partial listings. It implements
+// NotifyingStore for changes made through the store.
+type MemoryStore struct {
+	name string
+
+	mu        sync.Mutex
+	objects   map[string]memoryObject
+	faults    []*Fault
+	lifecycle time.Duration
+	now       func() time.Time
+	listeners map[*memoryListener]struct{}
+}
+
+type memoryObject struct {
+	data []byte
+	info ObjectInfo
+}
+
+// Fault describes latency or an error injected into MemoryStore operations.
+type Fault struct {
+	// Op is the operation to fail, e.g. OpGetObject. Empty matches all operations.
+	Op string
+	// Key only matches operations on this key. Empty matches all keys.
+	Key string
+	// Latency delays the operation. The delay is cut short if the context is done.
+	Latency time.Duration
+	// Err is returned instead of performing the operation. Listings deliver
+	// Err after After objects. A listing fault without Err and Latency
+	// silently ends the listing after After objects.
+	Err error
+	// After lets the first After matching operations (or listed objects) succeed.
+	After int
+	// Times limits how many times the fault is triggered. Zero means no limit.
+	Times int
+
+	seen, triggered int
+}
+
+// NewMemoryStore returns an empty in-memory store with the provided store name.
+func NewMemoryStore(name string) *MemoryStore {
+	return &MemoryStore{
+		name:    name,
+		objects: make(map[string]memoryObject),
+		now:     time.Now,
+	}
+}
+
+// SetLifecycle makes objects expire d after they were last written,
+// similar to a bucket lifecycle rule. Zero disables expiration.
+func (ms *MemoryStore) SetLifecycle(d time.Duration) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.lifecycle = d
+}
+
+// SetClock replaces the clock used for LastModified and expiration.
+func (ms *MemoryStore) SetClock(now func() time.Time) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.now = now
+}
+
+// InjectFault adds a fault. Faults are matched in the order they were added.
+func (ms *MemoryStore) InjectFault(f Fault) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.faults = append(ms.faults, &f)
+}
+
+// ClearFaults removes all injected faults.
+func (ms *MemoryStore) ClearFaults() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.faults = nil
+}
+
+// Keys returns the keys of all stored objects in sorted order.
+func (ms *MemoryStore) Keys() []string {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.sortedKeys()
+}
+
+func (ms *MemoryStore) GetObject(ctx context.Context, file string) ([]byte, ObjectInfo, error) {
+	if err := ms.faultErr(ctx, OpGetObject, file); err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	obj, ok := ms.lookup(file)
+	if !ok {
+		return nil, ObjectInfo{}, ms.notFound(file)
+	}
+	return append([]byte{}, obj.data...), obj.info.clone(), nil
+}
+
+func (ms *MemoryStore) PutObject(ctx context.Context, file string, data []byte) (ObjectInfo, error) {
+	return ms.PutObjectWithOptions(ctx, file, data, PutOptions{})
+}
+
+func (ms *MemoryStore) PutObjectWithOptions(ctx context.Context, file string, data []byte, opts PutOptions) (ObjectInfo, error) {
+	if err := ms.faultErr(ctx, OpPutObject, file); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	obj, exists := ms.lookup(file)
+	if opts.IfNoneMatch && exists {
+		return ObjectInfo{}, ms.preconditionFailed(file)
+	}
+	if opts.IfMatch != "" && (!exists || obj.info.ETag != opts.IfMatch) {
+		return ObjectInfo{}, ms.preconditionFailed(file)
+	}
+
+	sum := md5.Sum(data)
+	info := ObjectInfo{
+		Key:             file,
+		ETag:            hex.EncodeToString(sum[:]),
+		Size:            int64(len(data)),
+		LastModified:    ms.now().UTC(),
+		ContentType:     opts.ContentType,
+		ContentEncoding: opts.ContentEncoding,
+		Metadata:        canonicalMetadata(opts.Metadata),
+		Tags:            maps.Clone(nonEmpty(opts.Tags)),
+	}
+	if ms.lifecycle > 0 {
+		info.Expiration = info.LastModified.Add(ms.lifecycle)
+	}
+	ms.objects[file] = memoryObject{
+		data: append([]byte{}, data...),
+		info: info,
+	}
+	ms.notify(ObjectEvent{Type: ObjectCreated, Key: file, ETag: info.ETag})
+	return info.clone(), nil
+}
+
+func (ms *MemoryStore) DeleteObject(ctx context.Context, file string) error {
+	return ms.DeleteObjectWithOptions(ctx, file, DeleteOptions{})
+}
+
+// DeleteObjectWithOptions removes the object. Like S3, deleting a missing object is not an error.
+func (ms *MemoryStore) DeleteObjectWithOptions(ctx context.Context, file string, opts DeleteOptions) error {
+	if err := ms.faultErr(ctx, OpDeleteObject, file); err != nil {
+		return err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if opts.IfMatch != "" {
+		obj, ok := ms.lookup(file)
+		if !ok {
+			return ms.notFound(file)
+		}
+		if obj.info.ETag != opts.IfMatch {
+			return ms.preconditionFailed(file)
+		}
+	}
+	if _, ok := ms.lookup(file); ok {
+		delete(ms.objects, file)
+		ms.notify(ObjectEvent{Type: ObjectRemoved, Key: file})
+	}
+	return nil
+}
+
+func (ms *MemoryStore) CopyObject(ctx context.Context, src, dst string, opts CopyOptions) (ObjectInfo, error) {
+	return ms.copyObject(ctx, src, dst, opts, false)
+}
+
+// MoveObject copies the object and removes the source in one atomic step.
+func (ms *MemoryStore) MoveObject(ctx context.Context, src, dst string, opts CopyOptions) (ObjectInfo, error) {
+	return ms.copyObject(ctx, src, dst, opts, true)
+}
+
+func (ms *MemoryStore) copyObject(ctx context.Context, src, dst string, opts CopyOptions, move bool) (ObjectInfo, error) {
+	if err := ms.faultErr(ctx, OpCopyObject, src); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	obj, ok := ms.lookup(src)
+	if !ok {
+		return ObjectInfo{}, ms.notFound(src)
+	}
+	if opts.SourceETag != "" && obj.info.ETag != opts.SourceETag {
+		return ObjectInfo{}, ms.preconditionFailed(src)
+	}
+	if _, exists := ms.lookup(dst); opts.IfNoneMatch && exists {
+		return ObjectInfo{}, ms.preconditionFailed(dst)
+	}
+
+	info := obj.info.clone()
+	info.Key = dst
+	info.LastModified = ms.now().UTC()
+	if ms.lifecycle > 0 {
+		info.Expiration = info.LastModified.Add(ms.lifecycle)
+	}
+	ms.objects[dst] = memoryObject{data: obj.data, info: info}
+	ms.notify(ObjectEvent{Type: ObjectCreated, Key: dst, ETag: info.ETag})
+	if move && src != dst {
+		delete(ms.objects, src)
+		ms.notify(ObjectEvent{Type: ObjectRemoved, Key: src})
+	}
+	return info.clone(), nil
+}
+
+func (ms *MemoryStore) ListObjects(ctx context.Context) <-chan ObjectInfo {
+	return withoutListingErrors(ms.ListObjectsWithOptions(ctx, ListOptions{}))
+}
+
+// ListObjectsWithOptions lists a snapshot of the stored objects in key order.
+func (ms *MemoryStore) ListObjectsWithOptions(ctx context.Context, opts ListOptions) <-chan ObjectInfo {
+	ms.mu.Lock()
+	var infos []ObjectInfo
+	for _, key := range ms.sortedKeys() {
+		if !strings.HasPrefix(key, opts.Prefix) || key <= opts.StartAfter {
+			continue
+		}
+		if opts.MaxKeys > 0 && len(infos) == opts.MaxKeys {
+			break
+		}
+		if obj, ok := ms.lookup(key); ok {
+			infos = append(infos, obj.info.clone())
+		}
+	}
+	ms.mu.Unlock()
+
+	objects := make(chan ObjectInfo, 10)
+	go func() {
+		defer close(objects)
+		for _, info := range infos {
+			if f, err := ms.fault(ctx, OpListObjects, info.Key); err != nil {
+				info = ObjectInfo{Err: err}
+			} else if f != nil && f.Err != nil {
+				info = ObjectInfo{Err: f.Err}
+			} else if f != nil && f.Latency == 0 {
+				return // partial listing
+			}
+			select {
+			case objects <- info:
+			case <-ctx.Done():
+				return
+			}
+			if info.Err != nil {
+				return
+			}
+		}
+	}()
+	return objects
+}
+
+// ListenObjectEvents reports puts, copies and deletes of objects with the key
+// prefix. Events are queued, so slow consumers do not block the store.
+func (ms *MemoryStore) ListenObjectEvents(ctx context.Context, prefix string) <-chan ObjectEvent {
+	l := &memoryListener{prefix: prefix, wake: make(chan struct{}, 1)}
+	ms.mu.Lock()
+	if ms.listeners == nil {
+		ms.listeners = make(map[*memoryListener]struct{})
+	}
+	ms.listeners[l] = struct{}{}
+	ms.mu.Unlock()
+
+	events := make(chan ObjectEvent)
+	go func() {
+		defer close(events)
+		defer func() {
+			ms.mu.Lock()
+			delete(ms.listeners, l)
+			ms.mu.Unlock()
+		}()
+		for {
+			select {
+			case <-l.wake:
+			case <-ctx.Done():
+				return
+			}
+			for _, event := range l.drain() {
+				if !sendObjectEvent(ctx, events, event) {
+					return
+				}
+			}
+		}
+	}()
+	return events
+}
+
+func (ms *MemoryStore) StoreName() string {
+	return ms.name
+}
+
+// lookup returns a live object and lazily removes expired objects.
+func (ms *MemoryStore) lookup(file string) (memoryObject, bool) {
+	obj, ok := ms.objects[file]
+	if ok && !obj.info.Expiration.IsZero() && !ms.now().Before(obj.info.Expiration) {
+		delete(ms.objects, file)
+		return memoryObject{}, false
+	}
+	return obj, ok
+}
+
+func (ms *MemoryStore) sortedKeys() []string {
+	keys := make([]string, 0, len(ms.objects))
+	for key := range ms.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// fault applies the latency of the first matching fault and returns the fault.
+func (ms *MemoryStore) fault(ctx context.Context, op, file string) (*Fault, error) {
+	ms.mu.Lock()
+	var match *Fault
+	for _, f := range ms.faults {
+		if (f.Op != "" && f.Op != op) || (f.Key != "" && f.Key != file) {
+			continue
+		}
+		if f.Times > 0 && f.triggered >= f.Times {
+			continue
+		}
+		if f.seen++; f.seen <= f.After {
+			continue
+		}
+		f.triggered++
+		match = f
+		break
+	}
+	ms.mu.Unlock()
+
+	if match != nil && match.Latency > 0 {
+		select {
+		case <-time.After(match.Latency):
+		case <-ctx.Done():
+			return nil, NewErrorE(http.StatusServiceUnavailable, ctx.Err()).Msg("Operation cancelled.")
+		}
+	}
+	return match, nil
+}
+
+// faultErr returns the injected error for the operation, if any.
+func (ms *MemoryStore) faultErr(ctx context.Context, op, file string) error {
+	f, err := ms.fault(ctx, op, file)
+	if err != nil {
+		return err
+	} else if f != nil {
+		return f.Err
+	}
+	return nil
+}
+
+// notify queues the event for matching listeners. Must be called with ms.mu held.
+func (ms *MemoryStore) notify(event ObjectEvent) {
+	for l := range ms.listeners {
+		if !strings.HasPrefix(event.Key, l.prefix) {
+			continue
+		}
+		l.mu.Lock()
+		l.queue = append(l.queue, event)
+		l.mu.Unlock()
+		select {
+		case l.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+type memoryListener struct {
+	prefix string
+	wake   chan struct{}
+
+	mu    sync.Mutex
+	queue []ObjectEvent
+}
+
+func (l *memoryListener) drain() []ObjectEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	queue := l.queue
+	l.queue = nil
+	return queue
+}
+
+// clone copies the metadata and tag maps, so that callers cannot modify the
+// stored object through the returned info.
+func (info ObjectInfo) clone() ObjectInfo {
+	info.Metadata = maps.Clone(info.Metadata)
+	info.Tags = maps.Clone(info.Tags)
+	return info
+}
+
+func (ms *MemoryStore) notFound(file string) error {
+	return NewErrorE(http.StatusNotFound, ErrObjectNotFound).Caller(1).
+		Str("bucket", ms.name).Str("file", file).Msg("Could not get object")
+}
+
+func (ms *MemoryStore) preconditionFailed(file string) error {
+	return NewErrorE(http.StatusPreconditionFailed, ErrPreconditionFailed).Caller(1).
+		Str("bucket", ms.name).Str("file", file).Msg("Object ETag does not match.")
+}
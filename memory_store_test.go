@@ -0,0 +1,176 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMemoryStorePreconditions(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore("test")
+
+	info, err := ms.PutObjectWithOptions(ctx, "a", []byte("1"), PutOptions{IfNoneMatch: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.PutObjectWithOptions(ctx, "a", []byte("2"), PutOptions{IfNoneMatch: true}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected ErrPreconditionFailed for existing object but got %v", err)
+	}
+	if _, err := ms.PutObjectWithOptions(ctx, "a", []byte("2"), PutOptions{IfMatch: "stale"}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected ErrPreconditionFailed for stale etag but got %v", err)
+	}
+	if _, err := ms.PutObjectWithOptions(ctx, "a", []byte("2"), PutOptions{IfMatch: info.ETag}); err != nil {
+		t.Errorf("expected put with current etag to succeed but got %v", err)
+	}
+	if err := ms.DeleteObjectWithOptions(ctx, "a", DeleteOptions{IfMatch: info.ETag}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected ErrPreconditionFailed for delete with stale etag but got %v", err)
+	}
+
+	data, _, err := ms.GetObject(ctx, "a")
+	if err != nil || string(data) != "2" {
+		t.Errorf("expected data %q but got %q (%v)", "2", data, err)
+	}
+}
+
+func TestMemoryStoreExpiration(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ms := NewMemoryStore("test")
+	ms.SetClock(func() time.Time { return now })
+	ms.SetLifecycle(time.Hour)
+
+	info, err := ms.PutObject(ctx, "a", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Expiration.Equal(now.Add(time.Hour)) {
+		t.Errorf("expected expiration %v but got %v", now.Add(time.Hour), info.Expiration)
+	}
+
+	now = now.Add(time.Hour)
+	if _, _, err := ms.GetObject(ctx, "a"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expected ErrObjectNotFound for expired object but got %v", err)
+	}
+}
+
+func TestMemoryStoreFaults(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore("test")
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if _, err := ms.PutObject(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	failure := errors.New("injected")
+	ms.InjectFault(Fault{Op: OpGetObject, Key: "b", Err: failure, After: 1, Times: 1})
+	for i, expected := range []error{nil, failure, nil} {
+		if _, _, err := ms.GetObject(ctx, "b"); err != expected {
+			t.Errorf("get %d: expected %v but got %v", i, expected, err)
+		}
+	}
+
+	ms.InjectFault(Fault{Op: OpListObjects, After: 2})
+	if keys := listKeys(t, ms, ListOptions{}); len(keys) != 2 {
+		t.Errorf("expected partial listing of 2 keys but got %v", keys)
+	}
+
+	ms.ClearFaults()
+	ms.InjectFault(Fault{Op: OpListObjects, Err: failure, After: 3})
+	var listErr error
+	for info := range ms.ListObjectsWithOptions(ctx, ListOptions{}) {
+		listErr = info.Err
+	}
+	if listErr != failure {
+		t.Errorf("expected listing error %v but got %v", failure, listErr)
+	}
+}
+
+func TestMemoryStoreListing(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore("test")
+	for _, key := range []string{"x/1", "x/2", "x/3", "y/1"} {
+		if _, err := ms.PutObject(ctx, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page, err := ListObjectPage(ctx, ms, ListOptions{Prefix: "x/", StartAfter: "x/1", MaxKeys: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].Key != "x/2" {
+		t.Errorf("expected page [x/2] but got %v", page)
+	}
+
+	for _, tc := range []struct {
+		opts     ListOptions
+		expected []string
+	}{
+		{ListOptions{Prefix: "x/", MaxKeys: 3}, []string{"x/1", "x/2", "x/3"}},
+		{ListOptions{Prefix: "x/", StartAfter: "x/2", MaxKeys: 3}, []string{"x/3"}},
+		{ListOptions{Prefix: "x/", StartAfter: "x/3", MaxKeys: 3}, nil},
+		{ListOptions{StartAfter: "x/3"}, []string{"y/1"}},
+		{ListOptions{StartAfter: "x"}, []string{"x/1", "x/2", "x/3", "y/1"}},
+		{ListOptions{Prefix: "z/"}, nil},
+	} {
+		page, err := ListObjectPage(ctx, ms, tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, info := range page {
+			keys = append(keys, info.Key)
+		}
+		if !slices.Equal(keys, tc.expected) {
+			t.Errorf("%+v: expected page %v but got %v", tc.opts, tc.expected, keys)
+		}
+	}
+}
+
+func listKeys(t *testing.T, store LingioStore, opts ListOptions) []string {
+	t.Helper()
+	var keys []string
+	for info := range store.ListObjectsWithOptions(context.Background(), opts) {
+		if info.Err != nil {
+			t.Fatal(info.Err)
+		}
+		keys = append(keys, info.Key)
+	}
+	return keys
+}
+
+func TestMemoryStoreInfoIsCopied(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore("test")
+
+	tags := map[string]string{"owner": "a"}
+	info, err := ms.PutObjectWithOptions(ctx, "a", []byte("1"), PutOptions{
+		Metadata: map[string]string{"version": "1"},
+		Tags:     tags,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags["owner"] = "b"
+	info.Metadata["Version"] = "2"
+	_, got, err := ms.GetObject(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.Tags["owner"] = "c"
+	for info := range ms.ListObjects(ctx) {
+		info.Metadata["Version"] = "3"
+	}
+
+	_, got, err = ms.GetObject(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Tags["owner"] != "a" || got.Metadata["Version"] != "1" {
+		t.Errorf("expected the stored info to be unaffected by callers but got %v and %v", got.Tags, got.Metadata)
+	}
+}
@@ -0,0 +1,260 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Store metrics are registered on the default prometheus registry, which is
+// served at /metrics by NewEchoServerWithConfig.
+var (
+	storeOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "lingio",
+		Subsystem: "store",
+		Name:      "operations_total",
+		Help:      "Number of store operations by bucket, operation and status code.",
+	}, []string{"bucket", "op", "code"})
+	storeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "lingio",
+		Subsystem: "store",
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of store operations by bucket and operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12), // 5ms to ~10s
+	}, []string{"bucket", "op"})
+	storeBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "lingio",
+		Subsystem: "store",
+		Name:      "bytes_total",
+		Help:      "Object data read from (out) and written to (in) the store by bucket.",
+	}, []string{"bucket", "direction"})
+
+	registerStoreMetrics sync.Once
+)
+
+// MeteredStore records prometheus metrics for every operation of the backend:
+// operation counts by status code, latency histograms and bytes in and out,
+// labelled by bucket and operation. Wrap the raw object store to measure the
+// latency of the bucket itself.
+type MeteredStore struct {
+	backend LingioStore
+	bucket  string
+}
+
+// NewMeteredStore initializes a lingio store that records metrics for the backend.
+// The metrics are registered on prometheus.DefaultRegisterer on first use.
+func NewMeteredStore(backend LingioStore) *MeteredStore {
+	registerStoreMetrics.Do(func() {
+		for _, c := range []prometheus.Collector{storeOperations, storeDuration, storeBytes} {
+			if err := prometheus.DefaultRegisterer.Register(c); err != nil {
+				var are prometheus.AlreadyRegisteredError
+				if !errors.As(err, &are) {
+					panic(err)
+				}
+			}
+		}
+	})
+	return &MeteredStore{
+		backend: backend,
+		bucket:  backend.StoreName(),
+	}
+}
+
+func (ms *MeteredStore) GetObject(ctx context.Context, file string) ([]byte, ObjectInfo, error) {
+	defer ms.observe(OpGetObject, time.Now())
+	data, info, err := ms.backend.GetObject(ctx, file)
+	ms.count(OpGetObject, err)
+	ms.bytes("out", len(data))
+	return data, info, err
+}
+
+func (ms *MeteredStore) PutObject(ctx context.Context, file string, data []byte) (ObjectInfo, error) {
+	return ms.PutObjectWithOptions(ctx, file, data, PutOptions{})
+}
+
+func (ms *MeteredStore) PutObjectWithOptions(ctx context.Context, file string, data []byte, opts PutOptions) (ObjectInfo, error) {
+	defer ms.observe(OpPutObject, time.Now())
+	info, err := ms.backend.PutObjectWithOptions(ctx, file, data, opts)
+	ms.count(OpPutObject, err)
+	if err == nil {
+		ms.bytes("in", len(data))
+	}
+	return info, err
+}
+
+// GetObjectReader opens the file for reading. The latency covers opening the
+// object, bytes are counted as they are read.
+func (ms *MeteredStore) GetObjectReader(ctx context.Context, file string) (io.ReadCloser, ObjectInfo, error) {
+	defer ms.observe(OpGetObject, time.Now())
+	r, info, err := GetObjectReader(ctx, ms.backend, file)
+	ms.count(OpGetObject, err)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return meteredReadCloser{r, storeBytes.WithLabelValues(ms.bucket, "out")}, info, nil
+}
+
+func (ms *MeteredStore) PutObjectReader(ctx context.Context, file string, r io.Reader, size int64, opts PutOptions) (ObjectInfo, error) {
+	defer ms.observe(OpPutObject, time.Now())
+	info, err := PutObjectReader(ctx, ms.backend, file, meteredReadCloser{io.NopCloser(r), storeBytes.WithLabelValues(ms.bucket, "in")}, size, opts)
+	ms.count(OpPutObject, err)
+	return info, err
+}
+
+func (ms *MeteredStore) DeleteObject(ctx context.Context, file string) error {
+	return ms.DeleteObjectWithOptions(ctx, file, DeleteOptions{})
+}
+
+func (ms *MeteredStore) DeleteObjectWithOptions(ctx context.Context, file string, opts DeleteOptions) error {
+	defer ms.observe(OpDeleteObject, time.Now())
+	err := ms.backend.DeleteObjectWithOptions(ctx, file, opts)
+	ms.count(OpDeleteObject, err)
+	return err
+}
+
+func (ms *MeteredStore) CopyObject(ctx context.Context, src, dst string, opts CopyOptions) (ObjectInfo, error) {
+	defer ms.observe(OpCopyObject, time.Now())
+	info, err := ms.backend.CopyObject(ctx, src, dst, opts)
+	ms.count(OpCopyObject, err)
+	return info, err
+}
+
+func (ms *MeteredStore) MoveObject(ctx context.Context, src, dst string, opts CopyOptions) (ObjectInfo, error) {
+	defer ms.observe(OpCopyObject, time.Now())
+	info, err := ms.backend.MoveObject(ctx, src, dst, opts)
+	ms.count(OpCopyObject, err)
+	return info, err
+}
+
+// DeleteObjects removes the files, in bulk if the backend implements BatchDeleter.
+// Each file is counted as one delete operation.
+func (ms *MeteredStore) DeleteObjects(ctx context.Context, files []string) []BatchResult {
+	defer ms.observe(OpDeleteObject, time.Now())
+	results := DeleteObjects(ctx, ms.backend, files, DefaultBatchConcurrency)
+	for _, res := range results {
+		ms.count(OpDeleteObject, res.Err)
+	}
+	return results
+}
+
+func (ms *MeteredStore) ListObjects(ctx context.Context) <-chan ObjectInfo {
+	return withoutListingErrors(ms.ListObjectsWithOptions(ctx, ListOptions{}))
+}
+
+// ListObjectsWithOptions lists the backend. The latency covers the whole listing,
+// until the channel is closed.
+func (ms *MeteredStore) ListObjectsWithOptions(ctx context.Context, opts ListOptions) <-chan ObjectInfo {
+	start := time.Now()
+	listing := ms.backend.ListObjectsWithOptions(ctx, opts)
+	objects := make(chan ObjectInfo, 10)
+	go func() {
+		defer close(objects)
+		defer ms.observe(OpListObjects, start)
+		var err error
+		for info := range listing {
+			if info.Err != nil {
+				err = info.Err
+			}
+			select {
+			case objects <- info:
+			case <-ctx.Done():
+				ms.count(OpListObjects, ctx.Err())
+				return
+			}
+		}
+		ms.count(OpListObjects, err)
+	}()
+	return objects
+}
+
+func (ms *MeteredStore) GetObjectVersion(ctx context.Context, file, versionID string) ([]byte, ObjectInfo, error) {
+	vs, err := versionedBackend(ms.backend)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	defer ms.observe(OpGetObject, time.Now())
+	data, info, err := vs.GetObjectVersion(ctx, file, versionID)
+	ms.count(OpGetObject, err)
+	ms.bytes("out", len(data))
+	return data, info, err
+}
+
+func (ms *MeteredStore) ListObjectVersions(ctx context.Context, file string) ([]ObjectInfo, error) {
+	vs, err := versionedBackend(ms.backend)
+	if err != nil {
+		return nil, err
+	}
+	defer ms.observe(OpListObjects, time.Now())
+	versions, err := vs.ListObjectVersions(ctx, file)
+	ms.count(OpListObjects, err)
+	return versions, err
+}
+
+func (ms *MeteredStore) RestoreObjectVersion(ctx context.Context, file, versionID string) (ObjectInfo, error) {
+	vs, err := versionedBackend(ms.backend)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer ms.observe(OpCopyObject, time.Now())
+	info, err := vs.RestoreObjectVersion(ctx, file, versionID)
+	ms.count(OpCopyObject, err)
+	return info, err
+}
+
+// PresignGetObject is passed to the backend without metrics, since the transfer bypasses the store.
+func (ms *MeteredStore) PresignGetObject(ctx context.Context, file string, opts PresignOptions) (PresignedRequest, error) {
+	return PresignGetObject(ctx, ms.backend, file, opts)
+}
+
+// PresignPutObject is passed to the backend without metrics, since the transfer bypasses the store.
+func (ms *MeteredStore) PresignPutObject(ctx context.Context, file string, opts PresignOptions) (PresignedRequest, error) {
+	return PresignPutObject(ctx, ms.backend, file, opts)
+}
+
+func (ms *MeteredStore) ListenObjectEvents(ctx context.Context, prefix string) <-chan ObjectEvent {
+	events, err := ListenObjectEvents(ctx, ms.backend, prefix)
+	if err != nil {
+		return failedObjectEvents(err)
+	}
+	return events
+}
+
+func (ms *MeteredStore) StoreName() string {
+	return ms.backend.StoreName()
+}
+
+func (ms *MeteredStore) observe(op string, start time.Time) {
+	storeDuration.WithLabelValues(ms.bucket, op).Observe(time.Since(start).Seconds())
+}
+
+// count records the operation with the status code of err, e.g. "200" or "404".
+func (ms *MeteredStore) count(op string, err error) {
+	code := 200
+	if err != nil {
+		code = errorStatus(err)
+	}
+	storeOperations.WithLabelValues(ms.bucket, op, strconv.Itoa(code)).Inc()
+}
+
+func (ms *MeteredStore) bytes(direction string, n int) {
+	if n > 0 {
+		storeBytes.WithLabelValues(ms.bucket, direction).Add(float64(n))
+	}
+}
+
+// meteredReadCloser counts the bytes read.
+type meteredReadCloser struct {
+	io.ReadCloser
+	bytes prometheus.Counter
+}
+
+func (r meteredReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytes.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,54 @@
+package common
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMeteredStore(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMeteredStore(NewMemoryStore("metered-test"))
+
+	if _, err := ms.PutObject(ctx, "a", []byte("12345")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ms.GetObject(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ms.GetObject(ctx, "missing"); err == nil {
+		t.Fatal("expected missing object to fail")
+	}
+	r, _, err := ms.GetObjectReader(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, r)
+	r.Close()
+	for range ms.ListObjects(ctx) {
+	}
+
+	counts := map[[2]string]float64{
+		{OpPutObject, "200"}:   1,
+		{OpGetObject, "200"}:   2,
+		{OpGetObject, "404"}:   1,
+		{OpListObjects, "200"}: 1,
+	}
+	for labels, want := range counts {
+		got := testutil.ToFloat64(storeOperations.WithLabelValues("metered-test", labels[0], labels[1]))
+		if got != want {
+			t.Errorf("expected %v %s operations with code %s but got %v", want, labels[0], labels[1], got)
+		}
+	}
+	if got := testutil.ToFloat64(storeBytes.WithLabelValues("metered-test", "in")); got != 5 {
+		t.Errorf("expected 5 bytes in but got %v", got)
+	}
+	if got := testutil.ToFloat64(storeBytes.WithLabelValues("metered-test", "out")); got != 10 {
+		t.Errorf("expected 10 bytes out but got %v", got)
+	}
+	if n := testutil.CollectAndCount(storeDuration); n == 0 {
+		t.Error("expected latency to be recorded")
+	}
+}
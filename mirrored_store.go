@@ -0,0 +1,467 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"time"
+
+	zl "github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// MirroredStore writes to a primary and a secondary backend and reads from the
+// primary, for moving a bucket between providers without downtime. The primary
+// is authoritative: its result is returned and its preconditions are applied.
+// Failed secondary writes are logged as divergence and repaired by Reconcile.
+// Copies in the secondary record the ETag of the primary object in their user
+// metadata, so Reconcile can tell stale copies apart without comparing clocks.
+//
+// Mirror the raw object stores below an EncryptedStore, so that both buckets
+// hold the same encrypted keys:
+//
+//	mirror := NewMirroredStore(oldStore, newStore, MirrorOptions{ReadFallback: true})
+//	store, err := NewEncryptedStore(mirror, serviceKey)
+type MirroredStore struct {
+	primary, secondary LingioStore
+	opts               MirrorOptions
+}
+
+// MirrorOptions configures a MirroredStore.
+type MirrorOptions struct {
+	// ReadFallback reads from the secondary if the primary fails with a server
+	// error. Objects missing in the primary are not read from the secondary,
+	// since a failed secondary delete would otherwise bring them back.
+	ReadFallback bool
+	// RequireSecondary fails writes if the secondary write fails, after the
+	// primary write has succeeded. By default such failures are only logged.
+	RequireSecondary bool
+}
+
+// ReconcileOptions configures MirroredStore.Reconcile.
+type ReconcileOptions struct {
+	// Prefix limits reconciliation to objects with the key prefix.
+	Prefix string
+	// DeleteExtra removes objects from the secondary that are not in the primary.
+	DeleteExtra bool
+	// DryRun only counts the differences.
+	DryRun bool
+	// Concurrency is the number of concurrent copies. Defaults to DefaultBatchConcurrency.
+	Concurrency int
+}
+
+// ReconcileResult counts the differences found by MirroredStore.Reconcile.
+type ReconcileResult struct {
+	// Missing objects were in the primary but not in the secondary.
+	Missing int
+	// Stale objects differ in size or were not copied from the current primary object.
+	Stale int
+	// Extra objects were only in the secondary.
+	Extra int
+	// Failed counts repairs that failed. The keys are logged.
+	Failed int
+}
+
+// mirrorETagKey is the user metadata key holding the primary ETag of a secondary copy.
+const mirrorETagKey = "Mirror-Source-Etag"
+
+// NewMirroredStore initializes a lingio store that mirrors writes to secondary.
+func NewMirroredStore(primary, secondary LingioStore, opts MirrorOptions) *MirroredStore {
+	return &MirroredStore{
+		primary:   primary,
+		secondary: secondary,
+		opts:      opts,
+	}
+}
+
+// GetObject reads from the primary, falling back to the secondary if configured.
+func (ms *MirroredStore) GetObject(ctx context.Context, file string) (_ []byte, _ ObjectInfo, err error) {
+	ctx, span := tracer.Start(ctx, "mirrored_store.GetObject", trace.WithAttributes(
+		attribute.String("file", file),
+	))
+	defer span.End()
+	defer span.RecordError(err)
+
+	data, info, err := ms.primary.GetObject(ctx, file)
+	if !ms.fallback(err) {
+		return data, info, err
+	}
+
+	data, info, serr := ms.secondary.GetObject(ctx, file)
+	if serr != nil {
+		return nil, ObjectInfo{}, err
+	}
+	ms.diverged(OpGetObject, file, err, "object read from secondary")
+	return data, info, nil
+}
+
+// GetObjectReader opens the object in the primary, falling back to the secondary if configured.
+func (ms *MirroredStore) GetObjectReader(ctx context.Context, file string) (io.ReadCloser, ObjectInfo, error) {
+	r, info, err := GetObjectReader(ctx, ms.primary, file)
+	if !ms.fallback(err) {
+		return r, info, err
+	}
+
+	r, info, serr := GetObjectReader(ctx, ms.secondary, file)
+	if serr != nil {
+		return nil, ObjectInfo{}, err
+	}
+	ms.diverged(OpGetObject, file, err, "object read from secondary")
+	return r, info, nil
+}
+
+func (ms *MirroredStore) PutObject(ctx context.Context, file string, data []byte) (ObjectInfo, error) {
+	return ms.PutObjectWithOptions(ctx, file, data, PutOptions{})
+}
+
+// PutObjectWithOptions writes to the primary with the preconditions in opts,
+// and then to the secondary without preconditions, since ETags differ between providers.
+func (ms *MirroredStore) PutObjectWithOptions(ctx context.Context, file string, data []byte, opts PutOptions) (info ObjectInfo, err error) {
+	ctx, span := tracer.Start(ctx, "mirrored_store.PutObject", trace.WithAttributes(
+		attribute.String("file", file),
+	))
+	defer span.End()
+	defer span.RecordError(err)
+
+	info, err = ms.primary.PutObjectWithOptions(ctx, file, data, opts)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if _, err := ms.secondary.PutObjectWithOptions(ctx, file, data, mirrorPutOptions(opts, info.ETag)); err != nil {
+		return info, ms.secondaryFailed(OpPutObject, file, err)
+	}
+	return info, nil
+}
+
+// PutObjectReader streams the object to the primary and then copies it from the
+// primary to the secondary, since r can only be read once.
+func (ms *MirroredStore) PutObjectReader(ctx context.Context, file string, r io.Reader, size int64, opts PutOptions) (info ObjectInfo, err error) {
+	ctx, span := tracer.Start(ctx, "mirrored_store.PutObjectReader", trace.WithAttributes(
+		attribute.String("file", file),
+	))
+	defer span.End()
+	defer span.RecordError(err)
+
+	info, err = PutObjectReader(ctx, ms.primary, file, r, size, opts)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if _, err := ms.mirrorObject(ctx, file); err != nil {
+		return info, ms.secondaryFailed(OpPutObject, file, err)
+	}
+	return info, nil
+}
+
+func (ms *MirroredStore) DeleteObject(ctx context.Context, file string) error {
+	return ms.DeleteObjectWithOptions(ctx, file, DeleteOptions{})
+}
+
+// DeleteObjectWithOptions deletes from the primary if the preconditions hold, and then from the secondary.
+func (ms *MirroredStore) DeleteObjectWithOptions(ctx context.Context, file string, opts DeleteOptions) (err error) {
+	ctx, span := tracer.Start(ctx, "mirrored_store.DeleteObject", trace.WithAttributes(
+		attribute.String("file", file),
+	))
+	defer span.End()
+	defer span.RecordError(err)
+
+	if err := ms.primary.DeleteObjectWithOptions(ctx, file, opts); err != nil {
+		return err
+	}
+	if err := ms.secondary.DeleteObject(ctx, file); err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return ms.secondaryFailed(OpDeleteObject, file, err)
+	}
+	return nil
+}
+
+// CopyObject copies within the primary and then within the secondary.
+// opts.SourceETag only applies to the primary.
+func (ms *MirroredStore) CopyObject(ctx context.Context, src, dst string, opts CopyOptions) (info ObjectInfo, err error) {
+	ctx, span := tracer.Start(ctx, "mirrored_store.CopyObject", trace.WithAttributes(
+		attribute.String("src", src),
+		attribute.String("dst", dst),
+	))
+	defer span.End()
+	defer span.RecordError(err)
+
+	info, err = ms.primary.CopyObject(ctx, src, dst, opts)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	_, err = ms.secondary.CopyObject(ctx, src, dst, CopyOptions{})
+	return info, ms.mirrorCopy(ctx, dst, err)
+}
+
+// MoveObject moves within the primary and then within the secondary.
+func (ms *MirroredStore) MoveObject(ctx context.Context, src, dst string, opts CopyOptions) (info ObjectInfo, err error) {
+	ctx, span := tracer.Start(ctx, "mirrored_store.MoveObject", trace.WithAttributes(
+		attribute.String("src", src),
+		attribute.String("dst", dst),
+	))
+	defer span.End()
+	defer span.RecordError(err)
+
+	info, err = ms.primary.MoveObject(ctx, src, dst, opts)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	_, err = ms.secondary.MoveObject(ctx, src, dst, CopyOptions{})
+	return info, ms.mirrorCopy(ctx, dst, err)
+}
+
+// DeleteObjects removes the files from both backends. The results are those of the
+// primary, secondary failures are logged.
+func (ms *MirroredStore) DeleteObjects(ctx context.Context, files []string) []BatchResult {
+	results := DeleteObjects(ctx, ms.primary, files, DefaultBatchConcurrency)
+	var deleted []string
+	for _, res := range results {
+		if res.Err == nil {
+			deleted = append(deleted, res.Key)
+		}
+	}
+	for _, res := range DeleteObjects(ctx, ms.secondary, deleted, DefaultBatchConcurrency) {
+		if res.Err != nil && !errors.Is(res.Err, ErrObjectNotFound) {
+			ms.diverged(OpDeleteObject, res.Key, res.Err, "secondary write failed")
+		}
+	}
+	return results
+}
+
+// ListObjects lists the primary.
+func (ms *MirroredStore) ListObjects(ctx context.Context) <-chan ObjectInfo {
+	return ms.primary.ListObjects(ctx)
+}
+
+// ListObjectsWithOptions lists the primary.
+func (ms *MirroredStore) ListObjectsWithOptions(ctx context.Context, opts ListOptions) <-chan ObjectInfo {
+	return ms.primary.ListObjectsWithOptions(ctx, opts)
+}
+
+// GetObjectVersion reads a version from the primary. Versions are not mirrored.
+func (ms *MirroredStore) GetObjectVersion(ctx context.Context, file, versionID string) ([]byte, ObjectInfo, error) {
+	vs, err := versionedBackend(ms.primary)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return vs.GetObjectVersion(ctx, file, versionID)
+}
+
+// ListObjectVersions lists the versions in the primary.
+func (ms *MirroredStore) ListObjectVersions(ctx context.Context, file string) ([]ObjectInfo, error) {
+	vs, err := versionedBackend(ms.primary)
+	if err != nil {
+		return nil, err
+	}
+	return vs.ListObjectVersions(ctx, file)
+}
+
+// RestoreObjectVersion restores the version in the primary and copies the restored
+// object to the secondary.
+func (ms *MirroredStore) RestoreObjectVersion(ctx context.Context, file, versionID string) (ObjectInfo, error) {
+	vs, err := versionedBackend(ms.primary)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := vs.RestoreObjectVersion(ctx, file, versionID)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if _, err := ms.mirrorObject(ctx, file); err != nil {
+		return info, ms.secondaryFailed(OpCopyObject, file, err)
+	}
+	return info, nil
+}
+
+// PresignGetObject presigns a download from the primary.
+func (ms *MirroredStore) PresignGetObject(ctx context.Context, file string, opts PresignOptions) (PresignedRequest, error) {
+	return PresignGetObject(ctx, ms.primary, file, opts)
+}
+
+// PresignPutObject presigns an upload to the primary. The upload bypasses the
+// mirror, so the object only reaches the secondary with the next Reconcile.
+func (ms *MirroredStore) PresignPutObject(ctx context.Context, file string, opts PresignOptions) (PresignedRequest, error) {
+	return PresignPutObject(ctx, ms.primary, file, opts)
+}
+
+// ListenObjectEvents listens for changes in the primary.
+func (ms *MirroredStore) ListenObjectEvents(ctx context.Context, prefix string) <-chan ObjectEvent {
+	events, err := ListenObjectEvents(ctx, ms.primary, prefix)
+	if err != nil {
+		return failedObjectEvents(err)
+	}
+	return events
+}
+
+func (ms *MirroredStore) StoreName() string {
+	return ms.primary.StoreName()
+}
+
+// Reconcile lists both backends and copies objects that are missing or stale in
+// the secondary from the primary. A copy is stale if its size differs or it does
+// not record the ETag of the primary object, e.g. because it was written before the
+// mirror or a later secondary write failed. Objects only in the secondary are
+// removed if opts.DeleteExtra is set.
+func (ms *MirroredStore) Reconcile(ctx context.Context, opts ReconcileOptions) (result ReconcileResult, err error) {
+	ctx, span := tracer.Start(ctx, "mirrored_store.Reconcile")
+	defer span.End()
+	defer span.RecordError(err)
+
+	primary, err := listAll(ctx, ms.primary, ListOptions{Prefix: opts.Prefix})
+	if err != nil {
+		return result, err
+	}
+	secondary, err := listAll(ctx, ms.secondary, ListOptions{Prefix: opts.Prefix, WithMetadata: true})
+	if err != nil {
+		return result, err
+	}
+
+	var copies, deletes []string
+	for key, info := range primary {
+		if sinfo, ok := secondary[key]; !ok {
+			result.Missing++
+			copies = append(copies, key)
+		} else if info.Size != sinfo.Size || ms.sourceETag(ctx, sinfo) != info.ETag {
+			result.Stale++
+			copies = append(copies, key)
+		}
+	}
+	for key := range secondary {
+		if _, ok := primary[key]; !ok {
+			result.Extra++
+			deletes = append(deletes, key)
+		}
+	}
+	if opts.DryRun {
+		return result, nil
+	}
+
+	copied := forEach(ctx, copies, opts.Concurrency, func(i int) BatchResult {
+		info, err := ms.mirrorObject(ctx, copies[i])
+		return BatchResult{Key: copies[i], Info: info, Err: err}
+	})
+	var deleted []BatchResult
+	if opts.DeleteExtra {
+		deleted = DeleteObjects(ctx, ms.secondary, deletes, opts.Concurrency)
+	}
+	for _, res := range append(copied, deleted...) {
+		if res.Err != nil && !errors.Is(res.Err, ErrObjectNotFound) {
+			result.Failed++
+			ms.diverged("Reconcile", res.Key, res.Err, "could not reconcile object")
+		}
+	}
+	return result, ctx.Err()
+}
+
+// RunReconciler calls Reconcile every interval until ctx is done. Run it in a
+// single job rather than in every replica of a service, see script/reconcile.
+func (ms *MirroredStore) RunReconciler(ctx context.Context, interval time.Duration, opts ReconcileOptions) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		result, err := ms.Reconcile(ctx, opts)
+		if err != nil && ctx.Err() == nil {
+			zl.Warn().Str("component", "MirroredStore").Str("bucket", ms.StoreName()).Err(err).Msg("reconciliation failed")
+		} else if result != (ReconcileResult{}) {
+			zl.Info().Str("component", "MirroredStore").Str("bucket", ms.StoreName()).
+				Int("missing", result.Missing).Int("stale", result.Stale).
+				Int("extra", result.Extra).Int("failed", result.Failed).
+				Msg("reconciled mirror")
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// mirrorCopy handles the result of a copy within the secondary. If the source was
+// missing in the secondary, the destination is copied over from the primary instead.
+func (ms *MirroredStore) mirrorCopy(ctx context.Context, dst string, err error) error {
+	if errors.Is(err, ErrObjectNotFound) {
+		ms.diverged(OpCopyObject, dst, err, "copy source missing in secondary")
+		_, err = ms.mirrorObject(ctx, dst)
+	}
+	if err != nil {
+		return ms.secondaryFailed(OpCopyObject, dst, err)
+	}
+	return nil
+}
+
+// mirrorObject copies the file from the primary to the secondary and records the primary ETag.
+func (ms *MirroredStore) mirrorObject(ctx context.Context, file string) (ObjectInfo, error) {
+	r, info, err := GetObjectReader(ctx, ms.primary, file)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer r.Close()
+	return PutObjectReader(ctx, ms.secondary, file, r, info.Size, mirrorPutOptions(PutOptions{
+		ContentType:     info.ContentType,
+		ContentEncoding: info.ContentEncoding,
+		Metadata:        info.Metadata,
+		Tags:            info.Tags,
+	}, info.ETag))
+}
+
+// mirrorPutOptions returns the options for writing the copy of a primary object with the etag
+// to the secondary. Preconditions only apply to the primary, since ETags differ between providers.
+func mirrorPutOptions(opts PutOptions, etag string) PutOptions {
+	opts.IfMatch, opts.IfNoneMatch = "", false
+	opts.Metadata = maps.Clone(opts.Metadata)
+	if opts.Metadata == nil {
+		opts.Metadata = make(map[string]string)
+	}
+	opts.Metadata[mirrorETagKey] = etag
+	return opts
+}
+
+// sourceETag returns the primary ETag recorded on a secondary copy. Some providers
+// do not list user metadata, so it is read from the object if the listing lacks it.
+func (ms *MirroredStore) sourceETag(ctx context.Context, info ObjectInfo) string {
+	if etag, ok := info.Metadata[mirrorETagKey]; ok {
+		return etag
+	}
+	r, info, err := GetObjectReader(ctx, ms.secondary, info.Key)
+	if err != nil {
+		return ""
+	}
+	r.Close()
+	return info.Metadata[mirrorETagKey]
+}
+
+// fallback reports whether a failed primary read should be retried on the secondary.
+func (ms *MirroredStore) fallback(err error) bool {
+	return err != nil && ms.opts.ReadFallback && errorStatus(err) >= http.StatusInternalServerError
+}
+
+// secondaryFailed logs a failed secondary write and returns an error if the secondary is required.
+func (ms *MirroredStore) secondaryFailed(op, file string, err error) error {
+	ms.diverged(op, file, err, "secondary write failed")
+	if !ms.opts.RequireSecondary {
+		return nil
+	}
+	return NewErrorE(errorStatus(err), err).Str("bucket", ms.secondary.StoreName()).Str("file", file).
+		Msg("Mirrored write to secondary failed.")
+}
+
+func (ms *MirroredStore) diverged(op, file string, err error, msg string) {
+	zl.Warn().Str("component", "MirroredStore").
+		Str("primary", ms.primary.StoreName()).Str("secondary", ms.secondary.StoreName()).
+		Str("op", op).Str("file", file).Err(err).Msg("mirror diverged: " + msg)
+}
+
+// listAll collects the whole listing by key.
+func listAll(ctx context.Context, store LingioStore, opts ListOptions) (map[string]ObjectInfo, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	objects := make(map[string]ObjectInfo)
+	for info := range store.ListObjectsWithOptions(ctx, opts) {
+		if info.Err != nil {
+			return nil, info.Err
+		}
+		objects[info.Key] = info
+	}
+	return objects, ctx.Err()
+}
@@ -0,0 +1,151 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMirroredStoreWrites(t *testing.T) {
+	ctx := context.Background()
+	primary, secondary := NewMemoryStore("primary"), NewMemoryStore("secondary")
+	ms := NewMirroredStore(primary, secondary, MirrorOptions{})
+
+	info, err := ms.PutObjectWithOptions(ctx, "a", []byte("1"), PutOptions{IfNoneMatch: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.PutObjectWithOptions(ctx, "a", []byte("2"), PutOptions{IfMatch: "stale"}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected ErrPreconditionFailed from primary but got %v", err)
+	}
+	if _, err := ms.CopyObject(ctx, "a", "b", CopyOptions{SourceETag: info.ETag}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.DeleteObject(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	for _, store := range []*MemoryStore{primary, secondary} {
+		if keys := store.Keys(); !reflect.DeepEqual(keys, []string{"b"}) {
+			t.Errorf("expected %s to contain [b] but got %v", store.StoreName(), keys)
+		}
+	}
+
+	secondary.InjectFault(Fault{Op: OpPutObject, Err: NewError(http.StatusServiceUnavailable)})
+	if _, err := ms.PutObject(ctx, "c", []byte("3")); err != nil {
+		t.Errorf("expected failed secondary write to be ignored but got %v", err)
+	}
+	ms.opts.RequireSecondary = true
+	if _, err := ms.PutObject(ctx, "d", []byte("4")); err == nil {
+		t.Error("expected failed secondary write to fail with RequireSecondary")
+	}
+}
+
+func TestMirroredStoreReadFallback(t *testing.T) {
+	ctx := context.Background()
+	primary, secondary := NewMemoryStore("primary"), NewMemoryStore("secondary")
+	if _, err := secondary.PutObject(ctx, "a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	ms := NewMirroredStore(primary, secondary, MirrorOptions{ReadFallback: true})
+	if _, _, err := ms.GetObject(ctx, "a"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expected ErrObjectNotFound for object deleted in primary but got %v", err)
+	}
+
+	primary.InjectFault(Fault{Op: OpGetObject, Err: NewError(http.StatusServiceUnavailable)})
+	if _, _, err := NewMirroredStore(primary, secondary, MirrorOptions{}).GetObject(ctx, "a"); errorStatus(err) != http.StatusServiceUnavailable {
+		t.Errorf("expected primary error without fallback but got %v", err)
+	}
+	data, _, err := ms.GetObject(ctx, "a")
+	if err != nil || string(data) != "1" {
+		t.Errorf("expected object from secondary but got %q (%v)", data, err)
+	}
+	r, _, err := ms.GetObjectReader(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if data, err := io.ReadAll(r); err != nil || string(data) != "1" {
+		t.Errorf("expected streamed object from secondary but got %q (%v)", data, err)
+	}
+}
+
+func TestMirroredStoreStreaming(t *testing.T) {
+	ctx := context.Background()
+	primary, secondary := NewMemoryStore("primary"), NewMemoryStore("secondary")
+	ms := NewMirroredStore(primary, secondary, MirrorOptions{})
+	info, err := ms.PutObjectReader(ctx, "a", strings.NewReader("1"), 1, PutOptions{Metadata: map[string]string{"schema": "2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, sinfo, err := secondary.GetObject(ctx, "a")
+	if err != nil || string(data) != "1" || sinfo.Metadata["Schema"] != "2" {
+		t.Errorf("expected streamed object in secondary but got %q %v (%v)", data, sinfo.Metadata, err)
+	}
+	if sinfo.Metadata[mirrorETagKey] != info.ETag {
+		t.Errorf("expected copy to record primary etag %q but got %v", info.ETag, sinfo.Metadata)
+	}
+	if _, err := ms.ListObjectVersions(ctx, "a"); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported from unversioned primary but got %v", err)
+	}
+}
+
+func TestMirroredStoreReconcile(t *testing.T) {
+	ctx := context.Background()
+	primary, secondary := NewMemoryStore("primary"), NewMemoryStore("secondary")
+	for _, key := range []string{"a", "b"} {
+		if _, err := primary.PutObject(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := secondary.PutObject(ctx, "extra", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	ms := NewMirroredStore(primary, secondary, MirrorOptions{})
+
+	want := ReconcileResult{Missing: 2, Extra: 1}
+	if result, err := ms.Reconcile(ctx, ReconcileOptions{DryRun: true}); err != nil || result != want {
+		t.Errorf("expected %+v but got %+v (%v)", want, result, err)
+	}
+	if keys := secondary.Keys(); len(keys) != 1 {
+		t.Errorf("expected dry run to leave secondary untouched but got %v", keys)
+	}
+
+	if result, err := ms.Reconcile(ctx, ReconcileOptions{DeleteExtra: true}); err != nil || result != want {
+		t.Errorf("expected %+v but got %+v (%v)", want, result, err)
+	}
+	if keys := secondary.Keys(); !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Errorf("expected reconciled secondary but got %v", keys)
+	}
+	if result, err := ms.Reconcile(ctx, ReconcileOptions{}); err != nil || result != (ReconcileResult{}) {
+		t.Errorf("expected no differences but got %+v (%v)", result, err)
+	}
+
+	// copies are compared by the recorded primary etag, not by modification time
+	if _, err := secondary.PutObject(ctx, "a", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := primary.PutObject(ctx, "b", []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	want = ReconcileResult{Stale: 2}
+	if result, err := ms.Reconcile(ctx, ReconcileOptions{}); err != nil || result != want {
+		t.Errorf("expected %+v but got %+v (%v)", want, result, err)
+	}
+	for _, key := range []string{"a", "b"} {
+		pdata, _, _ := primary.GetObject(ctx, key)
+		if sdata, _, err := secondary.GetObject(ctx, key); err != nil || string(sdata) != string(pdata) {
+			t.Errorf("expected %s to be copied from primary but got %q (%v)", key, sdata, err)
+		}
+	}
+	if _, err := ms.PutObject(ctx, "c", []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := ms.Reconcile(ctx, ReconcileOptions{}); err != nil || result != (ReconcileResult{}) {
+		t.Errorf("expected mirrored writes to match but got %+v (%v)", result, err)
+	}
+}
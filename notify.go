@@ -0,0 +1,81 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+)
+
+// ObjectEventType is the kind of change reported by an ObjectEvent.
+type ObjectEventType string
+
+const (
+	ObjectCreated ObjectEventType = "created"
+	ObjectRemoved ObjectEventType = "removed"
+)
+
+// ObjectEvent reports that an object was written or removed.
+type ObjectEvent struct {
+	Type ObjectEventType
+	Key  string
+	// ETag is the ETag of the written object. It is empty for removed objects.
+	ETag string
+
+	// Err is set on the last event if the subscription failed.
+	Err error
+}
+
+// NotifyingStore is implemented by stores that can report object changes,
+// including changes made by other processes.
+type NotifyingStore interface {
+	// ListenObjectEvents reports changes to objects with the key prefix until
+	// ctx is done. If the subscription fails, the last event has Err set.
+	ListenObjectEvents(ctx context.Context, prefix string) <-chan ObjectEvent
+}
+
+// ListenObjectEvents subscribes to object changes if the store implements NotifyingStore.
+func ListenObjectEvents(ctx context.Context, store LingioStore, prefix string) (<-chan ObjectEvent, error) {
+	ns, ok := store.(NotifyingStore)
+	if !ok {
+		return nil, NewErrorE(http.StatusNotImplemented, ErrNotSupported).
+			Str("bucket", store.StoreName()).Msg("Store does not support object notifications.")
+	}
+	return ns.ListenObjectEvents(ctx, prefix), nil
+}
+
+func objectEventFromMinio(record notification.Event) ObjectEvent {
+	event := ObjectEvent{
+		Type: ObjectCreated,
+		ETag: record.S3.Object.ETag,
+	}
+	if strings.HasPrefix(record.EventName, "s3:ObjectRemoved:") {
+		event.Type = ObjectRemoved
+		event.ETag = ""
+	}
+	// object keys are url-encoded in notifications
+	event.Key = record.S3.Object.Key
+	if key, err := url.QueryUnescape(record.S3.Object.Key); err == nil {
+		event.Key = key
+	}
+	return event
+}
+
+func sendObjectEvent(ctx context.Context, events chan<- ObjectEvent, event ObjectEvent) bool {
+	select {
+	case events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// failedObjectEvents returns a closed subscription that only reports err.
+func failedObjectEvents(err error) <-chan ObjectEvent {
+	events := make(chan ObjectEvent, 1)
+	events <- ObjectEvent{Err: err}
+	close(events)
+	return events
+}
@@ -0,0 +1,92 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+)
+
+func nextObjectEvent(t *testing.T, events <-chan ObjectEvent) ObjectEvent {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("expected an event but the subscription was closed")
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return ObjectEvent{}
+}
+
+func TestEncryptedStoreObjectEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	es, backend := newTestEncryptedStore(t)
+
+	events, err := ListenObjectEvents(ctx, es, "a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// written to the backend by someone else: not decryptable, skipped
+	if _, err := backend.PutObject(ctx, "plain", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := es.PutObject(ctx, "b/1", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := es.PutObject(ctx, "a/1", []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := es.MoveObject(ctx, "a/1", "a/2", CopyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ObjectEvent{
+		{Type: ObjectCreated, Key: "a/1", ETag: info.ETag},
+		{Type: ObjectCreated, Key: "a/2", ETag: info.ETag},
+		{Type: ObjectRemoved, Key: "a/1"},
+	}
+	for _, w := range want {
+		if got := nextObjectEvent(t, events); got != w {
+			t.Errorf("expected %+v but got %+v", w, got)
+		}
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestListenObjectEventsNotSupported(t *testing.T) {
+	// only exposes the LingioStore methods
+	backend := struct{ LingioStore }{NewMemoryStore("test")}
+	es, err := NewEncryptedStore(backend, "0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListenObjectEvents(context.Background(), backend, ""); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported but got %v", err)
+	}
+	event := nextObjectEvent(t, es.ListenObjectEvents(context.Background(), ""))
+	if !errors.Is(event.Err, ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported event but got %+v", event)
+	}
+}
+
+func TestObjectEventFromMinio(t *testing.T) {
+	var record notification.Event
+	record.EventName = "s3:ObjectRemoved:Delete"
+	record.S3.Object.Key = "dir%2Fa+b.json"
+	record.S3.Object.ETag = "abc"
+
+	want := ObjectEvent{Type: ObjectRemoved, Key: "dir/a b.json"}
+	if got := objectEventFromMinio(record); got != want {
+		t.Errorf("expected %+v but got %+v", want, got)
+	}
+}
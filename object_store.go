@@ -6,10 +6,14 @@ package common
 import (
 	"bytes"
 	"context"
+	"encoding/xml"
 	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/minio/minio-go/v7"
 	"go.opentelemetry.io/otel/attribute"
@@ -20,6 +24,9 @@ import (
 var ErrBucketDoesNotExist = errors.New("bucket does not exist")
 var ErrObjectNotFound = errors.New("object not found")
 
+// ErrPreconditionFailed is returned when a conditional write or delete does not match the stored object.
+var ErrPreconditionFailed = errors.New("object precondition failed")
+
 // ObjectStore implements the Lingio CRUD database interface on top of minio's object storage engine.
 type ObjectStore struct {
 	mc         *minio.Client
@@ -32,6 +39,9 @@ type ObjectStoreConfig struct {
 	ContentType string
 	// ContentDisposition specifies the object disposition mime-type. Defaults to "".
 	ContentDisposition string
+	// HTTPClient sends the presigned requests used for conditional deletes and
+	// copies, which minio-go has no API for. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
 }
 
 // NewObjectStore attempts to initialize a new bucket if it does not already exist.
@@ -55,9 +65,53 @@ func (os ObjectStore) GetObject(ctx context.Context, file string) (_ []byte, _ O
 	defer span.End()
 	defer span.RecordError(lerr)
 
-	object, err := os.mc.GetObject(context.Background(), os.bucketName, file, minio.GetObjectOptions{
-		// TODO: add support for VersionID ?
+	return os.getObject(ctx, file, minio.GetObjectOptions{})
+}
+
+// GetObjectVersion attempts to get metadata and read data from a specific version of the file.
+func (os ObjectStore) GetObjectVersion(ctx context.Context, file, versionID string) (_ []byte, _ ObjectInfo, lerr error) {
+	ctx, span := tracer.Start(ctx, "object_store.GetObjectVersion", trace.WithAttributes(
+		attribute.String("file", file),
+		attribute.String("versionID", versionID),
+	))
+	defer span.End()
+	defer span.RecordError(lerr)
+
+	return os.getObject(ctx, file, minio.GetObjectOptions{
+		VersionID: versionID,
 	})
+}
+
+// GetObjectReader opens the file for reading without buffering it in memory.
+// The caller must close the returned reader.
+func (os ObjectStore) GetObjectReader(ctx context.Context, file string) (_ io.ReadCloser, _ ObjectInfo, lerr error) {
+	ctx, span := tracer.Start(ctx, "object_store.GetObjectReader", trace.WithAttributes(
+		attribute.String("file", file),
+	))
+	defer span.End()
+	defer span.RecordError(lerr)
+
+	object, err := os.mc.GetObject(ctx, os.bucketName, file, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, ObjectInfo{}, objectError(err, os.bucketName, file, "Could not get object")
+	}
+	// Stat performs the request so that missing objects are reported here and not on first read.
+	stat, err := object.Stat()
+	if err != nil {
+		object.Close()
+		return nil, ObjectInfo{}, objectError(err, os.bucketName, file, "Could not get object stat info.")
+	}
+	info, err := os.objectInfo(ctx, stat)
+	if err != nil {
+		object.Close()
+		return nil, ObjectInfo{}, err
+	}
+	return object, info, nil
+}
+
+func (os ObjectStore) getObject(ctx context.Context, file string, opts minio.GetObjectOptions) (_ []byte, _ ObjectInfo, lerr error) {
+	span := trace.SpanFromContext(ctx)
+	object, err := os.mc.GetObject(context.Background(), os.bucketName, file, opts)
 	if err != nil {
 		return nil, ObjectInfo{}, objectError(err, os.bucketName, file, "Could not get object")
 	}
@@ -81,11 +135,37 @@ func (os ObjectStore) GetObject(ctx context.Context, file string) (_ []byte, _ O
 		return nil, ObjectInfo{}, objectError(err, os.bucketName, file, "Could not get object stat info.")
 	}
 
-	return data, objectInfoFromMinio(stat), nil
+	info, err := os.objectInfo(ctx, stat)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return data, info, nil
+}
+
+// objectInfo converts the stat info and fetches the object tags,
+// which are not included in GET and HEAD responses.
+func (os ObjectStore) objectInfo(ctx context.Context, stat minio.ObjectInfo) (ObjectInfo, error) {
+	info := objectInfoFromMinio(stat)
+	if stat.UserTagCount > 0 {
+		tags, err := os.mc.GetObjectTagging(ctx, os.bucketName, stat.Key, minio.GetObjectTaggingOptions{
+			VersionID: stat.VersionID,
+		})
+		if err != nil {
+			return ObjectInfo{}, objectError(err, os.bucketName, stat.Key, "Could not get object tags.")
+		}
+		info.Tags = nonEmpty(tags.ToMap())
+	}
+	return info, nil
 }
 
 // PutObject uploads the object with pre-configured content type and content disposition.
-func (os ObjectStore) PutObject(ctx context.Context, file string, data []byte) (_ ObjectInfo, diderr error) {
+func (os ObjectStore) PutObject(ctx context.Context, file string, data []byte) (ObjectInfo, error) {
+	return os.PutObjectWithOptions(ctx, file, data, PutOptions{})
+}
+
+// PutObjectWithOptions uploads the object if the provided preconditions hold.
+// A precondition mismatch is reported as a 412 error wrapping ErrPreconditionFailed.
+func (os ObjectStore) PutObjectWithOptions(ctx context.Context, file string, data []byte, opts PutOptions) (_ ObjectInfo, diderr error) {
 	ctx, span := tracer.Start(ctx, "object_store.PutObject", trace.WithAttributes(
 		attribute.String("file", file),
 	))
@@ -93,23 +173,84 @@ func (os ObjectStore) PutObject(ctx context.Context, file string, data []byte) (
 	defer span.RecordError(diderr)
 
 	defer logObjectStoreAuditEvent(ctx, "Put", os.bucketName, file, diderr)
-	info, err := os.mc.PutObject(ctx, os.bucketName, file, bytes.NewBuffer(data), int64(len(data)), minio.PutObjectOptions{
-		ContentType:        os.config.ContentType,
-		ContentDisposition: os.config.ContentDisposition,
-		// NOTE: Also add support for ContentEncoding ?
-	})
+	putOpts := os.putOptions(opts)
+	info, err := os.mc.PutObject(ctx, os.bucketName, file, bytes.NewBuffer(data), int64(len(data)), putOpts)
+	if err != nil {
+		return ObjectInfo{}, objectError(err, os.bucketName, file, "Could not update object data.")
+	}
+	return objectInfoFromUpload(info, putOpts), nil
+}
+
+// PutObjectReader uploads size bytes from r without buffering the whole object.
+// If size is -1 the object is uploaded in 16MiB parts, which limits the object size to 156GiB.
+func (os ObjectStore) PutObjectReader(ctx context.Context, file string, r io.Reader, size int64, opts PutOptions) (_ ObjectInfo, diderr error) {
+	ctx, span := tracer.Start(ctx, "object_store.PutObjectReader", trace.WithAttributes(
+		attribute.String("file", file),
+		attribute.Int64("size", size),
+	))
+	defer span.End()
+	defer span.RecordError(diderr)
+
+	defer logObjectStoreAuditEvent(ctx, "Put", os.bucketName, file, diderr)
+	putOpts := os.putOptions(opts)
+	if size < 0 {
+		// minio buffers each part in memory and defaults to ~512MiB parts for unknown sizes.
+		putOpts.PartSize = 16 << 20
+	}
+	info, err := os.mc.PutObject(ctx, os.bucketName, file, r, size, putOpts)
 	if err != nil {
 		return ObjectInfo{}, objectError(err, os.bucketName, file, "Could not update object data.")
 	}
+	return objectInfoFromUpload(info, putOpts), nil
+}
+
+// putOptions applies the store config, metadata and preconditions to minio put options.
+func (os ObjectStore) putOptions(opts PutOptions) minio.PutObjectOptions {
+	putOpts := minio.PutObjectOptions{
+		ContentType:        os.config.ContentType,
+		ContentDisposition: os.config.ContentDisposition,
+		ContentEncoding:    opts.ContentEncoding,
+		UserMetadata:       opts.Metadata,
+		UserTags:           opts.Tags,
+	}
+	if opts.ContentType != "" {
+		putOpts.ContentType = opts.ContentType
+	}
+	// MinIO extension for optimistic locking, see minio.PutObjectOptions.SetMatchETag.
+	if opts.IfMatch != "" {
+		putOpts.SetMatchETag(opts.IfMatch)
+	}
+	if opts.IfNoneMatch {
+		putOpts.SetMatchETagExcept("*")
+	}
+	return putOpts
+}
+
+func objectInfoFromUpload(info minio.UploadInfo, opts minio.PutObjectOptions) ObjectInfo {
 	return ObjectInfo{
-		ETag:       info.ETag,
-		Expiration: info.Expiration,
-		Key:        info.Key,
-	}, nil
+		ETag:            info.ETag,
+		Expiration:      info.Expiration,
+		Key:             info.Key,
+		Size:            info.Size,
+		LastModified:    info.LastModified,
+		ContentType:     opts.ContentType,
+		ContentEncoding: opts.ContentEncoding,
+		Metadata:        canonicalMetadata(opts.UserMetadata),
+		Tags:            nonEmpty(opts.UserTags),
+		VersionID:       info.VersionID,
+	}
 }
 
 // DeleteObject will attempt to remove the requested file/object.
-func (os ObjectStore) DeleteObject(ctx context.Context, file string) (diderr error) {
+func (os ObjectStore) DeleteObject(ctx context.Context, file string) error {
+	return os.DeleteObjectWithOptions(ctx, file, DeleteOptions{})
+}
+
+// DeleteObjectWithOptions will attempt to remove the requested file/object if
+// the provided preconditions hold. minio-go cannot send conditional deletes, so a
+// delete with IfMatch is sent as a presigned request carrying an If-Match header
+// and the ETag is checked atomically by the server, see DeleteOptions.IfMatch.
+func (os ObjectStore) DeleteObjectWithOptions(ctx context.Context, file string, opts DeleteOptions) (diderr error) {
 	ctx, span := tracer.Start(ctx, "object_store.DeleteObject", trace.WithAttributes(
 		attribute.String("file", file),
 	))
@@ -120,8 +261,22 @@ func (os ObjectStore) DeleteObject(ctx context.Context, file string) (diderr err
 		}
 	}()
 	defer logObjectStoreAuditEvent(ctx, "Delete", os.bucketName, file, diderr)
+	if opts.IfMatch != "" {
+		params := url.Values{}
+		if opts.VersionID != "" {
+			params.Set("versionId", opts.VersionID)
+		}
+		resp, err := os.signedRequest(ctx, http.MethodDelete, file, params, http.Header{
+			"If-Match": []string{`"` + opts.IfMatch + `"`},
+		})
+		if err != nil {
+			return objectError(err, os.bucketName, file, "Could not remove object.")
+		}
+		resp.Body.Close()
+		return nil
+	}
 	err := os.mc.RemoveObject(ctx, os.bucketName, file, minio.RemoveObjectOptions{
-		// TODO: add support for VersionID ?
+		VersionID: opts.VersionID,
 	})
 	if err != nil {
 		return objectError(err, os.bucketName, file, "Could not remove object.")
@@ -129,29 +284,411 @@ func (os ObjectStore) DeleteObject(ctx context.Context, file string) (diderr err
 	return nil
 }
 
-// ListObjects performs a recursive object listing.
+// CopyObject copies the object server-side, including its metadata and tags.
+// A copy with IfNoneMatch is sent as a presigned request carrying an
+// If-None-Match header, so the destination is checked atomically by the server.
+func (os ObjectStore) CopyObject(ctx context.Context, src, dst string, opts CopyOptions) (_ ObjectInfo, diderr error) {
+	ctx, span := tracer.Start(ctx, "object_store.CopyObject", trace.WithAttributes(
+		attribute.String("src", src),
+		attribute.String("dst", dst),
+	))
+	defer span.End()
+	defer span.RecordError(diderr)
+
+	return os.copyObjectFrom(ctx, os.bucketName, src, dst, opts)
+}
+
+// MoveObject copies the object server-side and removes the source.
+func (os ObjectStore) MoveObject(ctx context.Context, src, dst string, opts CopyOptions) (ObjectInfo, error) {
+	return moveObject(ctx, os, src, dst, opts)
+}
+
+// copyObjectFrom copies an object from a bucket reachable by the same client.
+func (os ObjectStore) copyObjectFrom(ctx context.Context, srcBucket, src, dst string, opts CopyOptions) (_ ObjectInfo, diderr error) {
+	defer func() { logObjectStoreAuditEvent(ctx, "Copy", os.bucketName, dst, diderr) }()
+	if opts.IfNoneMatch {
+		return os.copyObjectIfNoneMatch(ctx, srcBucket, src, dst, opts)
+	}
+	info, err := os.mc.CopyObject(ctx, minio.CopyDestOptions{
+		Bucket: os.bucketName,
+		Object: dst,
+	}, minio.CopySrcOptions{
+		Bucket:    srcBucket,
+		Object:    src,
+		MatchETag: opts.SourceETag,
+	})
+	if err != nil {
+		return ObjectInfo{}, objectError(err, srcBucket, src, "Could not copy object.")
+	}
+	return objectInfoFromUpload(info, minio.PutObjectOptions{}), nil
+}
+
+// copyObjectIfNoneMatch copies the object with a presigned request, since
+// minio-go cannot send If-None-Match for copies.
+func (os ObjectStore) copyObjectIfNoneMatch(ctx context.Context, srcBucket, src, dst string, opts CopyOptions) (ObjectInfo, error) {
+	header := http.Header{
+		"X-Amz-Copy-Source": []string{(&url.URL{Path: "/" + srcBucket + "/" + src}).EscapedPath()},
+		"If-None-Match":     []string{"*"},
+	}
+	if opts.SourceETag != "" {
+		header.Set("X-Amz-Copy-Source-If-Match", `"`+opts.SourceETag+`"`)
+	}
+	resp, err := os.signedRequest(ctx, http.MethodPut, dst, nil, header)
+	if err != nil {
+		return ObjectInfo{}, objectError(err, srcBucket, src, "Could not copy object.")
+	}
+	defer resp.Body.Close()
+	// S3 may report a failed copy with a 200 status, so the body decides.
+	var result struct {
+		XMLName      xml.Name
+		ETag         string
+		LastModified time.Time
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		err = xml.Unmarshal(body, &result)
+	}
+	if err != nil {
+		return ObjectInfo{}, objectError(err, srcBucket, src, "Could not read copy result.")
+	}
+	if result.XMLName.Local == "Error" {
+		return ObjectInfo{}, objectError(responseError(http.StatusInternalServerError, body), srcBucket, src, "Could not copy object.")
+	}
+	return objectInfoFromUpload(minio.UploadInfo{
+		Bucket:       os.bucketName,
+		Key:          dst,
+		ETag:         strings.Trim(result.ETag, `"`),
+		LastModified: result.LastModified,
+		VersionID:    resp.Header.Get("X-Amz-Version-Id"),
+	}, minio.PutObjectOptions{}), nil
+}
+
+// signedRequest sends a request that minio-go has no API for. The request is
+// presigned by the minio client, including the given headers, and sent with
+// the configured HTTP client. Error responses are returned as minio.ErrorResponse.
+func (os ObjectStore) signedRequest(ctx context.Context, method, file string, params url.Values, header http.Header) (*http.Response, error) {
+	u, err := os.mc.PresignHeader(ctx, method, os.bucketName, file, time.Minute, params, header)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	client := os.config.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, responseError(resp.StatusCode, body)
+	}
+	return resp, nil
+}
+
+// responseError decodes an S3 error response.
+func responseError(status int, body []byte) minio.ErrorResponse {
+	merr := minio.ErrorResponse{}
+	if err := xml.Unmarshal(body, &merr); err != nil || merr.Code == "" {
+		switch status {
+		case http.StatusNotFound:
+			merr.Code = "NoSuchKey"
+		case http.StatusPreconditionFailed:
+			merr.Code = "PreconditionFailed"
+		case http.StatusNotImplemented:
+			merr.Code = "NotImplemented"
+		default:
+			merr.Code = http.StatusText(status)
+		}
+	}
+	merr.StatusCode = status
+	return merr
+}
+
+// DeleteObjects removes the files using multi-object delete requests of up to
+// 1000 keys each. It returns one result per file, in the same order.
+func (os ObjectStore) DeleteObjects(ctx context.Context, files []string) []BatchResult {
+	ctx, span := tracer.Start(ctx, "object_store.DeleteObjects", trace.WithAttributes(
+		attribute.Int("count", len(files)),
+	))
+	defer span.End()
+
+	objects := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(objects)
+		for _, file := range files {
+			select {
+			case objects <- minio.ObjectInfo{Key: file}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	failed := make(map[string]error)
+	for rerr := range os.mc.RemoveObjects(ctx, os.bucketName, objects, minio.RemoveObjectsOptions{}) {
+		span.RecordError(rerr.Err)
+		failed[rerr.ObjectName] = objectError(rerr.Err, os.bucketName, rerr.ObjectName, "Could not remove object.")
+	}
+
+	results := make([]BatchResult, len(files))
+	for i, file := range files {
+		results[i] = BatchResult{Key: file, Err: failed[file]}
+		if results[i].Err == nil && ctx.Err() != nil {
+			// removal may not have been attempted
+			results[i].Err = objectError(ctx.Err(), os.bucketName, file, "Could not remove object.")
+		}
+		logObjectStoreAuditEvent(ctx, "Delete", os.bucketName, file, results[i].Err)
+	}
+	return results
+}
+
+// ListObjects performs a recursive object listing. Listing errors are dropped,
+// use ListObjectsWithOptions to observe them.
 func (os ObjectStore) ListObjects(ctx context.Context) <-chan ObjectInfo {
-	ctx, span := tracer.Start(ctx, "object_store.ListObjects")
+	return withoutListingErrors(os.ListObjectsWithOptions(ctx, ListOptions{}))
+}
+
+// ListObjectsWithOptions performs a recursive object listing in key order. If
+// the listing fails, the last object on the channel has Err set.
+func (os ObjectStore) ListObjectsWithOptions(ctx context.Context, opts ListOptions) <-chan ObjectInfo {
+	ctx, span := tracer.Start(ctx, "object_store.ListObjects", trace.WithAttributes(
+		attribute.String("prefix", opts.Prefix),
+		attribute.String("startAfter", opts.StartAfter),
+		attribute.Int("maxKeys", opts.MaxKeys),
+	))
+	ctx, cancel := context.WithCancel(ctx)
 	listing := os.mc.ListObjects(ctx, os.bucketName, minio.ListObjectsOptions{
-		Recursive: true,
-		// add support for WithVersions ?
+		Prefix:       opts.Prefix,
+		StartAfter:   opts.StartAfter,
+		MaxKeys:      opts.MaxKeys, // page size of each list request
+		Recursive:    true,
+		WithMetadata: opts.WithMetadata,
 	})
 
 	objects := make(chan ObjectInfo, 10)
 	go func() {
 		defer span.End()
 		defer close(objects)
+		defer cancel()
+		var n int
 		for objectInfo := range listing {
+			info := objectInfoFromMinio(objectInfo)
 			if objectInfo.Err == io.EOF {
 				return
+			} else if objectInfo.Err != nil {
+				info.Err = bucketError(objectInfo.Err, os.bucketName, "Could not list objects.")
+				span.RecordError(info.Err)
+			}
+			select {
+			case objects <- info:
+			case <-ctx.Done():
+				return
+			}
+			if n++; info.Err != nil || n == opts.MaxKeys {
+				return
 			}
-			objects <- objectInfoFromMinio(objectInfo)
 		}
 	}()
 
 	return objects
 }
 
+// ListObjectVersions lists all versions and delete markers of the file, newest first.
+func (os ObjectStore) ListObjectVersions(ctx context.Context, file string) (_ []ObjectInfo, lerr error) {
+	ctx, span := tracer.Start(ctx, "object_store.ListObjectVersions", trace.WithAttributes(
+		attribute.String("file", file),
+	))
+	defer span.End()
+	defer span.RecordError(lerr)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var versions []ObjectInfo
+	for info := range os.mc.ListObjects(ctx, os.bucketName, minio.ListObjectsOptions{
+		Prefix:       file,
+		Recursive:    true,
+		WithVersions: true,
+	}) {
+		if info.Err != nil {
+			return nil, objectError(info.Err, os.bucketName, file, "Could not list object versions.")
+		}
+		// Prefix listing also includes keys that only start with file.
+		if info.Key != file {
+			continue
+		}
+		versions = append(versions, objectInfoFromMinio(info))
+	}
+	return versions, nil
+}
+
+// RestoreObjectVersion makes a copy of an old version the latest version of the file.
+// The copy is performed server-side and the restored object gets a new version ID.
+func (os ObjectStore) RestoreObjectVersion(ctx context.Context, file, versionID string) (_ ObjectInfo, diderr error) {
+	ctx, span := tracer.Start(ctx, "object_store.RestoreObjectVersion", trace.WithAttributes(
+		attribute.String("file", file),
+		attribute.String("versionID", versionID),
+	))
+	defer span.End()
+	defer span.RecordError(diderr)
+
+	defer logObjectStoreAuditEvent(ctx, "Restore", os.bucketName, file, diderr)
+	info, err := os.mc.CopyObject(ctx, minio.CopyDestOptions{
+		Bucket: os.bucketName,
+		Object: file,
+	}, minio.CopySrcOptions{
+		Bucket:    os.bucketName,
+		Object:    file,
+		VersionID: versionID,
+	})
+	if err != nil {
+		return ObjectInfo{}, objectError(err, os.bucketName, file, "Could not restore object version.")
+	}
+	return objectInfoFromUpload(info, minio.PutObjectOptions{}), nil
+}
+
+// PresignGetObject creates a URL for downloading the file directly from the bucket.
+func (os ObjectStore) PresignGetObject(ctx context.Context, file string, opts PresignOptions) (_ PresignedRequest, lerr error) {
+	ctx, span := tracer.Start(ctx, "object_store.PresignGetObject", trace.WithAttributes(
+		attribute.String("file", file),
+	))
+	defer span.End()
+	defer span.RecordError(lerr)
+
+	expiry := presignExpiry(opts)
+	params := make(url.Values)
+	if opts.ContentType != "" {
+		params.Set("response-content-type", opts.ContentType)
+	}
+	if opts.ContentDisposition != "" {
+		params.Set("response-content-disposition", opts.ContentDisposition)
+	}
+	u, err := os.mc.PresignedGetObject(ctx, os.bucketName, file, expiry, params)
+	if err != nil {
+		return PresignedRequest{}, objectError(err, os.bucketName, file, "Could not presign object download.")
+	}
+	return PresignedRequest{
+		Method:  http.MethodGet,
+		URL:     u.String(),
+		Expires: time.Now().Add(expiry),
+	}, nil
+}
+
+// PresignPutObject creates a request for uploading the file directly to the bucket.
+// Uploads with a size restriction use a POST policy, other uploads a PUT URL.
+func (os ObjectStore) PresignPutObject(ctx context.Context, file string, opts PresignOptions) (_ PresignedRequest, lerr error) {
+	ctx, span := tracer.Start(ctx, "object_store.PresignPutObject", trace.WithAttributes(
+		attribute.String("file", file),
+	))
+	defer span.End()
+	defer span.RecordError(lerr)
+
+	expiry := presignExpiry(opts)
+	contentType := opts.ContentType
+	if contentType == "" {
+		contentType = os.config.ContentType
+	}
+
+	if opts.MinSize > 0 || opts.MaxSize > 0 {
+		policy := minio.NewPostPolicy()
+		err := errors.Join(
+			policy.SetBucket(os.bucketName),
+			policy.SetKey(file),
+			policy.SetExpires(time.Now().UTC().Add(expiry)),
+		)
+		if contentType != "" {
+			err = errors.Join(err, policy.SetContentType(contentType))
+		}
+		if opts.MaxSize > 0 {
+			err = errors.Join(err, policy.SetContentLengthRange(opts.MinSize, opts.MaxSize))
+		} else {
+			err = errors.Join(err, policy.SetContentLengthRange(opts.MinSize, 5<<40))
+		}
+		if err != nil {
+			return PresignedRequest{}, objectError(err, os.bucketName, file, "Invalid presign options.")
+		}
+		u, formData, err := os.mc.PresignedPostPolicy(ctx, policy)
+		if err != nil {
+			return PresignedRequest{}, objectError(err, os.bucketName, file, "Could not presign object upload.")
+		}
+		return PresignedRequest{
+			Method:   http.MethodPost,
+			URL:      u.String(),
+			FormData: formData,
+			Expires:  time.Now().Add(expiry),
+		}, nil
+	}
+
+	var header http.Header
+	if contentType != "" {
+		header = http.Header{"Content-Type": []string{contentType}}
+	}
+	u, err := os.mc.PresignHeader(ctx, http.MethodPut, os.bucketName, file, expiry, nil, header)
+	if err != nil {
+		return PresignedRequest{}, objectError(err, os.bucketName, file, "Could not presign object upload.")
+	}
+	return PresignedRequest{
+		Method:  http.MethodPut,
+		URL:     u.String(),
+		Header:  header,
+		Expires: time.Now().Add(expiry),
+	}, nil
+}
+
+func presignExpiry(opts PresignOptions) time.Duration {
+	if opts.Expiry <= 0 {
+		return DefaultPresignExpiry
+	}
+	return opts.Expiry
+}
+
+// ListenObjectEvents subscribes to put and delete notifications of the bucket.
+// This is a MinIO extension, other S3 providers must use bucket notification targets.
+// The minio client reconnects on failures until ctx is done.
+func (os ObjectStore) ListenObjectEvents(ctx context.Context, prefix string) <-chan ObjectEvent {
+	notifications := os.mc.ListenBucketNotification(ctx, os.bucketName, prefix, "", []string{
+		"s3:ObjectCreated:*",
+		"s3:ObjectRemoved:*",
+	})
+
+	events := make(chan ObjectEvent, 10)
+	go func() {
+		defer close(events)
+		for info := range notifications {
+			if info.Err != nil {
+				if ctx.Err() == nil {
+					sendObjectEvent(ctx, events, ObjectEvent{Err: bucketError(info.Err, os.bucketName, "Bucket notifications failed.")})
+				}
+				return
+			}
+			for _, record := range info.Records {
+				if !sendObjectEvent(ctx, events, objectEventFromMinio(record)) {
+					return
+				}
+			}
+		}
+	}()
+	return events
+}
+
+// EnableVersioning turns on object versioning for the bucket. Versioning
+// cannot be disabled once enabled, only suspended.
+func (os ObjectStore) EnableVersioning(ctx context.Context) error {
+	if err := os.mc.EnableVersioning(ctx, os.bucketName); err != nil {
+		return bucketError(err, os.bucketName, "Could not enable versioning.")
+	}
+	return nil
+}
+
 func (os ObjectStore) StoreName() string {
 	return os.bucketName
 }
@@ -199,6 +736,12 @@ func wrapMinioError(err error) *Error {
 		case "NoSuchKey":
 			lerr = NewErrorE(http.StatusNotFound, ErrObjectNotFound).
 				Str("minio", err.Error())
+		case "PreconditionFailed":
+			lerr = NewErrorE(http.StatusPreconditionFailed, ErrPreconditionFailed).
+				Str("minio", err.Error())
+		case "NotImplemented":
+			lerr = NewErrorE(http.StatusNotImplemented, ErrNotSupported).
+				Str("minio", err.Error())
 		default:
 			lerr = NewErrorE(merr.StatusCode, err)
 		}
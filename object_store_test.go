@@ -0,0 +1,220 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// fakeS3 is a minimal S3 server with conditional writes, for testing ObjectStore
+// without a minio server.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if key == "" {
+		return // bucket exists
+	}
+	data, exists := s.objects[key]
+	etag := fakeETag(data)
+	switch r.Method {
+	case http.MethodHead:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", `"`+etag+`"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+	case http.MethodPut:
+		if copySource := r.Header.Get("X-Amz-Copy-Source"); copySource != "" {
+			s.copyObject(w, r, key, exists, copySource)
+			return
+		}
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || strings.Trim(match, `"`) != etag) ||
+			strings.Trim(r.Header.Get("If-None-Match"), `"`) == "*" && exists {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			io.WriteString(w, "<Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold</Message></Error>")
+			return
+		}
+		data = readChunkedBody(r)
+		s.objects[key] = data
+		w.Header().Set("ETag", `"`+fakeETag(data)+`"`)
+	case http.MethodDelete:
+		if match := r.Header.Get("If-Match"); match != "" && !exists {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>")
+			return
+		} else if match != "" && strings.Trim(match, `"`) != etag {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			io.WriteString(w, "<Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold</Message></Error>")
+			return
+		}
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (s *fakeS3) copyObject(w http.ResponseWriter, r *http.Request, key string, exists bool, copySource string) {
+	source, _ := url.PathUnescape(copySource)
+	_, srcKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	data, ok := s.objects[srcKey]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, "<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>")
+		return
+	}
+	if match := r.Header.Get("X-Amz-Copy-Source-If-Match"); match != "" && strings.Trim(match, `"`) != fakeETag(data) ||
+		r.Header.Get("If-None-Match") == "*" && exists {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		io.WriteString(w, "<Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold</Message></Error>")
+		return
+	}
+	s.objects[key] = data
+	io.WriteString(w, "<CopyObjectResult><ETag>&quot;"+fakeETag(data)+"&quot;</ETag><LastModified>"+
+		time.Now().UTC().Format(time.RFC3339)+"</LastModified></CopyObjectResult>")
+}
+
+// readChunkedBody reads the request body, decoding the signed chunks that minio
+// sends over plain http.
+func readChunkedBody(r *http.Request) []byte {
+	if r.Header.Get("X-Amz-Decoded-Content-Length") == "" {
+		data, _ := io.ReadAll(r.Body)
+		return data
+	}
+	var data []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return data
+		}
+		size, _, _ := strings.Cut(line, ";")
+		n, _ := strconv.ParseInt(size, 16, 64)
+		if n == 0 {
+			return data
+		}
+		chunk := make([]byte, n+2) // chunk data and \r\n
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return data
+		}
+		data = append(data, chunk[:n]...)
+	}
+}
+
+func fakeETag(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func newFakeObjectStore(t *testing.T) (ObjectStore, *fakeS3) {
+	s3 := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(s3)
+	t.Cleanup(srv.Close)
+	mc, err := minio.New(strings.TrimPrefix(srv.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("access", "secret", ""),
+		Region: "us-east-1", // avoids a bucket location request
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewObjectStore(mc, "test", ObjectStoreConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *store, s3
+}
+
+func TestObjectStoreConditionalPut(t *testing.T) {
+	ctx := context.Background()
+	store, s3 := newFakeObjectStore(t)
+	info, err := store.PutObjectWithOptions(ctx, "a", []byte("1"), PutOptions{IfNoneMatch: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.PutObjectWithOptions(ctx, "a", []byte("2"), PutOptions{IfNoneMatch: true}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected ErrPreconditionFailed for existing object but got %v", err)
+	}
+	if _, err := store.PutObjectWithOptions(ctx, "a", []byte("2"), PutOptions{IfMatch: "stale"}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected ErrPreconditionFailed for stale etag but got %v", err)
+	}
+	if string(s3.objects["a"]) != "1" {
+		t.Errorf("expected failed conditional puts to keep the object but got %q", s3.objects["a"])
+	}
+	if _, err := store.PutObjectWithOptions(ctx, "a", []byte("2"), PutOptions{IfMatch: info.ETag}); err != nil || string(s3.objects["a"]) != "2" {
+		t.Errorf("expected put with current etag to succeed but got %q (%v)", s3.objects["a"], err)
+	}
+}
+
+func TestObjectStoreConditionalDelete(t *testing.T) {
+	ctx := context.Background()
+	store, s3 := newFakeObjectStore(t)
+	info, err := store.PutObject(ctx, "a", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteObjectWithOptions(ctx, "a", DeleteOptions{IfMatch: "stale"}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected ErrPreconditionFailed for stale etag but got %v", err)
+	}
+	if _, ok := s3.objects["a"]; !ok {
+		t.Error("expected failed conditional delete to keep the object")
+	}
+	if err := store.DeleteObjectWithOptions(ctx, "a", DeleteOptions{IfMatch: info.ETag}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s3.objects["a"]; ok {
+		t.Error("expected delete with current etag to remove the object")
+	}
+	if err := store.DeleteObjectWithOptions(ctx, "a", DeleteOptions{IfMatch: info.ETag}); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expected ErrObjectNotFound for missing object but got %v", err)
+	}
+}
+
+func TestObjectStoreConditionalCopy(t *testing.T) {
+	ctx := context.Background()
+	store, s3 := newFakeObjectStore(t)
+	src, err := store.PutObject(ctx, "a", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.PutObject(ctx, "b", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CopyObject(ctx, "a", "b", CopyOptions{IfNoneMatch: true}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected ErrPreconditionFailed for existing destination but got %v", err)
+	}
+	if string(s3.objects["b"]) != "2" {
+		t.Errorf("expected failed conditional copy to keep the destination but got %q", s3.objects["b"])
+	}
+	if _, err := store.CopyObject(ctx, "a", "c", CopyOptions{IfNoneMatch: true, SourceETag: "stale"}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected ErrPreconditionFailed for stale source etag but got %v", err)
+	}
+	info, err := store.CopyObject(ctx, "a", "c", CopyOptions{IfNoneMatch: true, SourceETag: src.ETag})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Key != "c" || info.ETag != src.ETag || string(s3.objects["c"]) != "1" {
+		t.Errorf("expected copy of a at c but got %+v with %q", info, s3.objects["c"])
+	}
+}
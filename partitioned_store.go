@@ -0,0 +1,392 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	zl "github.com/rs/zerolog/log"
+)
+
+// TenantSeparator separates the tenant (partner ID) from the object key, e.g.
+// "partner-1/user-42.json". Using "/" lets object stores list a tenant by prefix.
+const TenantSeparator = "/"
+
+// ErrInvalidTenant is returned for empty tenant IDs, tenant IDs containing the
+// separator and, if known tenants are configured, for unknown tenants.
+var ErrInvalidTenant = errors.New("invalid tenant")
+
+// PartitionedStore keeps the objects of many tenants in one backend, each under
+// its own "<tenant>/" key prefix. Use Tenant to get a store scoped to a single
+// tenant, and Tenants, Usage and DeleteTenant to audit and offboard tenants.
+type PartitionedStore struct {
+	backend     LingioStore
+	known       []string
+	concurrency int
+}
+
+// PartitionOptions configures a PartitionedStore.
+type PartitionOptions struct {
+	// Tenants lists the known tenants. If set, Tenant refuses any other tenant.
+	// Unknown tenants are still reported by Tenants so they can be cleaned up.
+	Tenants []string
+	// Concurrency bounds the number of concurrent deletes by DeleteTenant.
+	// Zero uses DefaultBatchConcurrency.
+	Concurrency int
+}
+
+// TenantUsage is the number of objects and bytes stored by a tenant. Sizes are
+// reported by the backend, e.g. encrypted or compressed sizes.
+type TenantUsage struct {
+	Tenant  string
+	Known   bool
+	Objects int
+	Bytes   int64
+}
+
+// NewPartitionedStore initializes a partitioned store on top of the backend.
+func NewPartitionedStore(backend LingioStore, opts PartitionOptions) (*PartitionedStore, error) {
+	for _, tenant := range opts.Tenants {
+		if err := validTenant(tenant); err != nil {
+			return nil, err
+		}
+	}
+	return &PartitionedStore{
+		backend:     backend,
+		known:       slices.Clone(opts.Tenants),
+		concurrency: opts.Concurrency,
+	}, nil
+}
+
+// Tenant returns a store that transparently prefixes keys with the tenant and
+// strips the prefix from listed keys and events. The store cannot reach objects
+// of other tenants.
+func (ps *PartitionedStore) Tenant(tenant string) (*TenantStore, error) {
+	if err := ps.checkTenant(tenant); err != nil {
+		return nil, err
+	}
+	return &TenantStore{
+		backend: ps.backend,
+		tenant:  tenant,
+		prefix:  tenant + TenantSeparator,
+	}, nil
+}
+
+// SplitKey splits a backend key into tenant and tenant key. Keys without a
+// tenant prefix are returned with ok set to false.
+func (ps *PartitionedStore) SplitKey(key string) (tenant, file string, ok bool) {
+	tenant, file, ok = strings.Cut(key, TenantSeparator)
+	if !ok {
+		return "", key, false
+	}
+	return tenant, file, true
+}
+
+// Tenants lists the usage of every tenant found in the backend, sorted by tenant,
+// including unknown tenants. Objects without a tenant prefix are reported under
+// the empty tenant.
+func (ps *PartitionedStore) Tenants(ctx context.Context) ([]TenantUsage, error) {
+	usage := make(map[string]*TenantUsage)
+	for _, tenant := range ps.known {
+		usage[tenant] = &TenantUsage{Tenant: tenant, Known: true}
+	}
+	for info := range ps.backend.ListObjectsWithOptions(ctx, ListOptions{}) {
+		if info.Err != nil {
+			return nil, info.Err
+		}
+		tenant, _, _ := ps.SplitKey(info.Key)
+		u, found := usage[tenant]
+		if !found {
+			u = &TenantUsage{Tenant: tenant}
+			usage[tenant] = u
+		}
+		u.Objects++
+		u.Bytes += info.Size
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	tenants := make([]TenantUsage, 0, len(usage))
+	for _, u := range usage {
+		tenants = append(tenants, *u)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].Tenant < tenants[j].Tenant })
+	return tenants, nil
+}
+
+// Usage returns the number of objects and bytes stored by the tenant.
+func (ps *PartitionedStore) Usage(ctx context.Context, tenant string) (TenantUsage, error) {
+	if err := validTenant(tenant); err != nil {
+		return TenantUsage{}, err
+	}
+	usage := TenantUsage{Tenant: tenant, Known: ps.isKnown(tenant)}
+	for info := range ps.backend.ListObjectsWithOptions(ctx, ListOptions{Prefix: tenant + TenantSeparator}) {
+		if info.Err != nil {
+			return TenantUsage{}, info.Err
+		}
+		usage.Objects++
+		usage.Bytes += info.Size
+	}
+	return usage, ctx.Err()
+}
+
+// DeleteTenant removes every object of the tenant, known or not, and returns the
+// usage that was removed. Deletes that fail are skipped and reported in the
+// returned error, so the call can be repeated until it succeeds.
+func (ps *PartitionedStore) DeleteTenant(ctx context.Context, tenant string) (TenantUsage, error) {
+	if err := validTenant(tenant); err != nil {
+		return TenantUsage{}, err
+	}
+	deleted := TenantUsage{Tenant: tenant, Known: ps.isKnown(tenant)}
+	var (
+		files  []string
+		sizes  = make(map[string]int64)
+		failed []error
+	)
+	for info := range ps.backend.ListObjectsWithOptions(ctx, ListOptions{Prefix: tenant + TenantSeparator}) {
+		if info.Err != nil {
+			return deleted, info.Err
+		}
+		files = append(files, info.Key)
+		sizes[info.Key] = info.Size
+	}
+	for _, res := range DeleteObjects(ctx, ps.backend, files, ps.concurrency) {
+		if res.Err != nil && !errors.Is(res.Err, ErrObjectNotFound) {
+			failed = append(failed, res.Err)
+			continue
+		}
+		deleted.Objects++
+		deleted.Bytes += sizes[res.Key]
+	}
+
+	zl.Info().Str("component", "PartitionedStore").Str("bucket", ps.backend.StoreName()).
+		Str("tenant", tenant).Bool("known", deleted.Known).
+		Int("objects", deleted.Objects).Int64("bytes", deleted.Bytes).Int("failed", len(failed)).
+		Msg("deleted tenant")
+	if len(failed) > 0 {
+		return deleted, Errorf(errors.Join(failed...), "Could not delete all objects of tenant.").
+			Str("bucket", ps.backend.StoreName()).Str("tenant", tenant).Int("failed", len(failed))
+	}
+	return deleted, nil
+}
+
+func (ps *PartitionedStore) isKnown(tenant string) bool {
+	return slices.Contains(ps.known, tenant)
+}
+
+func (ps *PartitionedStore) checkTenant(tenant string) error {
+	if err := validTenant(tenant); err != nil {
+		return err
+	}
+	if len(ps.known) > 0 && !ps.isKnown(tenant) {
+		return NewErrorE(http.StatusForbidden, ErrInvalidTenant).
+			Str("bucket", ps.backend.StoreName()).Str("tenant", tenant).Msg("Unknown tenant.")
+	}
+	return nil
+}
+
+func validTenant(tenant string) error {
+	if tenant == "" || strings.Contains(tenant, TenantSeparator) || tenant == "." || tenant == ".." {
+		return NewErrorE(http.StatusBadRequest, ErrInvalidTenant).Str("tenant", tenant).Msg("Invalid tenant ID.")
+	}
+	return nil
+}
+
+// TenantStore is a lingio store scoped to a single tenant of a PartitionedStore.
+type TenantStore struct {
+	backend LingioStore
+	tenant  string
+	prefix  string
+}
+
+// TenantID returns the tenant of the store.
+func (ts *TenantStore) TenantID() string {
+	return ts.tenant
+}
+
+func (ts *TenantStore) GetObject(ctx context.Context, file string) ([]byte, ObjectInfo, error) {
+	key, err := ts.key(file)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	data, info, err := ts.backend.GetObject(ctx, key)
+	return data, ts.info(info), err
+}
+
+func (ts *TenantStore) PutObject(ctx context.Context, file string, data []byte) (ObjectInfo, error) {
+	return ts.PutObjectWithOptions(ctx, file, data, PutOptions{})
+}
+
+func (ts *TenantStore) PutObjectWithOptions(ctx context.Context, file string, data []byte, opts PutOptions) (ObjectInfo, error) {
+	key, err := ts.key(file)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := ts.backend.PutObjectWithOptions(ctx, key, data, opts)
+	return ts.info(info), err
+}
+
+func (ts *TenantStore) GetObjectReader(ctx context.Context, file string) (io.ReadCloser, ObjectInfo, error) {
+	key, err := ts.key(file)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	r, info, err := GetObjectReader(ctx, ts.backend, key)
+	return r, ts.info(info), err
+}
+
+func (ts *TenantStore) PutObjectReader(ctx context.Context, file string, r io.Reader, size int64, opts PutOptions) (ObjectInfo, error) {
+	key, err := ts.key(file)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := PutObjectReader(ctx, ts.backend, key, r, size, opts)
+	return ts.info(info), err
+}
+
+func (ts *TenantStore) DeleteObject(ctx context.Context, file string) error {
+	return ts.DeleteObjectWithOptions(ctx, file, DeleteOptions{})
+}
+
+func (ts *TenantStore) DeleteObjectWithOptions(ctx context.Context, file string, opts DeleteOptions) error {
+	key, err := ts.key(file)
+	if err != nil {
+		return err
+	}
+	return ts.backend.DeleteObjectWithOptions(ctx, key, opts)
+}
+
+func (ts *TenantStore) CopyObject(ctx context.Context, src, dst string, opts CopyOptions) (ObjectInfo, error) {
+	srcKey, dstKey, err := ts.keys(src, dst)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := ts.backend.CopyObject(ctx, srcKey, dstKey, opts)
+	return ts.info(info), err
+}
+
+func (ts *TenantStore) MoveObject(ctx context.Context, src, dst string, opts CopyOptions) (ObjectInfo, error) {
+	srcKey, dstKey, err := ts.keys(src, dst)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := ts.backend.MoveObject(ctx, srcKey, dstKey, opts)
+	return ts.info(info), err
+}
+
+// DeleteObjects removes the files of the tenant, in bulk if the backend implements BatchDeleter.
+func (ts *TenantStore) DeleteObjects(ctx context.Context, files []string) []BatchResult {
+	results := make([]BatchResult, len(files))
+	keys := make([]string, 0, len(files))
+	index := make([]int, 0, len(files))
+	for i, file := range files {
+		results[i].Key = file
+		key, err := ts.key(file)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		keys = append(keys, key)
+		index = append(index, i)
+	}
+	for j, res := range DeleteObjects(ctx, ts.backend, keys, DefaultBatchConcurrency) {
+		results[index[j]].Err = res.Err
+	}
+	return results
+}
+
+func (ts *TenantStore) ListObjects(ctx context.Context) <-chan ObjectInfo {
+	return withoutListingErrors(ts.ListObjectsWithOptions(ctx, ListOptions{}))
+}
+
+// ListObjectsWithOptions lists the objects of the tenant. Prefix and StartAfter
+// are relative to the tenant.
+func (ts *TenantStore) ListObjectsWithOptions(ctx context.Context, opts ListOptions) <-chan ObjectInfo {
+	opts.Prefix = ts.prefix + opts.Prefix
+	if opts.StartAfter != "" {
+		opts.StartAfter = ts.prefix + opts.StartAfter
+	}
+	listing := ts.backend.ListObjectsWithOptions(ctx, opts)
+	objects := make(chan ObjectInfo, 10)
+	go func() {
+		defer close(objects)
+		for info := range listing {
+			if info.Err == nil && !strings.HasPrefix(info.Key, ts.prefix) {
+				continue
+			}
+			select {
+			case objects <- ts.info(info):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return objects
+}
+
+// ListenObjectEvents subscribes to changes of the tenant's objects under the prefix.
+func (ts *TenantStore) ListenObjectEvents(ctx context.Context, prefix string) <-chan ObjectEvent {
+	backendEvents, err := ListenObjectEvents(ctx, ts.backend, ts.prefix+prefix)
+	if err != nil {
+		return failedObjectEvents(err)
+	}
+	events := make(chan ObjectEvent, 10)
+	go func() {
+		defer close(events)
+		for event := range backendEvents {
+			if event.Err == nil {
+				file, ok := strings.CutPrefix(event.Key, ts.prefix)
+				if !ok {
+					continue
+				}
+				event.Key = file
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events
+}
+
+// StoreName returns the name of the shared backend.
+func (ts *TenantStore) StoreName() string {
+	return ts.backend.StoreName()
+}
+
+// key returns the backend key of the file. Keys with relative path segments are
+// refused, since path based backends such as FileStore would resolve them into
+// another tenant.
+func (ts *TenantStore) key(file string) (string, error) {
+	for _, segment := range strings.Split(file, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", NewErrorE(http.StatusBadRequest, os.ErrInvalid).
+				Str("bucket", ts.backend.StoreName()).Str("tenant", ts.tenant).Str("file", file).
+				Msg("Invalid object key for tenant.")
+		}
+	}
+	return ts.prefix + file, nil
+}
+
+func (ts *TenantStore) keys(src, dst string) (string, string, error) {
+	srcKey, err := ts.key(src)
+	if err != nil {
+		return "", "", err
+	}
+	dstKey, err := ts.key(dst)
+	return srcKey, dstKey, err
+}
+
+// info strips the tenant prefix from the object key.
+func (ts *TenantStore) info(info ObjectInfo) ObjectInfo {
+	info.Key = strings.TrimPrefix(info.Key, ts.prefix)
+	return info
+}
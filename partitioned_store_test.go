@@ -0,0 +1,87 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestPartitionedStore(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore("test")
+	ps, err := NewPartitionedStore(ms, PartitionOptions{Tenants: []string{"p1", "p2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p1, err := ps.Tenant("p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := ps.Tenant("p2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p1.PutObject(ctx, "a", []byte("123")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p1.PutObject(ctx, "b", []byte("4")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p2.PutObject(ctx, "a", []byte("56")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.PutObject(ctx, "gone/a", []byte("7")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := ms.GetObject(ctx, "p1/a"); err != nil {
+		t.Errorf("expected tenant key to be prefixed but got %v", err)
+	}
+	if data, info, err := p2.GetObject(ctx, "a"); err != nil || string(data) != "56" || info.Key != "a" {
+		t.Errorf("expected p2 to read its own object but got %q %q (%v)", data, info.Key, err)
+	}
+	var keys []string
+	for info := range p1.ListObjects(ctx) {
+		keys = append(keys, info.Key)
+	}
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Errorf("expected p1 listing [a b] but got %v", keys)
+	}
+	if _, _, err := p1.GetObject(ctx, "../p2/a"); errorStatus(err) != http.StatusBadRequest {
+		t.Errorf("expected escaping key to be refused but got %v", err)
+	}
+	if _, err := ps.Tenant("gone"); !errors.Is(err, ErrInvalidTenant) {
+		t.Errorf("expected unknown tenant to be refused but got %v", err)
+	}
+
+	tenants, err := ps.Tenants(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TenantUsage{
+		{Tenant: "gone", Objects: 1, Bytes: 1},
+		{Tenant: "p1", Known: true, Objects: 2, Bytes: 4},
+		{Tenant: "p2", Known: true, Objects: 1, Bytes: 2},
+	}
+	if len(tenants) != len(want) {
+		t.Fatalf("expected %v but got %v", want, tenants)
+	}
+	for i := range want {
+		if tenants[i] != want[i] {
+			t.Errorf("expected %v but got %v", want[i], tenants[i])
+		}
+	}
+
+	deleted, err := ps.DeleteTenant(ctx, "p1")
+	if err != nil || deleted.Objects != 2 || deleted.Bytes != 4 {
+		t.Errorf("expected 2 objects and 4 bytes to be deleted but got %+v (%v)", deleted, err)
+	}
+	if usage, err := ps.Usage(ctx, "p1"); err != nil || usage.Objects != 0 {
+		t.Errorf("expected p1 to be empty but got %+v (%v)", usage, err)
+	}
+	if usage, err := ps.Usage(ctx, "p2"); err != nil || usage.Objects != 1 {
+		t.Errorf("expected p2 to be untouched but got %+v (%v)", usage, err)
+	}
+}
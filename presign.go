@@ -0,0 +1,69 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// DefaultPresignExpiry is used if no expiry is provided in PresignOptions.
+const DefaultPresignExpiry = 15 * time.Minute
+
+// PresignStore is implemented by stores that can hand out URLs for transferring
+// objects directly between clients and the bucket.
+//
+// EncryptedStore and CompressedStore do not implement it: the bucket only holds
+// encrypted or compressed data, so those objects must pass through the service.
+type PresignStore interface {
+	PresignGetObject(ctx context.Context, file string, opts PresignOptions) (PresignedRequest, error)
+	PresignPutObject(ctx context.Context, file string, opts PresignOptions) (PresignedRequest, error)
+}
+
+// PresignOptions restricts a presigned request.
+type PresignOptions struct {
+	// Expiry is how long the request is valid. Defaults to DefaultPresignExpiry, max 7 days.
+	Expiry time.Duration
+	// ContentType is returned as the response content type of downloads and
+	// must be sent by the client on uploads. Defaults to the store content type on uploads.
+	ContentType string
+	// ContentDisposition is returned as the response content disposition of downloads.
+	ContentDisposition string
+	// MinSize and MaxSize restrict the upload size. Uploads with a size restriction
+	// use a POST policy instead of a PUT URL.
+	MinSize, MaxSize int64
+}
+
+// PresignedRequest describes the request a client must make to transfer an object.
+type PresignedRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	// Header must be sent with the request.
+	Header http.Header `json:"header,omitempty"`
+	// FormData must be sent as multipart form fields, followed by the "file" field, for POST uploads.
+	FormData map[string]string `json:"formData,omitempty"`
+	Expires  time.Time         `json:"expires"`
+}
+
+// PresignGetObject creates a download URL for the file if the store implements PresignStore.
+func PresignGetObject(ctx context.Context, store LingioStore, file string, opts PresignOptions) (PresignedRequest, error) {
+	ps, ok := store.(PresignStore)
+	if !ok {
+		return PresignedRequest{}, presignNotSupported(store, file)
+	}
+	return ps.PresignGetObject(ctx, file, opts)
+}
+
+// PresignPutObject creates an upload request for the file if the store implements PresignStore.
+func PresignPutObject(ctx context.Context, store LingioStore, file string, opts PresignOptions) (PresignedRequest, error) {
+	ps, ok := store.(PresignStore)
+	if !ok {
+		return PresignedRequest{}, presignNotSupported(store, file)
+	}
+	return ps.PresignPutObject(ctx, file, opts)
+}
+
+func presignNotSupported(store LingioStore, file string) error {
+	return NewErrorE(http.StatusNotImplemented, ErrNotSupported).Caller(1).
+		Str("bucket", store.StoreName()).Str("file", file).
+		Msg("Store does not support presigned requests, objects must be transferred through the service.")
+}
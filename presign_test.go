@@ -0,0 +1,49 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+func TestPresign(t *testing.T) {
+	ctx := context.Background()
+	mc, err := minio.New("localhost:9000", &minio.Options{
+		Creds:  credentials.NewStaticV4("access", "secret", ""),
+		Region: "us-east-1", // avoids a bucket location request
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := ObjectStore{mc: mc, bucketName: "media"}
+
+	get, err := PresignGetObject(ctx, store, "video.mp4", PresignOptions{ContentType: "video/mp4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if get.Method != http.MethodGet || !strings.Contains(get.URL, "/media/video.mp4?") || !strings.Contains(get.URL, "response-content-type=video%2Fmp4") {
+		t.Errorf("unexpected download request %+v", get)
+	}
+
+	put, err := PresignPutObject(ctx, store, "video.mp4", PresignOptions{ContentType: "video/mp4", MaxSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if put.Method != http.MethodPost || put.FormData["key"] != "video.mp4" || put.FormData["policy"] == "" {
+		t.Errorf("expected a size restricted POST upload but got %+v", put)
+	}
+
+	es, err := NewEncryptedStore(store, "0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lerr *Error
+	if _, err := PresignGetObject(ctx, es, "video.mp4", PresignOptions{}); !errors.Is(err, ErrNotSupported) || !errors.As(err, &lerr) || lerr.HttpStatusCode != http.StatusNotImplemented {
+		t.Errorf("expected encrypted store to refuse presigning but got %v", err)
+	}
+}
@@ -60,6 +60,10 @@ type RedisCache struct {
 
 	redsync  *redsync.Redsync
 	initLock *redsync.Mutex
+
+	blindIndexKey   []byte // derived from the key passed to SetBlindIndexes
+	blindIndexKeyID string
+	blindIndexes    map[string]bool // key names of blind indexes
 }
 
 // NewRedisCache returns an initialized redis cache using name and version.
@@ -75,6 +79,43 @@ func NewRedisCache(client *redis.Client, name, version string) *RedisCache {
 	return rc
 }
 
+// SetBlindIndexes keys the indexes with the key names by the BlindIndex of their
+// values under the key, so that the values are not stored in plaintext in redis
+// keys. Lookups hash the value the same way.
+//
+// The key is per cache: cache keys are scoped by the ID of its blind index key,
+// see BlindIndexKeyID, e.g. people.v1.blind-<key id>.email=<blind index>. Enabling
+// or disabling blind indexes or rotating the key moves the cache to another scope.
+// Index entries of the previous scope are stale and are not read or updated again;
+// the new scope is empty until Init reloads it from the store. Stale entries expire
+// or must be flushed.
+func (c *RedisCache) SetBlindIndexes(key []byte, keyNames ...string) error {
+	if len(key) < minBlindIndexKeySize {
+		return fmt.Errorf("redis cache: blind index key must be at least %d bytes", minBlindIndexKeySize)
+	}
+	indexKey, err := deriveBlindIndexKey(key, "blind-index")
+	if err != nil {
+		return fmt.Errorf("redis cache: %w", err)
+	}
+	keyID, err := blindIndexKeyID(key)
+	if err != nil {
+		return fmt.Errorf("redis cache: %w", err)
+	}
+	c.blindIndexKey = indexKey
+	c.blindIndexKeyID = keyID
+	c.blindIndexes = make(map[string]bool, len(keyNames))
+	for _, keyName := range keyNames {
+		c.blindIndexes[keyName] = true
+	}
+	return nil
+}
+
+// BlindIndexKeyID returns the ID of the blind index key that scopes the cache keys,
+// or "" without blind indexes.
+func (c RedisCache) BlindIndexKeyID() string {
+	return c.blindIndexKeyID
+}
+
 // SetupRedisClient will attempt to 1) create a failover redis client by looking
 // up sentinel addrs using the provided service DNS, or 2) attempt to create a
 // simple redis client using the provided simpleAddr. If all three arguments are
@@ -165,6 +206,9 @@ func formatRedisCacheKey(elems ...string) string {
 func (c RedisCache) baseKey(elems ...string) string {
 	var s []string
 	s = append(s, c.Name, c.Version)
+	if c.blindIndexKeyID != "" {
+		s = append(s, "blind-"+c.blindIndexKeyID)
+	}
 	s = append(s, elems...)
 	return formatRedisCacheKey(s...)
 }
@@ -172,13 +216,22 @@ func (c RedisCache) baseKey(elems ...string) string {
 // Key returns the an index key
 func (c RedisCache) Key(keyName, key string) string {
 	// Example: $scope.id=p123
-	return c.baseKey(keyName) + "=" + key
+	return c.baseKey(keyName) + "=" + c.indexValue(keyName, key)
 }
 
 // ETagKey returns the etag key for an index key
 func (c RedisCache) ETagKey(keyName, key string) string {
 	// Example: GetAllByPartner --> $scope.etag.partnerID=nobina
-	return c.baseKey("etag", keyName) + "=" + key
+	return c.baseKey("etag", keyName) + "=" + c.indexValue(keyName, key)
+}
+
+// indexValue returns the blind index of the value if the index is blind.
+func (c RedisCache) indexValue(keyName, value string) string {
+	if c.blindIndexes[keyName] {
+		// Example: $scope.email=Qm9i...
+		return blindIndex(c.blindIndexKey, value)
+	}
+	return value
 }
 
 // InitKey returns the key for checking and storing initialization status
@@ -0,0 +1,408 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned with status 503 while the circuit breaker of a ResilientStore is open.
+var ErrCircuitOpen = errors.New("store circuit breaker is open")
+
+// ResilienceOptions configures a ResilientStore. Zero values use the defaults.
+type ResilienceOptions struct {
+	// MaxAttempts is the number of attempts per operation, including the first. Defaults to 3.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry, doubled for every further
+	// retry up to MaxBackoff. The delays are jittered. Defaults to 100ms and 2s.
+	InitialBackoff, MaxBackoff time.Duration
+	// Timeouts limits each attempt of an operation, e.g. Timeouts[OpGetObject].
+	// Operations without a timeout only end with the caller context.
+	Timeouts map[string]time.Duration
+
+	// BreakerThreshold is the number of consecutive transient failures that opens
+	// the circuit breaker. Defaults to 5.
+	BreakerThreshold int
+	// BreakerCooldown is how long the breaker stays open before a single trial
+	// operation is let through. Defaults to 30s.
+	BreakerCooldown time.Duration
+}
+
+// ResilientStore retries transient failures of the backend with exponential backoff
+// and stops calling the backend while it keeps failing. Transient failures are
+// server errors (5xx, including SlowDown), 408, 429 and attempts that exceeded
+// their timeout. Other errors, e.g. 404 and 412, are returned immediately.
+//
+// While the circuit breaker is open, operations fail with a 503 wrapping
+// ErrCircuitOpen without reaching the backend.
+//
+// Writes with preconditions may report ErrPreconditionFailed if an attempt
+// succeeded but its response was lost. Streamed writes are not retried.
+type ResilientStore struct {
+	backend LingioStore
+	opts    ResilienceOptions
+	breaker circuitBreaker
+}
+
+// NewResilientStore initializes a lingio store that retries failed backend operations.
+func NewResilientStore(backend LingioStore, opts ResilienceOptions) *ResilientStore {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 3
+	}
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = 100 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 2 * time.Second
+	}
+	if opts.BreakerThreshold <= 0 {
+		opts.BreakerThreshold = 5
+	}
+	if opts.BreakerCooldown <= 0 {
+		opts.BreakerCooldown = 30 * time.Second
+	}
+	return &ResilientStore{
+		backend: backend,
+		opts:    opts,
+		breaker: circuitBreaker{
+			threshold: opts.BreakerThreshold,
+			cooldown:  opts.BreakerCooldown,
+			now:       time.Now,
+		},
+	}
+}
+
+func (rs *ResilientStore) GetObject(ctx context.Context, file string) ([]byte, ObjectInfo, error) {
+	type result struct {
+		data []byte
+		info ObjectInfo
+	}
+	res, err := retry(ctx, rs, OpGetObject, file, func(ctx context.Context) (result, error) {
+		data, info, err := rs.backend.GetObject(ctx, file)
+		return result{data, info}, err
+	})
+	return res.data, res.info, err
+}
+
+func (rs *ResilientStore) PutObject(ctx context.Context, file string, data []byte) (ObjectInfo, error) {
+	return rs.PutObjectWithOptions(ctx, file, data, PutOptions{})
+}
+
+func (rs *ResilientStore) PutObjectWithOptions(ctx context.Context, file string, data []byte, opts PutOptions) (ObjectInfo, error) {
+	return retry(ctx, rs, OpPutObject, file, func(ctx context.Context) (ObjectInfo, error) {
+		return rs.backend.PutObjectWithOptions(ctx, file, data, opts)
+	})
+}
+
+// GetObjectReader retries opening the object. Failures while reading are returned to the caller.
+func (rs *ResilientStore) GetObjectReader(ctx context.Context, file string) (io.ReadCloser, ObjectInfo, error) {
+	type result struct {
+		r    io.ReadCloser
+		info ObjectInfo
+	}
+	// the attempt timeout would cut the read short, so only the caller context applies
+	res, err := retry(ctx, rs, "", file, func(ctx context.Context) (result, error) {
+		r, info, err := GetObjectReader(ctx, rs.backend, file)
+		return result{r, info}, err
+	})
+	return res.r, res.info, err
+}
+
+// PutObjectReader is attempted once, since r cannot be read again.
+func (rs *ResilientStore) PutObjectReader(ctx context.Context, file string, r io.Reader, size int64, opts PutOptions) (ObjectInfo, error) {
+	if err := rs.breaker.allow(rs.backend.StoreName(), file); err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := PutObjectReader(ctx, rs.backend, file, r, size, opts)
+	rs.breaker.record(err)
+	return info, err
+}
+
+func (rs *ResilientStore) DeleteObject(ctx context.Context, file string) error {
+	return rs.DeleteObjectWithOptions(ctx, file, DeleteOptions{})
+}
+
+func (rs *ResilientStore) DeleteObjectWithOptions(ctx context.Context, file string, opts DeleteOptions) error {
+	_, err := retry(ctx, rs, OpDeleteObject, file, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, rs.backend.DeleteObjectWithOptions(ctx, file, opts)
+	})
+	return err
+}
+
+func (rs *ResilientStore) CopyObject(ctx context.Context, src, dst string, opts CopyOptions) (ObjectInfo, error) {
+	return retry(ctx, rs, OpCopyObject, dst, func(ctx context.Context) (ObjectInfo, error) {
+		return rs.backend.CopyObject(ctx, src, dst, opts)
+	})
+}
+
+func (rs *ResilientStore) MoveObject(ctx context.Context, src, dst string, opts CopyOptions) (ObjectInfo, error) {
+	return retry(ctx, rs, OpCopyObject, dst, func(ctx context.Context) (ObjectInfo, error) {
+		return rs.backend.MoveObject(ctx, src, dst, opts)
+	})
+}
+
+// DeleteObjects removes the files, in bulk if the backend implements BatchDeleter.
+// Files that failed with a transient error are retried.
+func (rs *ResilientStore) DeleteObjects(ctx context.Context, files []string) []BatchResult {
+	results := make([]BatchResult, len(files))
+	pending := make([]int, len(files))
+	for i := range files {
+		pending[i] = i
+	}
+	for attempt := 1; ; attempt++ {
+		if err := rs.breaker.allow(rs.backend.StoreName(), ""); err != nil {
+			for _, i := range pending {
+				results[i] = BatchResult{Key: files[i], Err: err}
+			}
+			return results
+		}
+		batch := make([]string, len(pending))
+		for j, i := range pending {
+			batch[j] = files[i]
+		}
+		var failed []int
+		var lastErr error
+		for j, res := range DeleteObjects(ctx, rs.backend, batch, DefaultBatchConcurrency) {
+			results[pending[j]] = res
+			if isTransient(res.Err) {
+				failed = append(failed, pending[j])
+				lastErr = res.Err
+			}
+		}
+		if ctx.Err() != nil {
+			rs.breaker.release()
+			return results
+		}
+		rs.breaker.record(lastErr)
+		if len(failed) == 0 || attempt == rs.opts.MaxAttempts || !rs.backoff(ctx, attempt) {
+			return results
+		}
+		pending = failed
+	}
+}
+
+func (rs *ResilientStore) ListObjects(ctx context.Context) <-chan ObjectInfo {
+	return withoutListingErrors(rs.ListObjectsWithOptions(ctx, ListOptions{}))
+}
+
+// ListObjectsWithOptions lists the backend. If the listing fails with a transient
+// error, it is resumed after the last listed key.
+func (rs *ResilientStore) ListObjectsWithOptions(ctx context.Context, opts ListOptions) <-chan ObjectInfo {
+	objects := make(chan ObjectInfo, 10)
+	go func() {
+		defer close(objects)
+		for attempt := 1; ; attempt++ {
+			err := rs.breaker.allow(rs.backend.StoreName(), "")
+			if err == nil {
+				var listed int
+				listed, err = rs.listOnce(ctx, &opts, objects)
+				if ctx.Err() != nil {
+					rs.breaker.release()
+					return
+				}
+				rs.breaker.record(err)
+				if opts.MaxKeys > 0 {
+					opts.MaxKeys -= listed
+				}
+			}
+			if err == nil {
+				return
+			}
+			if !isTransient(err) || attempt == rs.opts.MaxAttempts || !rs.backoff(ctx, attempt) {
+				select {
+				case objects <- ObjectInfo{Err: err}:
+				case <-ctx.Done():
+				}
+				return
+			}
+		}
+	}()
+	return objects
+}
+
+// listOnce forwards the listing and advances opts.StartAfter past every forwarded
+// object, so that a failed listing can be resumed.
+func (rs *ResilientStore) listOnce(ctx context.Context, opts *ListOptions, objects chan<- ObjectInfo) (listed int, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for info := range rs.backend.ListObjectsWithOptions(ctx, *opts) {
+		if info.Err != nil {
+			return listed, info.Err
+		}
+		select {
+		case objects <- info:
+		case <-ctx.Done():
+			return listed, ctx.Err()
+		}
+		opts.StartAfter = info.Key
+		listed++
+	}
+	return listed, nil
+}
+
+func (rs *ResilientStore) GetObjectVersion(ctx context.Context, file, versionID string) ([]byte, ObjectInfo, error) {
+	vs, err := versionedBackend(rs.backend)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	type result struct {
+		data []byte
+		info ObjectInfo
+	}
+	res, err := retry(ctx, rs, OpGetObject, file, func(ctx context.Context) (result, error) {
+		data, info, err := vs.GetObjectVersion(ctx, file, versionID)
+		return result{data, info}, err
+	})
+	return res.data, res.info, err
+}
+
+func (rs *ResilientStore) ListObjectVersions(ctx context.Context, file string) ([]ObjectInfo, error) {
+	vs, err := versionedBackend(rs.backend)
+	if err != nil {
+		return nil, err
+	}
+	return retry(ctx, rs, OpListObjects, file, func(ctx context.Context) ([]ObjectInfo, error) {
+		return vs.ListObjectVersions(ctx, file)
+	})
+}
+
+func (rs *ResilientStore) RestoreObjectVersion(ctx context.Context, file, versionID string) (ObjectInfo, error) {
+	vs, err := versionedBackend(rs.backend)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return retry(ctx, rs, OpCopyObject, file, func(ctx context.Context) (ObjectInfo, error) {
+		return vs.RestoreObjectVersion(ctx, file, versionID)
+	})
+}
+
+func (rs *ResilientStore) PresignGetObject(ctx context.Context, file string, opts PresignOptions) (PresignedRequest, error) {
+	return PresignGetObject(ctx, rs.backend, file, opts)
+}
+
+func (rs *ResilientStore) PresignPutObject(ctx context.Context, file string, opts PresignOptions) (PresignedRequest, error) {
+	return PresignPutObject(ctx, rs.backend, file, opts)
+}
+
+func (rs *ResilientStore) ListenObjectEvents(ctx context.Context, prefix string) <-chan ObjectEvent {
+	events, err := ListenObjectEvents(ctx, rs.backend, prefix)
+	if err != nil {
+		return failedObjectEvents(err)
+	}
+	return events
+}
+
+func (rs *ResilientStore) StoreName() string {
+	return rs.backend.StoreName()
+}
+
+// retry calls fn until it succeeds, fails with a non-transient error or runs out
+// of attempts. Each attempt is limited by the timeout configured for op.
+func retry[T any](ctx context.Context, rs *ResilientStore, op, file string, fn func(ctx context.Context) (T, error)) (res T, err error) {
+	for attempt := 1; ; attempt++ {
+		if err = rs.breaker.allow(rs.backend.StoreName(), file); err != nil {
+			return res, err
+		}
+		actx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout := rs.opts.Timeouts[op]; timeout > 0 {
+			actx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		res, err = fn(actx)
+		cancel()
+		if ctx.Err() != nil {
+			// the caller gave up, which says nothing about the backend
+			rs.breaker.release()
+			return res, err
+		}
+		rs.breaker.record(err)
+		if !isTransient(err) || attempt == rs.opts.MaxAttempts || !rs.backoff(ctx, attempt) {
+			return res, err
+		}
+	}
+}
+
+// backoff waits before the next attempt and reports false if ctx is done first.
+func (rs *ResilientStore) backoff(ctx context.Context, attempt int) bool {
+	delay := rs.opts.InitialBackoff << (attempt - 1)
+	if delay <= 0 || delay > rs.opts.MaxBackoff {
+		delay = rs.opts.MaxBackoff
+	}
+	delay = delay/2 + rand.N(delay/2+1) // jitter
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// isTransient reports whether the operation may succeed if it is retried.
+func isTransient(err error) bool {
+	if err == nil || errors.Is(err, ErrCircuitOpen) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	switch code := errorStatus(err); code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	case http.StatusNotImplemented:
+		return false
+	default:
+		return code >= http.StatusInternalServerError
+	}
+}
+
+// circuitBreaker opens after threshold consecutive transient failures and lets a
+// single trial through after cooldown. A successful trial closes it again.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+func (cb *circuitBreaker) allow(bucket, file string) error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.failures < cb.threshold {
+		return nil
+	}
+	if !cb.trial && cb.now().Sub(cb.openedAt) >= cb.cooldown {
+		cb.trial = true
+		return nil
+	}
+	return NewErrorE(http.StatusServiceUnavailable, ErrCircuitOpen).
+		Str("bucket", bucket).Str("file", file).Msg("Object storage is unavailable.")
+}
+
+// release ends a trial without a result.
+func (cb *circuitBreaker) release() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.trial = false
+}
+
+func (cb *circuitBreaker) record(err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if !isTransient(err) {
+		cb.failures, cb.trial = 0, false
+		return
+	}
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		cb.openedAt, cb.trial = cb.now(), false
+	}
+}
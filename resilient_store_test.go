@@ -0,0 +1,97 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newTestResilientStore(backend LingioStore) *ResilientStore {
+	return NewResilientStore(backend, ResilienceOptions{
+		InitialBackoff:   time.Millisecond,
+		MaxBackoff:       time.Millisecond,
+		BreakerThreshold: 3,
+		BreakerCooldown:  time.Minute,
+	})
+}
+
+func TestResilientStoreRetries(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore("test")
+	rs := newTestResilientStore(ms)
+	if _, err := ms.PutObject(ctx, "a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	ms.InjectFault(Fault{Op: OpGetObject, Err: NewError(http.StatusServiceUnavailable).Msg("SlowDown"), Times: 2})
+	if data, _, err := rs.GetObject(ctx, "a"); err != nil || string(data) != "1" {
+		t.Errorf("expected get to succeed on third attempt but got %q (%v)", data, err)
+	}
+
+	ms.InjectFault(Fault{Op: OpGetObject, Err: NewErrorE(http.StatusNotFound, ErrObjectNotFound), Times: 1})
+	ms.InjectFault(Fault{Op: OpGetObject, Err: NewError(http.StatusServiceUnavailable), Times: 1})
+	if _, _, err := rs.GetObject(ctx, "a"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expected not found to be returned without retry but got %v", err)
+	}
+	ms.ClearFaults()
+
+	rs.opts.Timeouts = map[string]time.Duration{OpPutObject: 10 * time.Millisecond}
+	ms.InjectFault(Fault{Op: OpPutObject, Latency: time.Second, Times: 1})
+	if _, err := rs.PutObject(ctx, "b", []byte("2")); err != nil {
+		t.Errorf("expected put to succeed after timed out attempt but got %v", err)
+	}
+}
+
+func TestResilientStoreResumesListing(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore("test")
+	for _, key := range []string{"1", "2", "3", "4"} {
+		if _, err := ms.PutObject(ctx, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ms.InjectFault(Fault{Op: OpListObjects, Err: NewError(http.StatusInternalServerError), After: 2, Times: 1})
+
+	var keys []string
+	for info := range newTestResilientStore(ms).ListObjectsWithOptions(ctx, ListOptions{}) {
+		if info.Err != nil {
+			t.Fatal(info.Err)
+		}
+		keys = append(keys, info.Key)
+	}
+	if len(keys) != 4 || keys[2] != "3" {
+		t.Errorf("expected resumed listing of 4 keys but got %v", keys)
+	}
+}
+
+func TestResilientStoreCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	ms := NewMemoryStore("test")
+	rs := newTestResilientStore(ms)
+	rs.opts.MaxAttempts = 1
+	rs.breaker.now = func() time.Time { return now }
+
+	ms.InjectFault(Fault{Op: OpGetObject, Err: NewError(http.StatusBadGateway)})
+	for i := 0; i < 3; i++ {
+		if _, _, err := rs.GetObject(ctx, "a"); errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("expected breaker to be closed on attempt %d", i+1)
+		}
+	}
+	_, _, err := rs.GetObject(ctx, "a")
+	if !errors.Is(err, ErrCircuitOpen) || errorStatus(err) != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 ErrCircuitOpen but got %v", err)
+	}
+
+	// after the cooldown a single successful trial closes the breaker
+	ms.ClearFaults()
+	now = now.Add(time.Minute)
+	if _, _, err := rs.GetObject(ctx, "a"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expected trial to reach the backend but got %v", err)
+	}
+	if _, _, err := rs.GetObject(ctx, "a"); errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected breaker to be closed after trial but got %v", err)
+	}
+}
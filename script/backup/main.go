@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/lingio/go-common"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type config struct {
+	Minio minioConfig
+}
+type minioConfig struct {
+	Host, AccessKeyID string
+	SSL               bool
+}
+
+// Usage:
+//
+// MINIO_SECRET=yaya go run ./script/backup --config=<config> --bucket=people backup people.tar.zst
+// MINIO_SECRET=yaya go run ./script/backup --config=<config> --bucket=people --resume=people.tar.zst backup people-2.tar.zst
+// MINIO_SECRET=yaya go run ./script/backup --config=<config> --bucket=people restore people.tar.zst people-2.tar.zst
+// go run ./script/backup verify people.tar.zst
+//
+// With ENCRYPTION_KEY and --decrypt, objects are decrypted on backup and encrypted on restore.
+// ENCRYPTION_KEY may be a keyring, see common.ParseKeyring.
+func main() {
+	env := flag.String("config", "", "json config file with minio endpoint")
+	bucket := flag.String("bucket", "", "bucket to back up or restore into")
+	decrypt := flag.Bool("decrypt", false, "back up decrypted objects through an encrypted store (requires ENCRYPTION_KEY)")
+	prefix := flag.String("prefix", "", "backup only: only back up keys with prefix")
+	resume := flag.String("resume", "", "backup only: incomplete archive to resume from")
+	skipExisting := flag.Bool("skip-existing", false, "restore only: do not overwrite existing objects")
+	concurrency := flag.Int("concurrency", common.DefaultBatchConcurrency, "objects to read or write concurrently")
+	minioSecret := os.Getenv("MINIO_SECRET")
+	serviceKey := os.Getenv("ENCRYPTION_KEY")
+	flag.Parse()
+
+	log.Default().SetOutput(os.Stderr)
+	log.Default().SetPrefix("[backup] ")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	command, files := flag.Arg(0), flag.Args()
+	if len(files) > 0 {
+		files = files[1:]
+	}
+	if len(files) == 0 {
+		trap(errors.New("usage: backup [flags] backup|restore|verify archive..."))
+	}
+
+	if command == "verify" {
+		for _, file := range files {
+			manifest, err := verify(file)
+			trap(err)
+			log.Printf("%s: ok, %d objects from %s (%s)\n", file, len(manifest.Objects), manifest.Store, manifest.Mode)
+		}
+		return
+	}
+
+	if minioSecret == "" {
+		trap(errors.New("missing MINIO_SECRET environment variable"))
+	}
+	if *env == "" || *bucket == "" {
+		trap(errors.New("--config and --bucket must be specified"))
+	}
+	configData, err := os.ReadFile(*env)
+	trap(err)
+	var config config
+	trap(json.Unmarshal(configData, &config))
+
+	minioClient, err := minio.New(config.Minio.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.Minio.AccessKeyID, minioSecret, ""),
+		Secure: config.Minio.SSL,
+	})
+	trap(err)
+
+	var store common.LingioStore
+	store, err = common.NewObjectStore(minioClient, *bucket, common.ObjectStoreConfig{})
+	trap(err)
+	mode := common.BackupRaw
+	if *decrypt {
+		if serviceKey == "" {
+			trap(errors.New("missing ENCRYPTION_KEY environment variable"))
+		}
+		keyring, err := common.ParseKeyring(serviceKey)
+		trap(err)
+		store, err = common.NewKeyringEncryptedStore(store, keyring)
+		trap(err)
+		mode = common.BackupDecrypted
+	}
+
+	switch command {
+	case "backup":
+		if len(files) != 1 {
+			trap(errors.New("backup writes exactly one archive"))
+		}
+		opts := common.BackupOptions{
+			Mode:        mode,
+			Compression: compressionOf(files[0]),
+			Prefix:      *prefix,
+			Concurrency: *concurrency,
+			Progress:    progress("archived"),
+		}
+		if *resume != "" {
+			partial, err := verify(*resume)
+			if !errors.Is(err, common.ErrBackupIncomplete) {
+				trap(fmt.Errorf("resume: %s is not an incomplete archive: %v", *resume, err))
+			}
+			if partial.Mode != mode || partial.Prefix != *prefix {
+				trap(fmt.Errorf("resume: %s was made with mode %s and prefix %q", *resume, partial.Mode, partial.Prefix))
+			}
+			opts.StartAfter = partial.LastKey()
+			log.Println("resuming after", opts.StartAfter)
+		}
+
+		f, err := os.OpenFile(files[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		trap(err)
+		manifest, err := common.Backup(ctx, store, f, opts)
+		trap(errors.Join(err, f.Close()))
+		log.Println("done:", len(manifest.Objects), "objects archived")
+
+	case "restore":
+		var restored, skipped int
+		for _, file := range files {
+			f, err := os.Open(file)
+			trap(err)
+			result, err := common.Restore(ctx, store, f, common.RestoreOptions{
+				Mode:         mode,
+				SkipExisting: *skipExisting,
+				Concurrency:  *concurrency,
+				Progress:     progress("restored"),
+			})
+			f.Close()
+			if errors.Is(err, common.ErrBackupIncomplete) {
+				log.Printf("%s: incomplete archive restored up to %q\n", file, result.Manifest.LastKey())
+			} else {
+				trap(err)
+			}
+			restored += result.Restored
+			skipped += result.Skipped
+		}
+		log.Println("done:", restored, "objects restored,", skipped, "skipped")
+
+	default:
+		trap(fmt.Errorf("unknown command %q", command))
+	}
+}
+
+func verify(file string) (common.BackupManifest, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return common.BackupManifest{}, err
+	}
+	defer f.Close()
+	return common.VerifyBackup(f)
+}
+
+func compressionOf(file string) common.Compression {
+	switch {
+	case strings.HasSuffix(file, ".zst"):
+		return common.CompressionZstd
+	case strings.HasSuffix(file, ".gz"), strings.HasSuffix(file, ".tgz"):
+		return common.CompressionGzip
+	}
+	return ""
+}
+
+func progress(verb string) func(common.BackupEntry) {
+	var n int
+	return func(common.BackupEntry) {
+		if n++; n%10_000 == 0 {
+			log.Println(n, "objects", verb)
+		}
+	}
+}
+
+func trap(err error) {
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
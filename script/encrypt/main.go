@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -23,18 +24,22 @@ type Object struct {
 type dummyStore struct {
 	decoder *json.Decoder
 	encoder *json.Encoder
+	current Object // last object read from stdin
 }
 
 //
 // Usage:
 //
 // ENCRYPTION_KEY=256bit-key go run ./script/encrypt [--decrypt]
+//
+// ENCRYPTION_KEY may be a keyring, see common.ParseKeyring. Objects are encrypted
+// with v2 crypto. The crypto of decrypted objects is detected from their header;
+// objects without a header that v2 crypto cannot decrypt are decrypted with v1 crypto.
 func main() {
 	log.Default().SetOutput(os.Stderr)
 	log.Default().SetPrefix("[encrypt]")
 
 	decrypt := flag.Bool("decrypt", false, "decrypt stdin (instead of encrypt)")
-	cryptostore := flag.String("crypto", "", "crypto store to pass through: v1 (insecure) or v2 (secure)")
 	serviceKey := os.Getenv("ENCRYPTION_KEY")
 	flag.Parse()
 
@@ -47,37 +52,41 @@ func main() {
 		encoder: json.NewEncoder(os.Stdout),
 	}
 
-	var err error
-	var store common.LingioStore
-	if *cryptostore == "v1" {
-		store, err = common.NewInsecureEncryptedStore(ds, serviceKey)
-	} else if *cryptostore == "v2" {
-		store, err = common.NewEncryptedStore(ds, serviceKey)
-	} else {
-		trap(fmt.Errorf("unknown crypto store: %q - use either v1 (insecure) or v2 (secure)", *cryptostore))
-	}
+	keyring, err := common.ParseKeyring(serviceKey)
 	trap(err)
+	store, err := common.NewKeyringEncryptedStore(ds, keyring)
+	trap(err)
+	var insecure common.LingioStore // objects of v1 crypto have no header
+	if len(serviceKey) == 32 {
+		insecure, err = common.NewInsecureEncryptedStore(ds, serviceKey)
+		trap(err)
+	}
 
 	if *decrypt {
 		for {
-			data, info, err := store.GetObject(context.TODO(), "dummyfilename16b") // read from stdin and decrypt
-			if errors.Is(err, io.EOF) {
+			if err := ds.decoder.Decode(&ds.current); errors.Is(err, io.EOF) {
 				break
 			} else if err != nil {
 				trap(fmt.Errorf("read: %w", err))
 			}
+			data, info, err := store.GetObject(context.TODO(), "dummyfilename16b") // decrypt the object read from stdin
+			if errors.Is(err, common.ErrDecryptionFailed) && insecure != nil {
+				data, info, err = insecure.GetObject(context.TODO(), "dummyfilename16b")
+			}
+			if err != nil {
+				trap(fmt.Errorf("decrypt: %w", err))
+			}
 			_, lerr := ds.PutObject(context.TODO(), info.Key, data) // write plain text to stdout
 			trap(lerr)
 		}
 	} else {
 		for {
-			data, info, err := ds.GetObject(context.TODO(), "") // read directly from stdin
-			if errors.Is(err, io.EOF) {
+			if err := ds.decoder.Decode(&ds.current); errors.Is(err, io.EOF) {
 				break
 			} else if err != nil {
 				trap(fmt.Errorf("read: %w", err))
 			}
-			_, lerr := store.PutObject(context.TODO(), info.Key, data) // write encrypted to stdout
+			_, lerr := store.PutObject(context.TODO(), ds.current.Key, ds.current.Data) // write encrypted to stdout
 			trap(lerr)
 		}
 	}
@@ -93,13 +102,10 @@ func trap(err error) {
 	}
 }
 
-// GetObject is supposed to be called when we're trying to decrypt an encrypted stdin.
+// GetObject returns a copy of the last object read from stdin, since decryption
+// may modify the data.
 func (ds dummyStore) GetObject(ctx context.Context, filename string) ([]byte, common.ObjectInfo, error) {
-	var obj Object
-	if err := ds.decoder.Decode(&obj); err != nil {
-		return nil, common.ObjectInfo{}, common.NewErrorE(http.StatusInternalServerError, err)
-	}
-	return obj.Data, obj.ObjectInfo, nil
+	return bytes.Clone(ds.current.Data), ds.current.ObjectInfo, nil
 }
 
 // PutObject is supposed to be called when we're trying to encrypt a plain-text stdin.
@@ -115,12 +121,28 @@ func (ds dummyStore) PutObject(ctx context.Context, file string, data []byte) (c
 	return common.ObjectInfo{}, nil
 }
 
+func (ds dummyStore) PutObjectWithOptions(ctx context.Context, file string, data []byte, opts common.PutOptions) (common.ObjectInfo, error) {
+	return ds.PutObject(ctx, file, data)
+}
+
 func (ds dummyStore) DeleteObject(ctx context.Context, file string) error {
 	return nil
 }
+func (ds dummyStore) DeleteObjectWithOptions(ctx context.Context, file string, opts common.DeleteOptions) error {
+	return nil
+}
+func (ds dummyStore) CopyObject(ctx context.Context, src, dst string, opts common.CopyOptions) (common.ObjectInfo, error) {
+	return common.ObjectInfo{}, nil
+}
+func (ds dummyStore) MoveObject(ctx context.Context, src, dst string, opts common.CopyOptions) (common.ObjectInfo, error) {
+	return common.ObjectInfo{}, nil
+}
 func (ds dummyStore) ListObjects(ctx context.Context) <-chan common.ObjectInfo {
 	return nil
 }
+func (ds dummyStore) ListObjectsWithOptions(ctx context.Context, opts common.ListOptions) <-chan common.ObjectInfo {
+	return nil
+}
 func (ds dummyStore) StoreName() string {
 	return "dummy store"
 }
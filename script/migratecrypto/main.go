@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/lingio/go-common"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type config struct {
+	Minio minioConfig
+}
+type minioConfig struct {
+	Host, AccessKeyID string
+	SSL               bool
+}
+
+// Usage:
+//
+// ENCRYPTION_KEY=256bitkey MINIO_SECRET=yaya go run ./script/migratecrypto --config=<config> --bucket=people --json --dry-run
+// ENCRYPTION_KEY=256bitkey MINIO_SECRET=yaya go run ./script/migratecrypto --config=<config> --bucket=people --json --report=people.json
+//
+// Rewrites objects encrypted with insecure v1 crypto using v2 crypto. An interrupted
+// migration can be resumed with --resume=<checkpoint> from the report.
+//
+// ENCRYPTION_KEY=v4:2028:<new key>,<old key> MINIO_SECRET=yaya go run ./script/migratecrypto --config=<config> --bucket=people --to-v4
+//
+// Rewrites objects encrypted with the v2 keys of the keyring using its primary v4 key.
+func main() {
+	env := flag.String("config", "", "json config file with minio endpoint")
+	bucket := flag.String("bucket", "", "bucket to migrate")
+	dryRun := flag.Bool("dry-run", false, "decrypt and validate objects without migrating them")
+	resume := flag.String("resume", "", "encrypted key to resume after, e.g. the checkpoint of a previous report")
+	validateJSON := flag.Bool("json", false, "report objects that do not decrypt to valid json as undecryptable")
+	toV4 := flag.Bool("to-v4", false, "migrate objects of the v2 keys in ENCRYPTION_KEY to its primary v4 key")
+	reportFile := flag.String("report", "", "write the migration report as json to this file")
+	concurrency := flag.Int("concurrency", common.DefaultBatchConcurrency, "objects to migrate concurrently")
+	minioSecret := os.Getenv("MINIO_SECRET")
+	serviceKey := os.Getenv("ENCRYPTION_KEY")
+	flag.Parse()
+
+	log.Default().SetOutput(os.Stderr)
+	log.Default().SetPrefix("[migratecrypto] ")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if minioSecret == "" || serviceKey == "" {
+		trap(errors.New("missing MINIO_SECRET or ENCRYPTION_KEY environment variable"))
+	}
+	if *env == "" || *bucket == "" {
+		trap(errors.New("--config and --bucket must be specified"))
+	}
+	configData, err := os.ReadFile(*env)
+	trap(err)
+	var config config
+	trap(json.Unmarshal(configData, &config))
+
+	minioClient, err := minio.New(config.Minio.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.Minio.AccessKeyID, minioSecret, ""),
+		Secure: config.Minio.SSL,
+	})
+	trap(err)
+	store, err := common.NewObjectStore(minioClient, *bucket, common.ObjectStoreConfig{})
+	trap(err)
+
+	opts := common.MigrateCryptoOptions{
+		DryRun:      *dryRun,
+		StartAfter:  *resume,
+		Concurrency: *concurrency,
+		Progress: func(r common.CryptoMigrationReport) {
+			if r.Scanned%10_000 == 0 {
+				log.Println(r.Scanned, "objects scanned,", r.Migrated, "migrated, checkpoint", r.Checkpoint)
+			}
+		},
+	}
+	if *validateJSON {
+		opts.Validate = func(file string, data []byte) error {
+			if !json.Valid(data) {
+				return errors.New("invalid json")
+			}
+			return nil
+		}
+	}
+	var report common.CryptoMigrationReport
+	if *toV4 {
+		keyring, kerr := common.ParseKeyring(serviceKey)
+		trap(kerr)
+		report, err = common.MigrateV2ToV4(ctx, store, keyring, opts)
+	} else {
+		report, err = common.MigrateV1ToV2(ctx, store, serviceKey, opts)
+	}
+	if *reportFile != "" {
+		data, jerr := json.MarshalIndent(report, "", "  ")
+		trap(jerr)
+		trap(os.WriteFile(*reportFile, data, 0600))
+	}
+	if err != nil {
+		log.Println("interrupted, resume with --resume=" + report.Checkpoint)
+		trap(err)
+	}
+	log.Println("done:", report.Scanned, "objects scanned,", report.Migrated, "migrated,", report.Current, "already migrated,",
+		len(report.Conflicts), "conflicts,", len(report.Undecryptable), "undecryptable,", len(report.Failed), "failed")
+	for _, key := range report.Undecryptable {
+		log.Println("undecryptable:", key)
+	}
+	for key, msg := range report.Failed {
+		log.Println("failed:", key, msg)
+	}
+	if len(report.Failed) > 0 || len(report.Conflicts) > 0 {
+		os.Exit(1)
+	}
+}
+
+func trap(err error) {
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
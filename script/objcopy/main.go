@@ -130,7 +130,7 @@ func main() {
 
 func readAllFromStore(store *common.ObjectStore, keysOnly bool) <-chan Object {
 	const workers = 10
-	listing := store.ListObjects(context.Background())
+	listing := store.ListObjectsWithOptions(context.Background(), common.ListOptions{})
 	objchan := make(chan Object, workers*2)
 	errchan := make([]chan error, workers)
 	for i := 0; i < workers; i++ {
@@ -138,6 +138,10 @@ func readAllFromStore(store *common.ObjectStore, keysOnly bool) <-chan Object {
 		go func(workerId int) {
 			defer close(errchan[workerId])
 			for req := range listing {
+				if req.Err != nil {
+					errchan[workerId] <- fmt.Errorf("list: %w", req.Err)
+					return
+				}
 				if keysOnly {
 					objchan <- Object{
 						ObjectInfo: req,
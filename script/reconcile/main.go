@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/lingio/go-common"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type config struct {
+	Minio  minioConfig
+	Mirror minioConfig
+}
+type minioConfig struct {
+	Host, AccessKeyID string
+	SSL               bool
+}
+
+// Usage:
+//
+// MINIO_SECRET=yaya MIRROR_SECRET=yoyo go run ./script/reconcile --config=<config> --bucket=people
+//
+// Copies objects that are missing or stale in the mirror endpoint of the config from
+// the minio endpoint. Stores generated with WithMirror keep the mirror up to date, but
+// objects written before the mirror was enabled, or while it was failing, are only
+// copied by this script. Run it as a single job, e.g. with --interval=1h.
+func main() {
+	env := flag.String("config", "", "json config file with minio and mirror endpoints")
+	bucket := flag.String("bucket", "", "bucket to reconcile")
+	prefix := flag.String("prefix", "", "only reconcile objects with this key prefix")
+	deleteExtra := flag.Bool("delete-extra", false, "remove objects from the mirror that are not in minio")
+	dryRun := flag.Bool("dry-run", false, "only count the differences")
+	interval := flag.Duration("interval", 0, "reconcile repeatedly with this interval instead of once")
+	concurrency := flag.Int("concurrency", common.DefaultBatchConcurrency, "objects to copy concurrently")
+	minioSecret := os.Getenv("MINIO_SECRET")
+	mirrorSecret := os.Getenv("MIRROR_SECRET")
+	flag.Parse()
+
+	log.Default().SetOutput(os.Stderr)
+	log.Default().SetPrefix("[reconcile] ")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if minioSecret == "" || mirrorSecret == "" {
+		trap(errors.New("missing MINIO_SECRET or MIRROR_SECRET environment variable"))
+	}
+	if *env == "" || *bucket == "" {
+		trap(errors.New("--config and --bucket must be specified"))
+	}
+	configData, err := os.ReadFile(*env)
+	trap(err)
+	var config config
+	trap(json.Unmarshal(configData, &config))
+
+	primary := newObjectStore(config.Minio, minioSecret, *bucket)
+	secondary := newObjectStore(config.Mirror, mirrorSecret, *bucket)
+	mirror := common.NewMirroredStore(primary, secondary, common.MirrorOptions{})
+
+	opts := common.ReconcileOptions{
+		Prefix:      *prefix,
+		DeleteExtra: *deleteExtra,
+		DryRun:      *dryRun,
+		Concurrency: *concurrency,
+	}
+	if *interval > 0 {
+		mirror.RunReconciler(ctx, *interval, opts)
+		return
+	}
+	result, err := mirror.Reconcile(ctx, opts)
+	trap(err)
+	log.Println("done:", result.Missing, "missing,", result.Stale, "stale,", result.Extra, "extra,", result.Failed, "failed")
+	if result.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func newObjectStore(cfg minioConfig, secret, bucket string) common.LingioStore {
+	minioClient, err := minio.New(cfg.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKeyID, secret, ""),
+		Secure: cfg.SSL,
+	})
+	trap(err)
+	store, err := common.NewObjectStore(minioClient, bucket, common.ObjectStoreConfig{})
+	trap(err)
+	return store
+}
+
+func trap(err error) {
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
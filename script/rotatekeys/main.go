@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/lingio/go-common"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type config struct {
+	Minio minioConfig
+}
+type minioConfig struct {
+	Host, AccessKeyID string
+	SSL               bool
+}
+
+// Usage:
+//
+// ENCRYPTION_KEY=2027:<new key>,<old key> MINIO_SECRET=yaya go run ./script/rotatekeys --config=<config> --bucket=people
+//
+// Re-encrypts every object of the bucket with the first (primary) key of the keyring.
+// Rotating to a new v4 key, e.g. ENCRYPTION_KEY=v4:2028:<new key>,<old key>, migrates
+// the bucket to v4 crypto.
+//
+// MINIO_SECRET=yaya go run ./script/rotatekeys --config=<config> --bucket=people --master-keys=new.key,old.key
+//
+// Enables envelope encryption: objects encrypted with the keyring in ENCRYPTION_KEY (if any)
+// are re-encrypted with data keys, and all data keys are rewrapped with the first master key.
+//
+// With --bind, objects written with v2 crypto are rewritten with v3 crypto.
+func main() {
+	env := flag.String("config", "", "json config file with minio endpoint")
+	bucket := flag.String("bucket", "", "bucket to re-encrypt")
+	masterKeys := flag.String("master-keys", "", "comma separated master key files, first one wraps data keys")
+	bind := flag.Bool("bind", false, "rewrite objects with v3 crypto, which authenticates bucket and filename")
+	bindBucket := flag.String("bind-bucket", "", "bucket name authenticated by v3 crypto, if not the bucket name")
+	concurrency := flag.Int("concurrency", common.DefaultBatchConcurrency, "objects to re-encrypt concurrently")
+	minioSecret := os.Getenv("MINIO_SECRET")
+	serviceKey := os.Getenv("ENCRYPTION_KEY")
+	flag.Parse()
+
+	log.Default().SetOutput(os.Stderr)
+	log.Default().SetPrefix("[rotatekeys] ")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if minioSecret == "" || (serviceKey == "" && *masterKeys == "") {
+		trap(errors.New("missing MINIO_SECRET or ENCRYPTION_KEY environment variable"))
+	}
+	if *env == "" || *bucket == "" {
+		trap(errors.New("--config and --bucket must be specified"))
+	}
+	configData, err := os.ReadFile(*env)
+	trap(err)
+	var config config
+	trap(json.Unmarshal(configData, &config))
+	var keyring common.Keyring
+	if serviceKey != "" {
+		keyring, err = common.ParseKeyring(serviceKey)
+		trap(err)
+	}
+
+	minioClient, err := minio.New(config.Minio.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.Minio.AccessKeyID, minioSecret, ""),
+		Secure: config.Minio.SSL,
+	})
+	trap(err)
+	objectStore, err := common.NewObjectStore(minioClient, *bucket, common.ObjectStoreConfig{})
+	trap(err)
+	var store *common.EncryptedStore
+	if *masterKeys != "" {
+		km, err := common.NewLocalKeyManager(strings.Split(*masterKeys, ",")...)
+		trap(err)
+		store, err = common.NewEnvelopeEncryptedStore(ctx, objectStore, km, common.EnvelopeOptions{Keyring: keyring})
+		trap(err)
+	} else {
+		store, err = common.NewKeyringEncryptedStore(objectStore, keyring)
+		trap(err)
+	}
+
+	if *bind {
+		store, err = store.Bind(common.BindOptions{Bucket: *bindBucket})
+		trap(err)
+	}
+
+	opts := common.RotateOptions{
+		Concurrency: *concurrency,
+		Progress: func(r common.RotateResult) {
+			if r.Scanned%10_000 == 0 {
+				log.Println(r.Scanned, "objects scanned,", r.Rotated, "rotated,", r.Failed, "failed")
+			}
+		},
+	}
+	result, err := store.RotateKeys(ctx, opts)
+	trap(err)
+	log.Println("done:", result.Scanned, "objects scanned,", result.Rotated, "rotated,", result.Skipped, "with unknown keys,", result.Failed, "failed")
+	failed := result.Failed
+	if *masterKeys != "" {
+		result, err = store.RewrapKeys(ctx, opts)
+		trap(err)
+		log.Println("done:", result.Scanned, "objects scanned,", result.Rotated, "data keys rewrapped,", result.Skipped, "with unknown master keys,", result.Failed, "failed")
+		failed += result.Failed
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func trap(err error) {
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
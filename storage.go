@@ -37,6 +37,10 @@ type SecondaryIndex struct {
 
 	Name, Type, CacheKey string
 	Optional             bool // is the whole index optional?
+
+	// BlindIndex keys the index by a keyed HMAC of the value instead of the value,
+	// so that e.g. email addresses are not stored in plaintext in the cache.
+	BlindIndex bool
 }
 
 type IndexComponent struct {